@@ -2,13 +2,16 @@ package client
 
 import (
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"goSimDFS/server"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
+	"os"
 	"strconv"
+	"strings"
 )
 
 type Message struct {
@@ -17,15 +20,34 @@ type Message struct {
 }
 type FileSystem interface {
 	Read(string) string
+	Open(string) (io.ReadCloser, error)
+	ReadAt(string, int, int) (io.ReadCloser, error)
 	Write(string, io.Reader)
+	WriteWithReplicas(string, io.Reader, int)
+	WriteErasureCoded(string, io.Reader, string)
+	Append(string, io.Reader)
+	RecordAppend(string, []byte) (int, error)
+	SetReplication(string, int)
 	GetDiskCapacity()
 	Rename(string, string)
-	ListFiles()
+	ListDir(string)
+	Mkdir(string)
+	Rmdir(string)
+	Delete(string)
 	GetFileSize(string)
 	GetFileStat(string)
 	GetNodeStat()
 	GetNodeStatById(int)
-	StopNode()
+	StopNode(int)
+	StopRandomNodes(int, int64)
+	StopRack(int)
+	StartNode(int)
+	RestartNode(int)
+	AddNode(int, int)
+	Decommission(int)
+	Balance(string)
+	Checkpoint()
+	ScrubStat()
 	Kill()
 }
 
@@ -48,6 +70,20 @@ func NewClient(metaconn, chunkconn net.Conn) FileSystem {
 		chunkServerSocket: Socket{encoder: cenc, decoder: cdec}}
 }
 
+// nodeSocket connects to the node process at addr, or returns the chunk
+// server socket when addr is empty. The returned function closes the
+// connection to the node.
+func (c *Client) nodeSocket(addr string) (Socket, func(), error) {
+	if len(addr) == 0 {
+		return c.chunkServerSocket, func() {}, nil
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return Socket{}, nil, err
+	}
+	return Socket{encoder: gob.NewEncoder(conn), decoder: gob.NewDecoder(conn)}, func() { conn.Close() }, nil
+}
+
 func (c *Client) Kill() {
 	var cmd = server.Message{Command: "killserver"}
 	var rmsg Message
@@ -70,20 +106,222 @@ func (c *Client) Kill() {
 	}
 }
 
+// Read returns the whole content of a file, or an empty string if it cannot
+// be read.
 func (c *Client) Read(filename string) string {
-	var fileString string
+	reader, err := c.Open(filename)
+	if err != nil {
+		log.Println(err.Error())
+		return ""
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return string(data)
+}
+
+// Open streams the content of a file. The chunks are fetched while the
+// returned reader is read, and it must be closed before the client is used
+// for another command.
+func (c *Client) Open(filename string) (io.ReadCloser, error) {
+	return c.ReadAt(filename, 0, -1)
+}
+
+// ReadAt streams length bytes of a file starting at offset, fetching only
+// the chunks that overlap the range. A negative length reads to the end of
+// the file.
+func (c *Client) ReadAt(filename string, offset int, length int) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid offset %d", offset)
+	}
 	var cmd = server.Message{Command: "read", Args: []string{filename}}
 	var rmsg struct {
 		Result *server.File
+		Addr   string
 		Err    string
 	}
+	chunk := &server.ChunkMetadata{}
+	gob.Register(chunk)
 	err := c.metaServerSocket.encoder.Encode(&cmd)
 	if err != nil {
-		log.Println(err.Error())
+		return nil, err
+	}
+	err = c.metaServerSocket.decoder.Decode(&rmsg)
+	if err != nil {
+		return nil, err
+	}
+	if len(rmsg.Err) > 0 {
+		return nil, errors.New(rmsg.Err)
+	}
+	if offset > rmsg.Result.Size {
+		return nil, fmt.Errorf("offset %d is beyond the end of %s", offset, filename)
+	}
+	// read from the node holding the data when it runs in a process
+	socket, closeSocket, err := c.nodeSocket(rmsg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Args = append(cmd.Args, strconv.Itoa(offset), strconv.Itoa(length))
+	err = socket.encoder.Encode(&cmd)
+	if err == nil {
+		err = socket.encoder.Encode(rmsg.Result)
+	}
+	if err != nil {
+		closeSocket()
+		return nil, err
+	}
+	return &chunkReader{socket: socket, close: closeSocket}, nil
+}
+
+// chunkReader reads the pieces the chunk server streams for a read.
+type chunkReader struct {
+	socket Socket
+	close  func()
+	buf    []byte
+	done   bool
+	err    error
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.next()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *chunkReader) next() {
+	var piece server.ReadPiece
+	if err := r.socket.decoder.Decode(&piece); err != nil {
+		r.err = err
+	} else if len(piece.Err) > 0 {
+		r.err = errors.New(piece.Err)
+	} else if len(piece.Data) == 0 {
+		r.done = true
 	} else {
-		chunk := &server.ChunkMetadata{}
-		gob.Register(chunk)
+		r.buf = piece.Data
+	}
+}
+
+// Close drains the pieces that were not read, so the connection can carry
+// the next command.
+func (r *chunkReader) Close() error {
+	for !r.done && r.err == nil {
+		r.next()
+	}
+	r.close()
+	r.buf = nil
+	if r.err == io.EOF {
+		return nil
+	}
+	return r.err
+}
+
+func (c *Client) Write(filename string, file io.Reader) {
+	c.WriteWithReplicas(filename, file, 0)
+}
+
+// WriteWithReplicas stores file with the given number of copies per chunk,
+// or the cluster default when replicas is 0. The file is streamed to the
+// chunk server one chunk at a time, so it never has to fit in memory.
+func (c *Client) WriteWithReplicas(filename string, file io.Reader, replicas int) {
+	c.send("write", filename, file, strconv.Itoa(replicas))
+}
+
+// WriteErasureCoded stores file with its chunks split into Reed-Solomon
+// shards, e.g. "6,3" for six data and three parity shards per chunk.
+func (c *Client) WriteErasureCoded(filename string, file io.Reader, scheme string) {
+	c.send("write", filename, file, "0", scheme)
+}
+
+// Append adds the content of file to the end of an existing file.
+func (c *Client) Append(filename string, file io.Reader) {
+	c.send("append", filename, file)
+}
+
+// RecordAppend adds record to the end of a file at an offset chosen by the
+// chunk server and returns that offset. Records are never split across
+// chunks, so the file may contain zero padding, and a record may appear more
+// than once if an attempt had to be retried.
+func (c *Client) RecordAppend(filename string, record []byte) (int, error) {
+	// the record goes to the node process holding the lease, if any
+	var lease struct {
+		Result server.Lease
+		Addr   string
+		Err    string
+	}
+	err := c.metaServerSocket.encoder.Encode(&server.Message{Command: "lease", Args: []string{filename}})
+	if err == nil {
+		err = c.metaServerSocket.decoder.Decode(&lease)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(lease.Err) > 0 {
+		return 0, errors.New(lease.Err)
+	}
+	socket, closeSocket, err := c.nodeSocket(lease.Addr)
+	if err != nil {
+		return 0, err
+	}
+	defer closeSocket()
+	var cmd = server.Message{Command: "recordappend", Args: []string{filename}}
+	var rmsg struct {
+		Result int
+		Err    string
+	}
+	err = socket.encoder.Encode(&cmd)
+	if err == nil {
+		err = socket.encoder.Encode(record)
+	}
+	if err == nil {
+		err = socket.decoder.Decode(&rmsg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(rmsg.Err) > 0 {
+		return 0, errors.New(rmsg.Err)
 	}
+	return rmsg.Result, nil
+}
+
+// send asks the metadata server for the entry of filename and streams file
+// with the same command to the node process holding the lease on the file,
+// or to the chunk server.
+func (c *Client) send(command string, filename string, file io.Reader, args ...string) {
+	// the size is only known up front for files, other readers skip the
+	// disk capacity check of the metadata server
+	var size int64
+	if stat, ok := file.(interface{ Stat() (os.FileInfo, error) }); ok {
+		if info, err := stat.Stat(); err == nil {
+			size = info.Size()
+		}
+	}
+	var cmd = server.Message{Command: command, Args: append([]string{filename, strconv.FormatInt(size, 10)}, args...)}
+	var rmsg struct {
+		Result    *server.File
+		ChunkSize int
+		Addr      string
+		Err       string
+	}
+
+	err := c.metaServerSocket.encoder.Encode(&cmd)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	chunk := &server.ChunkMetadata{}
+	gob.Register(chunk)
 	err = c.metaServerSocket.decoder.Decode(&rmsg)
 	if err != nil {
 		if err == io.EOF {
@@ -93,48 +331,62 @@ func (c *Client) Read(filename string) string {
 	}
 	if len(rmsg.Err) > 0 {
 		log.Println(rmsg.Err)
-	} else {
-		err = c.chunkServerSocket.encoder.Encode(&cmd)
-		if err != nil {
-			log.Println(err.Error())
+		return
+	}
+	socket, closeSocket, err := c.nodeSocket(rmsg.Addr)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	defer closeSocket()
+	err = socket.encoder.Encode(&cmd)
+	if err == nil {
+		err = socket.encoder.Encode(rmsg.Result)
+	}
+	buf := make([]byte, rmsg.ChunkSize)
+	for err == nil {
+		n, readErr := io.ReadFull(file, buf)
+		if n > 0 {
+			err = socket.encoder.Encode(buf[:n])
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		} else if readErr != nil {
+			log.Fatal(readErr.Error())
+		}
+	}
+	if err == nil {
+		// an empty piece ends the file
+		err = socket.encoder.Encode([]byte{})
+	}
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	var reply Message
+	err = socket.decoder.Decode(&reply)
+	if err != nil {
+		if err == io.EOF {
 		} else {
-			err = c.chunkServerSocket.encoder.Encode(rmsg.Result)
-			if err != nil {
-				log.Println(err.Error())
-			} else {
-				err = c.chunkServerSocket.decoder.Decode(&fileString)
-				if err != nil {
-					if err == io.EOF {
-					} else {
-						log.Fatal("decode error: ", err.Error())
-					}
-				}
-				return fileString
-			}
-
+			log.Fatal("decode error: ", err.Error())
 		}
 	}
-	return fileString
+	if len(reply.Err) > 0 {
+		log.Println(reply.Err)
+	} else {
+		fmt.Println(reply.Result)
+	}
 }
 
-func (c *Client) Write(filename string, file io.Reader) {
-	var buf []byte
-	buf, err := ioutil.ReadAll(file)
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-	var cmd = server.Message{Command: "write", Args: []string{filename, strconv.Itoa(len(buf))}}
+func (c *Client) Rename(old string, new string) {
+	var cmd = server.Message{Command: "rename", Args: []string{old, new}}
 	var rmsg struct {
-		Result *server.File
-		Err    string
+		Err string
 	}
-
-	err = c.metaServerSocket.encoder.Encode(&cmd)
+	err := c.metaServerSocket.encoder.Encode(&cmd)
 	if err != nil {
 		log.Println(err.Error())
 	} else {
-		chunk := &server.ChunkMetadata{}
-		gob.Register(chunk)
 		err = c.metaServerSocket.decoder.Decode(&rmsg)
 		if err != nil {
 			if err == io.EOF {
@@ -145,30 +397,14 @@ func (c *Client) Write(filename string, file io.Reader) {
 		if len(rmsg.Err) > 0 {
 			log.Println(rmsg.Err)
 		} else {
-			err = c.chunkServerSocket.encoder.Encode(&cmd)
-			if err != nil {
-				log.Println(err.Error())
-			} else {
-
-				err = c.chunkServerSocket.encoder.Encode(rmsg.Result)
-				if err != nil {
-					log.Println(err.Error())
-				} else {
-					err = c.chunkServerSocket.encoder.Encode(buf)
-					if err != nil {
-						log.Println(err.Error())
-					}
-				}
-			}
+			fmt.Println("successfully moved")
 		}
 	}
 }
 
-func (c *Client) Rename(old string, new string) {
-	var cmd = server.Message{Command: "rename", Args: []string{old, new}}
-	var rmsg struct {
-		Err string
-	}
+func (c *Client) ListDir(dir string) {
+	var cmd = server.Message{Command: "ls", Args: []string{dir}}
+	var rmsg Message
 	err := c.metaServerSocket.encoder.Encode(&cmd)
 	if err != nil {
 		log.Println(err.Error())
@@ -183,14 +419,30 @@ func (c *Client) Rename(old string, new string) {
 		if len(rmsg.Err) > 0 {
 			log.Println(rmsg.Err)
 		} else {
-			fmt.Println("file successfully renamed")
+			fmt.Println(rmsg.Result)
 		}
 	}
 }
 
-func (c *Client) ListFiles() {
-	var cmd = server.Message{Command: "ls"}
-	var rmsg Message
+func (c *Client) Mkdir(dir string) {
+	c.changeDir("mkdir", dir, "directory successfully created")
+}
+
+func (c *Client) Rmdir(dir string) {
+	c.changeDir("rmdir", dir, "directory successfully removed")
+}
+
+func (c *Client) Delete(filename string) {
+	c.changeDir("delete", filename, "file successfully deleted")
+}
+
+// changeDir sends a namespace command on path and prints result once the
+// metadata server accepted it.
+func (c *Client) changeDir(command string, path string, result string) {
+	var cmd = server.Message{Command: command, Args: []string{path}}
+	var rmsg struct {
+		Err string
+	}
 	err := c.metaServerSocket.encoder.Encode(&cmd)
 	if err != nil {
 		log.Println(err.Error())
@@ -205,7 +457,7 @@ func (c *Client) ListFiles() {
 		if len(rmsg.Err) > 0 {
 			log.Println(rmsg.Err)
 		} else {
-			fmt.Println(rmsg.Result)
+			fmt.Println(result)
 		}
 	}
 }
@@ -288,8 +540,134 @@ func (c *Client) GetFileStat(filename string) {
 
 }
 
+// GetNodeStat prints the overview of the chunk server followed by every node
+// as the metadata server sees it, including the progress of decommissions.
 func (c *Client) GetNodeStat() {
 	var cmd = server.Message{Command: "nodestat"}
+	for _, socket := range []Socket{c.chunkServerSocket, c.metaServerSocket} {
+		var rmsg Message
+		err := socket.encoder.Encode(&cmd)
+		if err != nil {
+			log.Println(err.Error())
+		} else {
+			err = socket.decoder.Decode(&rmsg)
+			if err != nil {
+				if err == io.EOF {
+				} else {
+					log.Println("decode error: ", err.Error())
+				}
+			}
+
+			if len(rmsg.Err) > 0 {
+				log.Println(rmsg.Err)
+			} else {
+				fmt.Println(rmsg.Result)
+			}
+		}
+	}
+}
+
+func (c *Client) GetNodeStatById(nodeID int) {
+	var cmd = server.Message{Command: "nodestat", Args: []string{strconv.Itoa(nodeID)}}
+	var rmsg Message
+	err := c.metaServerSocket.encoder.Encode(&cmd)
+	if err != nil {
+		log.Println(err.Error())
+	} else {
+		err = c.metaServerSocket.decoder.Decode(&rmsg)
+		if err != nil {
+			if err == io.EOF {
+			} else {
+				log.Println("decode error: ", err.Error())
+			}
+		}
+
+		if len(rmsg.Err) > 0 {
+			log.Println(rmsg.Err)
+		} else {
+			fmt.Println(rmsg.Result)
+		}
+	}
+}
+
+// StopNode stops the node with the given id, or a random one if the id is
+// negative.
+func (c *Client) StopNode(nodeID int) {
+	if nodeID < 0 {
+		c.stopNodes(server.Message{Command: "stopnode"})
+		return
+	}
+	c.stopNodes(server.Message{Command: "stopnode", Args: []string{strconv.Itoa(nodeID)}})
+}
+
+// StopRandomNodes stops count random nodes. A seed other than 0 makes the
+// choice repeatable.
+func (c *Client) StopRandomNodes(count int, seed int64) {
+	c.stopNodes(server.Message{Command: "stopnode", Args: []string{
+		"--count", strconv.Itoa(count), strconv.FormatInt(seed, 10)}})
+}
+
+// StopRack stops every running node of a rack.
+func (c *Client) StopRack(rack int) {
+	c.stopNodes(server.Message{Command: "stoprack", Args: []string{strconv.Itoa(rack)}})
+}
+
+// stopNodes marks the nodes as stopped on the metadata server and then
+// kills every one the metadata server chose on the chunk server.
+func (c *Client) stopNodes(cmd server.Message) {
+	var rmsg Message
+	err := c.metaServerSocket.encoder.Encode(&cmd)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	err = c.metaServerSocket.decoder.Decode(&rmsg)
+	if err != nil {
+		if err != io.EOF {
+			log.Println("decode error: ", err.Error())
+		}
+		return
+	}
+	if len(rmsg.Err) > 0 {
+		log.Println(rmsg.Err)
+		return
+	}
+	fmt.Printf("stopping nodes %s\n", rmsg.Result)
+	for _, nodeID := range strings.Split(rmsg.Result, ",") {
+		cmd = server.Message{Command: "killnode", Args: []string{nodeID}}
+		err = c.chunkServerSocket.encoder.Encode(&cmd)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		var reply Message
+		err = c.chunkServerSocket.decoder.Decode(&reply)
+		if err != nil {
+			if err != io.EOF {
+				log.Println("decode error: ", err.Error())
+			}
+			return
+		}
+		if len(reply.Err) > 0 {
+			log.Println(reply.Err)
+		} else {
+			fmt.Println(reply.Result)
+		}
+	}
+}
+
+// StartNode brings a stopped node back into the cluster.
+func (c *Client) StartNode(nodeID int) {
+	c.startNode("startnode", nodeID)
+}
+
+// RestartNode stops and starts a node, which then reports its chunks again.
+func (c *Client) RestartNode(nodeID int) {
+	c.startNode("restartnode", nodeID)
+}
+
+func (c *Client) startNode(command string, nodeID int) {
+	var cmd = server.Message{Command: command, Args: []string{strconv.Itoa(nodeID)}}
 	var rmsg Message
 	err := c.chunkServerSocket.encoder.Encode(&cmd)
 	if err != nil {
@@ -309,11 +687,33 @@ func (c *Client) GetNodeStat() {
 			fmt.Println(rmsg.Result)
 		}
 	}
+}
 
+// AddNode adds a node with the given capacity, or the default one when
+// capacity is 0, to a rack.
+func (c *Client) AddNode(rack int, capacity int) {
+	c.metaCommand("addnode", strconv.Itoa(rack), strconv.Itoa(capacity))
 }
 
-func (c *Client) GetNodeStatById(nodeID int) {
-	var cmd = server.Message{Command: "nodestat", Args: []string{strconv.Itoa(nodeID)}}
+// Decommission moves every chunk off a node and then removes it.
+func (c *Client) Decommission(nodeID int) {
+	c.metaCommand("decommission", strconv.Itoa(nodeID))
+}
+
+// Balance moves chunk copies until every node is within threshold, e.g.
+// "10%", of the average disk usage. An empty threshold uses the configured
+// one.
+func (c *Client) Balance(threshold string) {
+	if len(threshold) == 0 {
+		c.metaCommand("balance")
+	} else {
+		c.metaCommand("balance", threshold)
+	}
+}
+
+// metaCommand sends a command to the metadata server and prints its reply.
+func (c *Client) metaCommand(command string, args ...string) {
+	var cmd = server.Message{Command: command, Args: args}
 	var rmsg Message
 	err := c.metaServerSocket.encoder.Encode(&cmd)
 	if err != nil {
@@ -335,14 +735,13 @@ func (c *Client) GetNodeStatById(nodeID int) {
 	}
 }
 
-func (c *Client) StopNode() {
-	var cmd = server.Message{Command: "stopnode"}
+func (c *Client) Checkpoint() {
+	var cmd = server.Message{Command: "checkpoint"}
 	var rmsg Message
 	err := c.metaServerSocket.encoder.Encode(&cmd)
 	if err != nil {
 		log.Println(err.Error())
 	} else {
-
 		err = c.metaServerSocket.decoder.Decode(&rmsg)
 		if err != nil {
 			if err == io.EOF {
@@ -354,25 +753,53 @@ func (c *Client) StopNode() {
 		if len(rmsg.Err) > 0 {
 			log.Println(rmsg.Err)
 		} else {
-			cmd.Command = "killnode"
-			cmd.Args = []string{rmsg.Result}
-			err = c.chunkServerSocket.encoder.Encode(&cmd)
-			if err != nil {
-				log.Println(err.Error())
-			}
-			err = c.chunkServerSocket.decoder.Decode(&rmsg)
-			if err != nil {
-				if err == io.EOF {
-				} else {
-					log.Println("decode error: ", err.Error())
-				}
-			}
-			if len(rmsg.Err) > 0 {
-				log.Println(rmsg.Err)
+			fmt.Println(rmsg.Result)
+		}
+	}
+}
+
+func (c *Client) ScrubStat() {
+	var cmd = server.Message{Command: "scrubstat"}
+	var rmsg Message
+	err := c.chunkServerSocket.encoder.Encode(&cmd)
+	if err != nil {
+		log.Println(err.Error())
+	} else {
+		err = c.chunkServerSocket.decoder.Decode(&rmsg)
+		if err != nil {
+			if err == io.EOF {
 			} else {
-				fmt.Println(rmsg.Result)
+				log.Println("decode error: ", err.Error())
 			}
 		}
+
+		if len(rmsg.Err) > 0 {
+			log.Println(rmsg.Err)
+		} else {
+			fmt.Println(rmsg.Result)
+		}
 	}
+}
 
+func (c *Client) SetReplication(filename string, replicas int) {
+	var cmd = server.Message{Command: "setrep", Args: []string{filename, strconv.Itoa(replicas)}}
+	var rmsg Message
+	err := c.metaServerSocket.encoder.Encode(&cmd)
+	if err != nil {
+		log.Println(err.Error())
+	} else {
+		err = c.metaServerSocket.decoder.Decode(&rmsg)
+		if err != nil {
+			if err == io.EOF {
+			} else {
+				log.Println("decode error: ", err.Error())
+			}
+		}
+
+		if len(rmsg.Err) > 0 {
+			log.Println(rmsg.Err)
+		} else {
+			fmt.Println(rmsg.Result)
+		}
+	}
 }
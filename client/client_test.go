@@ -1,3 +1,165 @@
 package client
 
 // Client interface unit tests
+
+import (
+	"fmt"
+	"goSimDFS/server"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func freePort(t testing.TB) int {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// startTestCluster runs a metadata server, and with it the chunk server, on
+// free loopback ports and returns a client connected to both.
+func startTestCluster(t *testing.T, config map[string]interface{}) FileSystem {
+	metaPort, chunkPort := freePort(t), freePort(t)
+	os.Setenv("META_SERVER_PORT", strconv.Itoa(metaPort))
+	os.Setenv("CHUNK_SERVER_PORT", strconv.Itoa(chunkPort))
+	config["port"] = metaPort
+	master := server.NewMasterServer("metadata", config)
+	go master.Run()
+
+	var conns []net.Conn
+	for _, port := range []int{metaPort, chunkPort} {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			conn, err := net.Dial("tcp", fmt.Sprintf(":%d", port))
+			if err == nil {
+				conns = append(conns, conn)
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("server on port %d did not start: %v", port, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	t.Cleanup(func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	return NewClient(conns[0], conns[1])
+}
+
+// testData is written over five chunks of ten bytes.
+var testData = strings.Repeat("0123456789", 5)
+
+func TestReadAtBounds(t *testing.T) {
+	c := startTestCluster(t, map[string]interface{}{"chunksize": 10, "heartbeatinterval": 0})
+	c.Write("ranged", strings.NewReader(testData))
+
+	for _, r := range []struct {
+		offset, length int
+		expected       string
+	}{
+		{0, -1, testData},
+		{15, 20, testData[15:35]},
+		{45, -1, testData[45:]},
+		{40, 100, testData[40:]},
+		{len(testData), -1, ""},
+		{7, 0, ""},
+	} {
+		reader, err := c.ReadAt("ranged", r.offset, r.length)
+		if err != nil {
+			t.Fatalf("read of %d bytes at %d: %v", r.length, r.offset, err)
+		}
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Errorf("read of %d bytes at %d: %v", r.length, r.offset, err)
+		}
+		if err := reader.Close(); err != nil {
+			t.Errorf("close after reading %d bytes at %d: %v", r.length, r.offset, err)
+		}
+		if string(data) != r.expected {
+			t.Errorf("read %q for %d bytes at %d, expected %q", data, r.length, r.offset, r.expected)
+		}
+	}
+
+	for _, offset := range []int{-1, len(testData) + 1} {
+		if _, err := c.ReadAt("ranged", offset, -1); err == nil {
+			t.Errorf("read at offset %d of a %d byte file", offset, len(testData))
+		}
+	}
+	if _, err := c.ReadAt("missing", 0, -1); err == nil {
+		t.Error("read a file that does not exist")
+	}
+}
+
+func TestPartialChunkReads(t *testing.T) {
+	c := startTestCluster(t, map[string]interface{}{"chunksize": 10, "heartbeatinterval": 0})
+	c.Write("partial", strings.NewReader(testData))
+	reader, err := c.Open("partial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	// a buffer smaller than a chunk takes it in several reads, and a read
+	// never goes past the end of a chunk
+	var content string
+	buf := make([]byte, 4)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 && len(content)/10 != (len(content)+n-1)/10 {
+			t.Fatalf("read of %d bytes at %d crosses a chunk", n, len(content))
+		}
+		content += string(buf[:n])
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if content != testData {
+		t.Errorf("read %q, expected %q", content, testData)
+	}
+	if n, err := reader.Read(buf); n != 0 || err != io.EOF {
+		t.Errorf("read %d bytes after the end: %v", n, err)
+	}
+}
+
+func TestCloseDrainsStream(t *testing.T) {
+	c := startTestCluster(t, map[string]interface{}{"chunksize": 10, "heartbeatinterval": 0})
+	c.Write("drained", strings.NewReader(testData))
+	reader, err := c.Open("drained")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if n, err := io.ReadFull(reader, buf); n != len(buf) || err != nil {
+		t.Fatalf("read %d bytes: %v", n, err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatalf("close in the middle of the file: %v", err)
+	}
+
+	// the pieces that were not read are gone from the connection, so the
+	// next command gets its own answer
+	if content := c.Read("drained"); content != testData {
+		t.Errorf("read %q after closing a partial read, expected %q", content, testData)
+	}
+	reader, err = c.ReadAt("drained", 20, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if data, _ := ioutil.ReadAll(reader); string(data) != testData[20:30] {
+		t.Errorf("read %q after closing a partial read, expected %q", data, testData[20:30])
+	}
+}
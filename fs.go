@@ -4,11 +4,20 @@ import (
 	"fmt"
 	"goSimDFS/client"
 	"goSimDFS/server"
+	"io"
 	"log"
 	"net"
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
+)
+
+// directories holding chunk node data and metadata when CHUNK_SERVER_DIR
+// and META_SERVER_DIR are not set
+const (
+	DEFAULT_CHUNK_DIR = "data/chunks"
+	DEFAULT_META_DIR  = "data/meta"
 )
 
 var HELP_MESSAGE = fmt.Sprintf(`usage: %s [help] <command> [<args>]
@@ -19,12 +28,31 @@ start - start meta-data server, which also starts chunk server on a background p
 
 kill - stop running servers 
 
+chunknode --id N [--rack R] [--master <addr>] [--port P] - run chunk node N as a process
+    of its own on rack R (given by N by default), which joins the metadata server at addr (:META_SERVER_PORT by
+    default) and listens on port P (any free port by default). Clients read from and
+    write to the node directly, every other node is reached through the server holding it
+
 file system commands:
-read <filename> - display content of specified filename
+read <filename> [--offset N] [--length N] - display content of specified filename,
+    optionally only length bytes starting at offset
+
+write <filename> [--replicas N] [--ec K,M] - create file entry from specified filename on
+    local disk, optionally with N copies per chunk instead of the cluster default, or
+    erasure coded with K data and M parity shards per chunk, e.g. --ec 6,3
+
+append <filename> <local file> - add the content of local file to the end of filename
+
+recordappend <filename> <record> - atomically append record at an offset chosen by the
+    system and print that offset, records never straddle a chunk boundary
+
+ls [<dir>] - list the files and directories in dir, the root directory by default
+
+mkdir <dir> - create a directory along with any missing parent directory
 
-write <filename> - create file entry from specified filename on local disk
+rmdir <dir> - remove an empty directory
 
-ls - list available files
+rm <filename> - delete a file, the space of its chunks is reclaimed in the background
 
 stat <filename> - fetch info of file with specified filename
 
@@ -32,16 +60,62 @@ filesize <filename> -  fetch size of file with specified filename
 
 rename <filename> <new filename> - rename specified file entry 
 
+mv <path> <new path> - move a file or a directory with everything below it, moving
+    onto an existing directory moves the path into that directory
+
+setrep <filename> <n> - change the number of copies kept for each chunk of a file
+
 diskcapacity - fetch sum of leftover disk space on each chunk node
 
 nodestat - fetch total disk size and leftover disk size for each chunk node
 
-stopnode - randomly select and stop a node (simulate a node failure)
+stopnode [<id>] [--count N] [--seed S] - stop the node with the given id, or N randomly
+    selected nodes (simulate a node failure), a seed makes the random choice repeatable
+
+stoprack <rack> - stop every node of a rack
+
+startnode <id> - bring a stopped node back, it reports its chunks and stale copies are dropped
+
+restartnode <id> - stop and start a node, which then reports its chunks again
+
+addnode --rack R [--capacity C] - add a node to rack R with C bytes of disk space, the
+    default capacity when not given
+
+decommission <id> - copy every chunk of a node to other nodes and then remove it, the
+    progress is shown by nodestat
+
+balance [--threshold T%%] - move chunk copies from over-full to under-full nodes until
+    every node is within T percentage points of the average disk usage
+
+admin commands:
+checkpoint - force a snapshot of the metadata server state
+
+scrubstat - show when the chunk scrubber last scanned each node, how many chunks
+    it scanned and how many corrupt chunks it found
+
+simulate [--chunks N] [--racks R] [--nodes-per-rack K] [--replicas N] [--ec K,M] - place
+    N chunks under every placement policy and as erasure coded shards, RS(6,3) by default,
+    and compare the results and the storage overhead
+
+the placement policy of a running cluster is chosen with the PLACEMENT_POLICY
+environment variable: hdfs (default), leastused or roundrobin. The scrubber pauses
+SCRUB_INTERVAL seconds between passes and reads at most SCRUB_RATE bytes per second.
+Reads fetch up to READ_CONCURRENCY chunks at once and try another copy of a chunk
+when a node takes longer than HEDGE_DELAY milliseconds. Writes and appends to a file
+are ordered by the node holding its lease, which lasts LEASE_DURATION seconds.
+Random node failures are repeatable across runs with the same FAILURE_SEED.
+Nodes send a heartbeat every HEARTBEAT_INTERVAL milliseconds and are taken as
+dead after HEARTBEAT_MISSES missed heartbeats. Such a node rejoins once its
+heartbeats resume, while a node stopped with stopnode waits for startnode.
+The balancer runs every BALANCE_INTERVAL seconds with a threshold of
+BALANCE_THRESHOLD percent and copies at most BALANCE_BANDWIDTH bytes per second
 `, os.Args[0])
 
 func main() {
 
-	if len(os.Args) > 1 {
+	if len(os.Args) > 1 && os.Args[1] == "chunknode" {
+		runChunkNode(os.Args)
+	} else if len(os.Args) > 1 {
 		metaPort := os.Getenv("META_SERVER_PORT")
 		if len(metaPort) == 0 {
 			log.Fatal("META_SERVER_PORT environment variable is not set")
@@ -53,7 +127,42 @@ func main() {
 		}
 		if os.Args[1] == "startserver" {
 			port, _ := strconv.Atoi(metaPort)
-			masterNode := server.NewMasterServer("metadata", map[string]interface{}{"port": port})
+			chunkDir := os.Getenv("CHUNK_SERVER_DIR")
+			if len(chunkDir) == 0 {
+				chunkDir = DEFAULT_CHUNK_DIR
+			}
+			metaDir := os.Getenv("META_SERVER_DIR")
+			if len(metaDir) == 0 {
+				metaDir = DEFAULT_META_DIR
+			}
+			config := map[string]interface{}{
+				"port":      port,
+				"chunkdir":  chunkDir,
+				"metadir":   metaDir,
+				"placement": os.Getenv("PLACEMENT_POLICY"),
+			}
+			for key, env := range map[string]string{
+				"scrubinterval":     "SCRUB_INTERVAL",
+				"scrubrate":         "SCRUB_RATE",
+				"readconcurrency":   "READ_CONCURRENCY",
+				"hedgedelay":        "HEDGE_DELAY",
+				"leaseduration":     "LEASE_DURATION",
+				"seed":              "FAILURE_SEED",
+				"heartbeatinterval": "HEARTBEAT_INTERVAL",
+				"heartbeatmisses":   "HEARTBEAT_MISSES",
+				"balanceinterval":   "BALANCE_INTERVAL",
+				"balancethreshold":  "BALANCE_THRESHOLD",
+				"balancebandwidth":  "BALANCE_BANDWIDTH",
+			} {
+				if value := os.Getenv(env); len(value) > 0 {
+					n, err := strconv.Atoi(value)
+					if err != nil {
+						log.Fatalf("invalid value %s for %s\n", value, env)
+					}
+					config[key] = n
+				}
+			}
+			masterNode := server.NewMasterServer("metadata", config)
 			masterNode.Run()
 
 		} else if os.Args[1] == "start" {
@@ -65,6 +174,8 @@ func main() {
 			os.Exit(1)
 		} else if os.Args[1] == "help" {
 			fmt.Println(HELP_MESSAGE)
+		} else if os.Args[1] == "simulate" {
+			simulatePlacement(os.Args)
 		} else {
 			createConnection(os.Args)
 		}
@@ -95,7 +206,14 @@ func createConnection(args []string) {
 			os.Exit(1)
 		}
 		filename := args[2]
-		fmt.Print(client.Read(filename))
+		reader, err := client.ReadAt(filename, intOption(args, "--offset", 0), intOption(args, "--length", -1))
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		if _, err = io.Copy(os.Stdout, reader); err != nil {
+			log.Println(err.Error())
+		}
+		reader.Close()
 		break
 	case "write":
 		if len(args) < 3 {
@@ -103,11 +221,49 @@ func createConnection(args []string) {
 			os.Exit(1)
 		}
 		filename := args[2]
+		replicas := intOption(args, "--replicas", 0)
 		file, err := os.Open(filename)
 		if err != nil {
 			log.Fatal(err.Error())
 		}
-		client.Write(filename, file)
+		if scheme := stringOption(args, "--ec", ""); len(scheme) > 0 {
+			client.WriteErasureCoded(filename, file, scheme)
+		} else {
+			client.WriteWithReplicas(filename, file, replicas)
+		}
+		break
+	case "append":
+		if len(args) < 4 {
+			fmt.Printf("missing argument append <filename> <local file>. See '%s help' for commands\n", os.Args[0])
+			os.Exit(1)
+		}
+		file, err := os.Open(args[3])
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		client.Append(args[2], file)
+		break
+	case "recordappend":
+		if len(args) < 4 {
+			fmt.Printf("missing argument recordappend <filename> <record>. See '%s help' for commands\n", os.Args[0])
+			os.Exit(1)
+		}
+		offset, err := client.RecordAppend(args[2], []byte(args[3]))
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		fmt.Printf("record appended at offset %d\n", offset)
+		break
+	case "setrep":
+		if len(args) < 4 {
+			fmt.Printf("missing argument setrep <filename> <n>. See '%s help' for commands\n", os.Args[0])
+			os.Exit(1)
+		}
+		replicas, err := strconv.Atoi(args[3])
+		if err != nil {
+			log.Fatal(err)
+		}
+		client.SetReplication(args[2], replicas)
 		break
 	case "nodestat":
 		if len(args) > 2 {
@@ -124,7 +280,73 @@ func createConnection(args []string) {
 		client.Kill()
 		break
 	case "stopnode":
-		client.StopNode()
+		if len(args) > 2 && !strings.HasPrefix(args[2], "--") {
+			id, err := strconv.Atoi(args[2])
+			if err != nil {
+				log.Fatal(err)
+			}
+			client.StopNode(id)
+		} else if count := intOption(args, "--count", 0); count > 0 || hasOption(args, "--seed") {
+			if count == 0 {
+				count = 1
+			}
+			client.StopRandomNodes(count, int64(intOption(args, "--seed", 0)))
+		} else {
+			client.StopNode(-1)
+		}
+		break
+	case "stoprack":
+		if len(args) < 3 {
+			fmt.Printf("missing argument stoprack <rack>. See '%s help' for commands\n", os.Args[0])
+			os.Exit(1)
+		}
+		rack, err := strconv.Atoi(args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+		client.StopRack(rack)
+		break
+	case "startnode", "restartnode":
+		if len(args) < 3 {
+			fmt.Printf("missing argument %s <id>. See '%s help' for commands\n", args[1], os.Args[0])
+			os.Exit(1)
+		}
+		id, err := strconv.Atoi(args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if args[1] == "startnode" {
+			client.StartNode(id)
+		} else {
+			client.RestartNode(id)
+		}
+		break
+	case "addnode":
+		if !hasOption(args, "--rack") {
+			fmt.Printf("missing argument addnode --rack <rack>. See '%s help' for commands\n", os.Args[0])
+			os.Exit(1)
+		}
+		client.AddNode(intOption(args, "--rack", 0), intOption(args, "--capacity", 0))
+		break
+	case "decommission":
+		if len(args) < 3 {
+			fmt.Printf("missing argument decommission <id>. See '%s help' for commands\n", os.Args[0])
+			os.Exit(1)
+		}
+		id, err := strconv.Atoi(args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+		client.Decommission(id)
+		break
+	case "balance":
+		client.Balance(stringOption(args, "--threshold", ""))
+		break
+	case "checkpoint":
+		client.Checkpoint()
+		break
+	case "scrubstat":
+		client.ScrubStat()
 		break
 	case "filesize":
 		if len(args) < 3 {
@@ -134,7 +356,29 @@ func createConnection(args []string) {
 		client.GetFileSize(args[2])
 		break
 	case "ls":
-		client.ListFiles()
+		dir := "/"
+		if len(args) > 2 {
+			dir = args[2]
+		}
+		client.ListDir(dir)
+		break
+	case "rm", "delete":
+		if len(args) < 3 {
+			fmt.Printf("missing argument %s <filename>. See '%s help' for commands\n", args[1], os.Args[0])
+			os.Exit(1)
+		}
+		client.Delete(args[2])
+		break
+	case "mkdir", "rmdir":
+		if len(args) < 3 {
+			fmt.Printf("missing argument %s <dir>. See '%s help' for commands\n", args[1], os.Args[0])
+			os.Exit(1)
+		}
+		if args[1] == "mkdir" {
+			client.Mkdir(args[2])
+		} else {
+			client.Rmdir(args[2])
+		}
 		break
 	case "stat":
 		if len(args) < 3 {
@@ -146,9 +390,9 @@ func createConnection(args []string) {
 	case "diskcapacity":
 		client.GetDiskCapacity()
 		break
-	case "rename":
+	case "rename", "mv":
 		if len(args) < 4 {
-			fmt.Printf("missing argument rename <filename> <new filename>. See '%s help' for commands\n", os.Args[0])
+			fmt.Printf("missing argument %s <path> <new path>. See '%s help' for commands\n", args[1], os.Args[0])
 			os.Exit(1)
 		}
 		client.Rename(args[2], args[3])
@@ -158,3 +402,90 @@ func createConnection(args []string) {
 		os.Exit(1)
 	}
 }
+
+// hasOption reports whether name is given in args.
+func hasOption(args []string, name string) bool {
+	for _, arg := range args {
+		if arg == name {
+			return true
+		}
+	}
+	return false
+}
+
+// intOption returns the integer following name in args, or def if name is
+// not given. An invalid value ends the program.
+func intOption(args []string, name string, def int) int {
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == name {
+			value, err := strconv.Atoi(args[i+1])
+			if err != nil || value < 0 {
+				fmt.Printf("invalid value %s for %s. See '%s help' for commands\n", args[i+1], name, os.Args[0])
+				os.Exit(1)
+			}
+			return value
+		}
+	}
+	return def
+}
+
+// stringOption returns the value following name in args, or def if name is
+// not given.
+func stringOption(args []string, name string, def string) string {
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == name {
+			return args[i+1]
+		}
+	}
+	return def
+}
+
+func runChunkNode(args []string) {
+	if !hasOption(args, "--id") {
+		fmt.Printf("missing argument chunknode --id <id>. See '%s help' for commands\n", os.Args[0])
+		os.Exit(1)
+	}
+	chunkDir := os.Getenv("CHUNK_SERVER_DIR")
+	if len(chunkDir) == 0 {
+		chunkDir = DEFAULT_CHUNK_DIR
+	}
+	config := map[string]interface{}{
+		"id":      intOption(args, "--id", 0),
+		"rack":    intOption(args, "--rack", -1),
+		"master":  stringOption(args, "--master", ":"+os.Getenv("META_SERVER_PORT")),
+		"port":    intOption(args, "--port", 0),
+		"datadir": chunkDir,
+	}
+	chunkNode, err := server.NewChunkNode("chunk node", config)
+	if err != nil {
+		log.Fatalf("unable to join the metadata server: %v\n", err.Error())
+	}
+	chunkNode.Run()
+}
+
+func simulatePlacement(args []string) {
+	chunks := intOption(args, "--chunks", 1000)
+	racks := intOption(args, "--racks", 4)
+	nodesPerRack := intOption(args, "--nodes-per-rack", 4)
+	replicas := intOption(args, "--replicas", 3)
+	for name, value := range map[string]int{"--racks": racks, "--nodes-per-rack": nodesPerRack, "--replicas": replicas} {
+		if value < 1 {
+			fmt.Printf("invalid value %d for %s, expected at least 1. See '%s help' for commands\n", value, name, os.Args[0])
+			os.Exit(1)
+		}
+	}
+	scheme, err := server.ParseErasureScheme(stringOption(args, "--ec", "6,3"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	capacity := chunks * replicas * 100
+	fmt.Printf("placing %d chunks with %d copies on %d racks of %d nodes\n", chunks, replicas, racks, nodesPerRack)
+	for _, name := range server.PlacementPolicies {
+		policy, _ := server.NewPlacementPolicy(name)
+		fmt.Println(server.SimulatePlacement(policy, racks, nodesPerRack, capacity, chunks, replicas, 100))
+	}
+	erasure := server.SimulateErasure(scheme, racks, nodesPerRack, capacity, chunks, 100)
+	fmt.Println(erasure)
+	fmt.Printf("%s stores %.2fx the data against %dx for %d copies, %.0f%% less disk space\n",
+		scheme, erasure.Overhead(), replicas, replicas, 100*(1-erasure.Overhead()/float64(replicas)))
+}
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+)
+
+// handleAppendConnection adds the pieces the client streams to the end of
+// file. A last chunk that is not full is rewritten together with the first
+// bytes of the new data, so appends do not leave a trail of small chunks.
+// The new chunks only become part of the file once the metadata server
+// accepts them, and are dropped if the file changed in the meantime.
+func (c *ChunkServer) handleAppendConnection(s *session, file FileEntry) {
+	mu, writeErr := c.beginMutation(file.GetName())
+	defer c.endMutation(mu)
+	entry := file
+	if writeErr == nil {
+		// the file may have changed while earlier mutations of it ran
+		var current *File
+		if current, writeErr = c.lookupFile(file.GetName()); writeErr == nil {
+			entry = current
+		}
+	}
+	replicas := c.REPLICAS
+	if file, ok := entry.(*File); ok && file.Replicas > 0 {
+		replicas = file.Replicas
+	}
+	chunks := entry.Read()
+	from := len(chunks)
+	var lastChecksum uint32
+	if from > 0 {
+		lastChecksum = chunks[from-1].GetChecksum()
+	}
+	var pending []byte
+	var err error
+	if writeErr == nil && from > 0 && chunks[from-1].Size() < c.CHUNKSIZE {
+		from--
+		pending, writeErr = c.readChunk(entry.GetName(), from, chunks[from])
+	}
+
+	appended := &File{Name: entry.GetName()}
+	if file, ok := entry.(*File); ok {
+		appended.Erasure = file.Erasure
+	}
+	var size int
+	var ended bool
+	writer := mu.Lease.Primary
+	for !ended {
+		var data []byte
+		err = s.decoder.Decode(&data)
+		if err != nil {
+			if err != io.EOF {
+				log.Println("decode error: ", err.Error())
+			}
+			break
+		}
+		ended = len(data) == 0
+		size += len(data)
+		if writeErr != nil {
+			continue
+		}
+		pending = append(pending, data...)
+		for len(pending) >= c.CHUNKSIZE && writeErr == nil {
+			writeErr = c.writeChunk(appended, writer, replicas, pending[:c.CHUNKSIZE])
+			pending = pending[c.CHUNKSIZE:]
+		}
+	}
+	if !ended {
+		// the client went away before the end of its data
+		c.dropChunks(appended)
+		return
+	}
+
+	var rmsg struct {
+		Result string
+		Err    string
+	}
+	offset := entry.GetSize()
+	if writeErr == nil && size > 0 {
+		if len(pending) > 0 {
+			writeErr = c.writeChunk(appended, writer, replicas, pending)
+		}
+		if writeErr == nil {
+			offset, writeErr = c.commitAppend(entry.GetName(), from, len(chunks), lastChecksum, mu.Lease.ID, appended)
+		}
+	}
+	if writeErr != nil {
+		c.dropChunks(appended)
+		rmsg.Err = writeErr.Error()
+	} else {
+		rmsg.Result = fmt.Sprintf("appended %d bytes to %s at offset %d", size, entry.GetName(), offset)
+	}
+	err = s.encoder.Encode(rmsg)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// commitAppend asks the metadata server to replace the chunks of a file from
+// index from on with the appended ones, under the lease with id leaseID. It
+// returns the offset the new data starts at.
+func (c *ChunkServer) commitAppend(filename string, from int, count int, lastChecksum uint32, leaseID uint64, appended *File) (int, error) {
+	conn, err := net.Dial("tcp", c.metaAddr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	s := newSession(conn)
+	msg := &Message{Command: "appendchunks", Args: []string{
+		filename, strconv.Itoa(from), strconv.Itoa(count), strconv.FormatUint(uint64(lastChecksum), 10),
+		strconv.FormatUint(leaseID, 10)}}
+	if err = s.encoder.Encode(msg); err != nil {
+		return 0, err
+	}
+	if err = s.encoder.Encode(struct{ Entry *File }{appended}); err != nil {
+		return 0, err
+	}
+	var rmsg struct {
+		Result int
+		Err    string
+	}
+	if err = s.decoder.Decode(&rmsg); err != nil {
+		return 0, err
+	}
+	if len(rmsg.Err) > 0 {
+		return 0, errors.New(rmsg.Err)
+	}
+	return rmsg.Result, nil
+}
+
+// dropChunks deletes copies that never became part of a file.
+func (c *ChunkServer) dropChunks(entry FileEntry) {
+	for _, chunk := range entry.Read() {
+		for _, chunkCopy := range chunk.Read() {
+			if _, err := c.node(chunkCopy.Node).Delete(chunkCopy.Addr); err != nil {
+				log.Println(err.Error())
+			}
+		}
+	}
+}
+
+// CommitAppend replaces the chunks of a file from index from on with the
+// chunks of appended, provided the file still has count chunks and its last
+// chunk still has the given checksum and leaseID is the current lease on the
+// file. The replaced copies are left to the garbage collector. It returns the
+// size of the file before the append.
+func (m *MasterNode) CommitAppend(filename string, from int, count int, lastChecksum uint32, leaseID uint64, appended *File) (int, error) {
+	filename = cleanPath(filename)
+	m.namespace.Lock(filename)
+	defer m.namespace.Unlock(filename)
+	m.mutex.RLock()
+	entry, ok := m.files[filename]
+	var err error
+	var size int
+	if !ok {
+		err = fmt.Errorf("%s does not exist", filename)
+	} else if err = m.checkLease(filename, leaseID); err == nil {
+		chunks := entry.getChunks()
+		size = entry.GetSize()
+		if len(chunks) != count || (count > 0 && chunks[count-1].GetChecksum() != lastChecksum) || from > count {
+			err = fmt.Errorf("%s changed during the append, try again", filename)
+		}
+	}
+	m.mutex.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	err = m.commit(&logRecord{Op: "append", Args: []string{filename, strconv.Itoa(from)}, Entry: appended})
+	return size, err
+}
+
+func (m *MasterNode) applyAppend(filename string, from int, appended *File) {
+	entry, ok := m.files[filename].(*File)
+	if !ok || from > len(entry.Chunks) {
+		return
+	}
+	for _, chunk := range entry.Chunks[from:] {
+		m.garbage = append(m.garbage, chunk.Read()...)
+	}
+	stampVersions(appended.getChunks(), entry.Chunks, from)
+	entry.Chunks = entry.Chunks[:from]
+	for _, chunk := range appended.getChunks() {
+		if metadata, ok := chunk.(*ChunkMetadata); ok {
+			metadata.Index = len(entry.Chunks)
+		}
+		for _, chunkCopy := range chunk.Read() {
+			m.adjustSpace(chunkCopy.Node, -chunkCopy.Size)
+		}
+		entry.Chunks = append(entry.Chunks, chunk)
+	}
+	entry.Size = 0
+	for _, chunk := range entry.Chunks {
+		entry.Size += chunk.Size()
+	}
+	m.updateDiskCap()
+}
+
+// number of times a record append is tried before its error is returned
+const recordAppendAttempts = 5
+
+// RecordAppend adds record to the end of a file at an offset of the server's
+// choosing and returns that offset, like GFS record append. Concurrent
+// appends to a file are ordered by the primary holding its lease, so every
+// writer gets its own offset.
+// A record never straddles a chunk boundary: when it does not fit in the
+// last chunk, the rest of that chunk is padded with zero bytes and the
+// record starts a new chunk. A failed attempt is retried, so readers must
+// skip padding and tolerate a record appearing more than once.
+func (c *ChunkServer) RecordAppend(filename string, record []byte) (int, error) {
+	if len(record) == 0 || len(record) > c.CHUNKSIZE {
+		return 0, fmt.Errorf("record size must be between 1 and %d bytes", c.CHUNKSIZE)
+	}
+	var err error
+	for attempt := 0; attempt < recordAppendAttempts; attempt++ {
+		var offset int
+		var mu *mutation
+		mu, err = c.beginMutation(filename)
+		if err == nil {
+			offset, err = c.recordAppend(filename, record, mu.Lease)
+		}
+		c.endMutation(mu)
+		if err == nil {
+			return offset, nil
+		}
+		if remote, ok := c.node(mu.Lease.Primary).(*RemoteNode); ok && mu.Lease.ID > 0 {
+			// the lease is held elsewhere, the record goes to its server
+			return remote.recordAppend(filename, record)
+		}
+		log.Printf("record append to %s failed: %v\n", filename, err)
+	}
+	return 0, err
+}
+
+func (c *ChunkServer) recordAppend(filename string, record []byte, lease Lease) (int, error) {
+	entry, err := c.lookupFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	replicas := c.REPLICAS
+	if entry.Replicas > 0 {
+		replicas = entry.Replicas
+	}
+	chunks := entry.Read()
+	from := len(chunks)
+	var lastChecksum uint32
+	if from > 0 {
+		lastChecksum = chunks[from-1].GetChecksum()
+	}
+
+	pieces := [][]byte{record}
+	if from > 0 && chunks[from-1].Size() < c.CHUNKSIZE {
+		from--
+		last, err := c.readChunk(entry.GetName(), from, chunks[from])
+		if err != nil {
+			return 0, err
+		}
+		if len(last)+len(record) <= c.CHUNKSIZE {
+			pieces = [][]byte{append(last, record...)}
+		} else {
+			padded := append(last, make([]byte, c.CHUNKSIZE-len(last))...)
+			pieces = [][]byte{padded, record}
+		}
+	}
+	offset := 0
+	for _, chunk := range chunks[:from] {
+		offset += chunk.Size()
+	}
+
+	appended := &File{Name: entry.GetName(), Erasure: entry.Erasure}
+	for _, piece := range pieces {
+		if err := c.writeChunk(appended, lease.Primary, replicas, piece); err != nil {
+			c.dropChunks(appended)
+			return 0, err
+		}
+		offset += len(piece)
+	}
+	if _, err := c.commitAppend(entry.GetName(), from, len(chunks), lastChecksum, lease.ID, appended); err != nil {
+		c.dropChunks(appended)
+		return 0, err
+	}
+	// the record ends the file
+	return offset - len(record), nil
+}
+
+// lookupFile fetches the current entry of a file from the metadata server.
+func (c *ChunkServer) lookupFile(filename string) (*File, error) {
+	var rmsg struct {
+		Result *File
+		Err    string
+	}
+	if err := c.callMetaServer(&Message{Command: "read", Args: []string{filename}}, &rmsg); err != nil {
+		return nil, err
+	}
+	if len(rmsg.Err) > 0 {
+		return nil, errors.New(rmsg.Err)
+	}
+	return rmsg.Result, nil
+}
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The balancer evens out disk usage. A node is over-full when its share of
+// used space is more than the threshold, in percentage points, above the
+// average of the running nodes, and under-full when it is that far below.
+// Chunk copies move one at a time from the fullest nodes to the emptiest
+// ones, like the HDFS balancer: the new copy is made first, then a single
+// "move" record swaps it for the old one in the chunk metadata and puts the
+// old copy on the garbage list. Clients that looked up the chunk before the
+// move can still read the old copy until the garbage collector reclaims it. A
+// move never lowers the number of racks a chunk spans, nor piles up the
+// shards of an erasure coded chunk on one rack, and the balancer pauses after
+// every move so that it copies at most the configured bandwidth in bytes per
+// second.
+
+// balanceMove is a chunk copy the balancer moves to another node.
+type balanceMove struct {
+	filename string
+	index    int
+	source   Copy
+	target   int
+	checksum uint32
+	checked  bool
+}
+
+// balancer settings and the lock that keeps passes from overlapping
+type balancer struct {
+	interval  time.Duration
+	threshold int
+	bandwidth int
+	mutex     sync.Mutex
+}
+
+func (m *MasterNode) runBalancer() {
+	ticker := time.NewTicker(m.balancer.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		moved, _, err := m.Balance(m.balancer.threshold)
+		if err != nil {
+			log.Println(err.Error())
+		} else if moved > 0 {
+			log.Printf("balancer moved %d chunk copies\n", moved)
+		}
+	}
+}
+
+// Balance moves chunk copies until the usage of every running node is within
+// threshold percentage points of the average, or no copy can be moved
+// without breaking the placement rules. It returns the number of copies
+// moved and the gap between the fullest and the emptiest node before and
+// after, in percent.
+func (m *MasterNode) Balance(threshold int) (int, [2]float64, error) {
+	var spread [2]float64
+	if threshold < 0 || threshold > 100 {
+		return 0, spread, fmt.Errorf("invalid threshold %d%%, expected 0 to 100", threshold)
+	}
+	m.balancer.mutex.Lock()
+	defer m.balancer.mutex.Unlock()
+	spread[0] = m.usageSpread()
+	var moved int
+	// every copy moves at most once per pass
+	done := map[Copy]bool{}
+	for {
+		move, ok := m.planMove(float64(threshold), done)
+		if !ok {
+			break
+		}
+		done[move.source] = true
+		if err := m.moveCopy(move); err != nil {
+			log.Printf("unable to move chunk %d of %s: %v\n", move.index, move.filename, err)
+			continue
+		}
+		moved++
+		if m.balancer.bandwidth > 0 {
+			time.Sleep(time.Duration(move.source.Size) * time.Second / time.Duration(m.balancer.bandwidth))
+		}
+	}
+	spread[1] = m.usageSpread()
+	return moved, spread, nil
+}
+
+// usedSpace adds up the size of the chunk copies on every node and expects
+// the caller to hold the metadata lock. It goes by the chunk metadata rather
+// than nodeMap, which heartbeats overwrite with what the nodes report.
+func (m *MasterNode) usedSpace() map[int]int {
+	used := map[int]int{}
+	for _, entry := range m.files {
+		for _, chunk := range entry.getChunks() {
+			for _, chunkCopy := range chunk.Read() {
+				used[chunkCopy.Node] += chunkCopy.Size
+			}
+		}
+	}
+	return used
+}
+
+// capacityOf returns the disk space of a node and expects the caller to hold
+// the metadata lock.
+func (m *MasterNode) capacityOf(nodeID int) int {
+	if capacity, ok := m.capacities[nodeID]; ok {
+		return capacity
+	}
+	return DEFAULT_ALLOCATED_DISKSPACE
+}
+
+// usage returns the share of used disk space of every running node that
+// accepts new copies, in percent, and expects the caller to hold the
+// metadata lock.
+func (m *MasterNode) usage(used map[int]int) map[int]float64 {
+	usage := map[int]float64{}
+	for nodeID := range m.nodeMap {
+		if capacity := m.capacityOf(nodeID); m.isPlaceable(nodeID) && capacity > 0 {
+			usage[nodeID] = 100 * float64(used[nodeID]) / float64(capacity)
+		}
+	}
+	return usage
+}
+
+// usageSpread returns the gap between the fullest and the emptiest node.
+func (m *MasterNode) usageSpread() float64 {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var low, high float64
+	first := true
+	for _, value := range m.usage(m.usedSpace()) {
+		if first || value < low {
+			low = value
+		}
+		if first || value > high {
+			high = value
+		}
+		first = false
+	}
+	return high - low
+}
+
+// planMove picks the next copy to move: from an over-full node to a node
+// below the average or, when no node is over-full, from a node above the
+// average to an under-full one, as long as the move narrows the gap between
+// the two. Copies in done are left alone.
+func (m *MasterNode) planMove(threshold float64, done map[Copy]bool) (balanceMove, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	used := m.usedSpace()
+	usage := m.usage(used)
+	if len(usage) < 2 {
+		return balanceMove{}, false
+	}
+	var average float64
+	for _, value := range usage {
+		average += value
+	}
+	average /= float64(len(usage))
+
+	var over, under, above, below []int
+	for nodeID, value := range usage {
+		if value > average+threshold {
+			over = append(over, nodeID)
+		} else if value < average-threshold {
+			under = append(under, nodeID)
+		}
+		if value > average {
+			above = append(above, nodeID)
+		} else if value < average {
+			below = append(below, nodeID)
+		}
+	}
+	sources, targets := over, below
+	if len(over) == 0 {
+		sources, targets = above, under
+	}
+	// fullest sources and emptiest targets first
+	sort.Slice(sources, func(i, j int) bool { return usage[sources[i]] > usage[sources[j]] })
+	sort.Slice(targets, func(i, j int) bool { return usage[targets[i]] < usage[targets[j]] })
+
+	var filenames []string
+	for filename := range m.files {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	for _, source := range sources {
+		for _, target := range targets {
+			for _, filename := range filenames {
+				for index, chunk := range m.files[filename].getChunks() {
+					free := m.capacityOf(target) - used[target]
+					if move, ok := m.movable(chunk, source, target, free, done); ok && m.narrowsGap(used, move) {
+						move.filename, move.index = filename, index
+						return move, true
+					}
+				}
+			}
+		}
+	}
+	return balanceMove{}, false
+}
+
+// narrowsGap reports whether the source of a move stays at least as full as
+// its target, so that the copy never has a reason to move back. It expects
+// the caller to hold the metadata lock.
+func (m *MasterNode) narrowsGap(used map[int]int, move balanceMove) bool {
+	after := func(nodeID int, delta int) float64 {
+		return float64(used[nodeID]+delta) / float64(m.capacityOf(nodeID))
+	}
+	return after(move.source.Node, -move.source.Size) >= after(move.target, move.source.Size)
+}
+
+// movable reports whether the copy of chunk on source can move to target,
+// which has free bytes left, and expects the caller to hold the metadata lock.
+func (m *MasterNode) movable(chunk ChunkEntry, source int, target int, free int, done map[Copy]bool) (balanceMove, bool) {
+	var move balanceMove
+	var found bool
+	racks := map[int]int{}
+	for _, chunkCopy := range chunk.Read() {
+		if chunkCopy.Node == target {
+			return move, false
+		}
+		if !chunkCopy.Valid {
+			continue
+		}
+		racks[m.rackOf(chunkCopy.Node)]++
+		if chunkCopy.Node == source && !done[chunkCopy] {
+			move.source, found = chunkCopy, true
+		}
+	}
+	if !found || free < move.source.Size {
+		return move, false
+	}
+	if metadata, ok := chunk.(*ChunkMetadata); ok && move.source.Version != metadata.Version {
+		// stale copies are for the replication manager to drop
+		return move, false
+	}
+	sourceRack, targetRack := m.rackOf(source), m.rackOf(target)
+	if erasureOf(chunk).Data > 0 {
+		// no rack may end up with more shards of the chunk than the source
+		// rack held
+		if targetRack != sourceRack && racks[targetRack]+1 > racks[sourceRack] {
+			return move, false
+		}
+	} else if _, ok := racks[targetRack]; ok && targetRack != sourceRack && racks[sourceRack] == 1 {
+		// the chunk must not end up on fewer racks
+		return move, false
+	}
+	move.target = target
+	move.checksum, move.checked = chunk.GetChecksum(), chunk.HasChecksum()
+	if erasureOf(chunk).Data > 0 {
+		// every shard has a checksum of its own
+		move.checksum, move.checked = move.source.Checksum, true
+	}
+	return move, true
+}
+
+// moveCopy copies a chunk to the target node and swaps the new copy for the
+// old one in the chunk metadata with a single log record. The old copy goes
+// to the garbage list rather than being deleted right away, since readers
+// that looked up the chunk before the move may still be sent to it.
+func (m *MasterNode) moveCopy(move balanceMove) error {
+	var rmsg struct {
+		Result Copy
+		Err    string
+	}
+	msg := &Message{Command: "replicate", Args: []string{
+		strconv.Itoa(move.source.Node), strconv.Itoa(move.source.Addr), strconv.Itoa(move.target),
+		checksumArg(move.checksum, move.checked)}}
+	if err := m.callChunkServer(msg, &rmsg); err != nil {
+		return err
+	}
+	if len(rmsg.Err) > 0 {
+		return errors.New(rmsg.Err)
+	}
+	replica := rmsg.Result
+
+	m.namespace.Lock(move.filename)
+	if !m.hasCopy(move.filename, move.index, move.source) {
+		m.namespace.Unlock(move.filename)
+		// the file was rewritten or removed while the data was copied
+		m.deleteChunkCopy(replica)
+		return fmt.Errorf("chunk changed during the move")
+	}
+	err := m.commit(&logRecord{Op: "move", Args: []string{
+		move.filename, strconv.Itoa(move.index), strconv.Itoa(move.source.Node), strconv.Itoa(move.source.Addr),
+		strconv.Itoa(replica.Node), strconv.Itoa(replica.Addr), strconv.Itoa(replica.Size)}})
+	m.namespace.Unlock(move.filename)
+	if err != nil {
+		m.deleteChunkCopy(replica)
+		return err
+	}
+	log.Printf("moved chunk %d of %s from node %d to node %d\n", move.index, move.filename, move.source.Node, replica.Node)
+	return nil
+}
+
+func (m *MasterNode) applyMove(args []string) {
+	var values []int
+	for _, arg := range args[1:] {
+		value, _ := strconv.Atoi(arg)
+		values = append(values, value)
+	}
+	index, source := values[0], Copy{Node: values[1], Addr: values[2]}
+	replica := Copy{Node: values[3], Addr: values[4], Size: values[5], Valid: true}
+	chunk := m.findChunk(args[0], index, source)
+	if chunk == nil {
+		return
+	}
+	for i, chunkCopy := range chunk.Copies {
+		if chunkCopy.Node == source.Node && chunkCopy.Addr == source.Addr {
+			replica.Checksum = chunkCopy.Checksum
+			replica.Version = chunkCopy.Version
+			replica.Shard = chunkCopy.Shard
+			chunk.Copies[i] = replica
+			// its space comes back when the garbage collector reclaims it
+			m.garbage = append(m.garbage, chunkCopy)
+			m.adjustSpace(replica.Node, -replica.Size)
+			break
+		}
+	}
+	m.updateDiskCap()
+}
@@ -0,0 +1,633 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+)
+
+// A chunk node can run as a process of its own, started with
+//
+//	goSimDFS chunknode --id 3 --rack 1 --master :9000
+//
+// The process serves node 3 from its own port and joins the metadata server,
+// which replies with the cluster configuration and the address of every node
+// that runs in a process. Each process, like the chunk server started by the
+// metadata server, is a ChunkServer: the nodes it holds are local and every
+// other node is a RemoteNode that forwards reads, writes and deletes to the
+// server holding it. Nodes that do not run in a process of their own are
+// held by the chunk server of the metadata server. Clients send reads to a
+// node holding the first chunk of a file and writes to the node holding the
+// lease on it. A node process sends its address and rack with every
+// heartbeat, so a restarted metadata server learns about it again. The reply
+// to a heartbeat also lists the stopped nodes, which is how a chunk server
+// knows whether a remote node runs without asking its server every time.
+
+// NodeMember is where a node runs in a process of its own.
+type NodeMember struct {
+	Addr string
+	Rack int
+}
+
+// RemoteNode is a DataNode held by another chunk server.
+type RemoteNode struct {
+	id   int
+	addr string
+	// set while the metadata server considers the node stopped
+	stopped int32
+}
+
+func (n *RemoteNode) call(msg *Message, reply interface{}) error {
+	conn, err := net.Dial("tcp", n.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	s := newSession(conn)
+	if err = s.encoder.Encode(msg); err != nil {
+		return err
+	}
+	return s.decoder.Decode(reply)
+}
+
+func (n *RemoteNode) GetSize() int {
+	var rmsg struct {
+		Result int
+		Err    string
+	}
+	if err := n.call(&Message{Command: "nodesize", Args: []string{strconv.Itoa(n.id)}}, &rmsg); err != nil {
+		log.Println(err.Error())
+	}
+	return rmsg.Result
+}
+
+// Load is a no-op since a remote node is loaded by its own process.
+func (n *RemoteNode) Load() error {
+	return nil
+}
+
+// Run is a no-op, a remote node is started by forwarding startnode to its
+// server, see StartNode.
+func (n *RemoteNode) Run() {
+}
+
+func (n *RemoteNode) Kill() {
+	var rmsg struct {
+		Result string
+		Err    string
+	}
+	if err := n.call(&Message{Command: "killnode", Args: []string{strconv.Itoa(n.id)}}, &rmsg); err != nil {
+		log.Println(err.Error())
+	}
+	n.setRunning(false)
+}
+
+// IsRunning tells what the last heartbeat reply said about the node, see
+// updateLiveness. A node that cannot be reached in the meantime shows up as
+// a failed read or write.
+func (n *RemoteNode) IsRunning() bool {
+	return atomic.LoadInt32(&n.stopped) == 0
+}
+
+func (n *RemoteNode) setRunning(running bool) {
+	var stopped int32
+	if !running {
+		stopped = 1
+	}
+	atomic.StoreInt32(&n.stopped, stopped)
+}
+
+func (n *RemoteNode) Read(addr int) string {
+	data, err := n.read(addr)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return string(data)
+}
+
+// read is Read with the error kept, so that callers can tell a node they
+// could not reach from a copy that came back wrong, see readCopy.
+func (n *RemoteNode) read(addr int) ([]byte, error) {
+	var rmsg struct {
+		Result []byte
+		Err    string
+	}
+	if err := n.call(&Message{Command: "chunkread", Args: []string{strconv.Itoa(n.id), strconv.Itoa(addr)}}, &rmsg); err != nil {
+		return nil, err
+	}
+	if len(rmsg.Err) > 0 {
+		return nil, errors.New(rmsg.Err)
+	}
+	return rmsg.Result, nil
+}
+
+func (n *RemoteNode) Write(dataChannel <-chan []byte, checksum uint32) (int, int) {
+	data := <-dataChannel
+	conn, err := net.Dial("tcp", n.addr)
+	if err != nil {
+		log.Println(err.Error())
+		return -1, 0
+	}
+	defer conn.Close()
+	s := newSession(conn)
+	msg := &Message{Command: "chunkwrite", Args: []string{strconv.Itoa(n.id), strconv.FormatUint(uint64(checksum), 10)}}
+	if err = s.encoder.Encode(msg); err == nil {
+		err = s.encoder.Encode(data)
+	}
+	var rmsg struct {
+		Result Copy
+		Err    string
+	}
+	if err == nil {
+		err = s.decoder.Decode(&rmsg)
+	}
+	if err != nil {
+		log.Println(err.Error())
+		return -1, 0
+	}
+	if len(rmsg.Err) > 0 {
+		log.Println(rmsg.Err)
+		return -1, 0
+	}
+	return rmsg.Result.Addr, rmsg.Result.Size
+}
+
+func (n *RemoteNode) Delete(addr int) (bool, error) {
+	var rmsg struct {
+		Err string
+	}
+	err := n.call(&Message{Command: "deletechunk", Args: []string{strconv.Itoa(n.id), strconv.Itoa(addr)}}, &rmsg)
+	if err != nil {
+		return false, err
+	}
+	if len(rmsg.Err) > 0 {
+		return false, errors.New(rmsg.Err)
+	}
+	return true, nil
+}
+
+func (n *RemoteNode) Checksums() map[int]uint32 {
+	var rmsg struct {
+		Result map[int]uint32
+		Err    string
+	}
+	if err := n.call(&Message{Command: "chunkchecksums", Args: []string{strconv.Itoa(n.id)}}, &rmsg); err != nil {
+		log.Println(err.Error())
+	}
+	if rmsg.Result == nil {
+		return map[int]uint32{}
+	}
+	return rmsg.Result
+}
+
+func (n *RemoteNode) Checksum(addr int) (uint32, bool) {
+	var rmsg struct {
+		Result  uint32
+		Checked bool
+		Err     string
+	}
+	err := n.call(&Message{Command: "chunkchecksum", Args: []string{strconv.Itoa(n.id), strconv.Itoa(addr)}}, &rmsg)
+	if err != nil {
+		log.Println(err.Error())
+	} else if len(rmsg.Err) > 0 {
+		log.Println(rmsg.Err)
+	}
+	return rmsg.Result, rmsg.Checked
+}
+
+// recordAppend forwards a record append to the server holding the node.
+func (n *RemoteNode) recordAppend(filename string, record []byte) (int, error) {
+	conn, err := net.Dial("tcp", n.addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	s := newSession(conn)
+	var rmsg struct {
+		Result int
+		Err    string
+	}
+	if err = s.encoder.Encode(&Message{Command: "recordappend", Args: []string{filename}}); err == nil {
+		err = s.encoder.Encode(record)
+	}
+	if err == nil {
+		err = s.decoder.Decode(&rmsg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(rmsg.Err) > 0 {
+		return 0, errors.New(rmsg.Err)
+	}
+	return rmsg.Result, nil
+}
+
+// start forwards startnode, or restartnode when restart is set, to the
+// server holding the node.
+func (n *RemoteNode) start(restart bool) (string, error) {
+	command := "startnode"
+	if restart {
+		command = "restartnode"
+	}
+	var rmsg struct {
+		Result string
+		Err    string
+	}
+	if err := n.call(&Message{Command: command, Args: []string{strconv.Itoa(n.id)}}, &rmsg); err != nil {
+		return "", err
+	}
+	if len(rmsg.Err) > 0 {
+		return "", errors.New(rmsg.Err)
+	}
+	n.setRunning(true)
+	return rmsg.Result, nil
+}
+
+// NewChunkNode starts serving node id of a rack from this process and joins
+// the metadata server at address master. A negative rack leaves the rack to
+// the metadata server. The node keeps its chunks under
+// datadir, or in memory when no datadir is given, and listens on port, or
+// on any free port when port is 0. The returned server is started with Run.
+func NewChunkNode(serverName string, serverConfig map[string]interface{}) (*ChunkServer, error) {
+	nodeID, _ := serverConfig["id"].(int)
+	rack, _ := serverConfig["rack"].(int)
+	master, _ := serverConfig["master"].(string)
+	port, _ := serverConfig["port"].(int)
+	dataDir, _ := serverConfig["datadir"].(string)
+
+	socket, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	port = socket.Addr().(*net.TCPAddr).Port
+	addr := fmt.Sprintf(":%d", port)
+
+	var node DataNode = &Node{id: nodeID}
+	if len(dataDir) > 0 {
+		node = NewDiskNode(nodeID, dataDir)
+	}
+	if err = node.Load(); err != nil {
+		socket.Close()
+		return nil, fmt.Errorf("unable to load chunks for node %d: %v", nodeID, err)
+	}
+
+	args := []string{strconv.Itoa(nodeID), strconv.Itoa(rack), addr}
+	for chunkAddr, checksum := range node.Checksums() {
+		args = append(args, fmt.Sprintf("%d:%d", chunkAddr, checksum))
+	}
+	var rmsg struct {
+		Result  map[string]interface{}
+		Members map[int]NodeMember
+		Err     string
+	}
+	err = (&RemoteNode{addr: master}).call(&Message{Command: "joinnode", Args: args}, &rmsg)
+	if err == nil && len(rmsg.Err) > 0 {
+		err = errors.New(rmsg.Err)
+	}
+	if err != nil {
+		socket.Close()
+		return nil, err
+	}
+
+	config := rmsg.Result
+	config["port"] = strconv.Itoa(port)
+	config["metaaddr"] = master
+	// the other nodes are attached below
+	delete(config, "datadir")
+	chunkServer := NewChunkServer(serverName, config)
+	chunkServer.socket = socket
+	chunkServer.self = nodeID
+	chunkServer.addr = addr
+	chunkServer.nodesMutex.Lock()
+	if nodeID >= len(chunkServer.nodes) {
+		chunkServer.nodesMutex.Unlock()
+		socket.Close()
+		return nil, fmt.Errorf("no node with id %d", nodeID)
+	}
+	chunkServer.nodes[nodeID] = node
+	chunkServer.racks[nodeID] = rmsg.Members[nodeID].Rack
+	chunkAddr, _ := config["chunkaddr"].(string)
+	chunkServer.chunkAddr = chunkAddr
+	for id := range chunkServer.nodes {
+		if id != nodeID {
+			chunkServer.nodes[id] = &RemoteNode{id: id, addr: chunkAddr}
+		}
+	}
+	chunkServer.nodesMutex.Unlock()
+	chunkServer.attachMembers(rmsg.Members)
+	return chunkServer, nil
+}
+
+// node returns the node with the given id, or nil if there is none.
+func (c *ChunkServer) node(nodeID int) DataNode {
+	c.nodesMutex.RLock()
+	defer c.nodesMutex.RUnlock()
+	if nodeID < 0 || nodeID >= len(c.nodes) {
+		return nil
+	}
+	return c.nodes[nodeID]
+}
+
+// nodeList returns the nodes by id.
+func (c *ChunkServer) nodeList() []DataNode {
+	c.nodesMutex.RLock()
+	defer c.nodesMutex.RUnlock()
+	return append([]DataNode(nil), c.nodes...)
+}
+
+// localNode returns a node held by this server, or nil if the node is
+// remote or there is none.
+func (c *ChunkServer) localNode(nodeID int) DataNode {
+	node := c.node(nodeID)
+	if _, remote := node.(*RemoteNode); remote {
+		return nil
+	}
+	return node
+}
+
+// readCopy reads a chunk copy from the node holding it. An error means the
+// node could not be reached or no longer holds the copy, neither of which is
+// data that fails verification, so neither is reported as a bad copy.
+func (c *ChunkServer) readCopy(nodeID int, addr int) ([]byte, error) {
+	node := c.node(nodeID)
+	if node == nil {
+		return nil, fmt.Errorf("no node with id %d", nodeID)
+	}
+	if remote, ok := node.(*RemoteNode); ok {
+		return remote.read(addr)
+	}
+	return readLocal(nodeID, node, addr)
+}
+
+// readLocal reads a chunk from a node held by this server. A node reads an
+// address it does not hold as no data, which is told apart here from a chunk
+// that is empty or whose data is wrong.
+func readLocal(nodeID int, node DataNode, addr int) ([]byte, error) {
+	if _, ok := node.Checksums()[addr]; !ok {
+		return nil, fmt.Errorf("no chunk at address %d on node %d", addr, nodeID)
+	}
+	return []byte(node.Read(addr)), nil
+}
+
+// rackOf returns the rack of a node, which is given by its id unless the
+// node joined with a rack of its own.
+func (c *ChunkServer) rackOf(nodeID int) int {
+	c.nodesMutex.RLock()
+	defer c.nodesMutex.RUnlock()
+	if rack, ok := c.racks[nodeID]; ok {
+		return rack
+	}
+	return nodeID / c.NODEPERRACK
+}
+
+// attachMembers reaches the nodes running in processes of their own at their
+// address, except the node this server holds itself.
+func (c *ChunkServer) attachMembers(members map[int]NodeMember) {
+	c.nodesMutex.Lock()
+	defer c.nodesMutex.Unlock()
+	for nodeID, member := range members {
+		if nodeID == c.self || nodeID < 0 || nodeID >= len(c.nodes) {
+			continue
+		}
+		if remote, ok := c.nodes[nodeID].(*RemoteNode); !ok || remote.addr != member.Addr {
+			c.nodes[nodeID] = &RemoteNode{id: nodeID, addr: member.Addr}
+			log.Printf("node %d runs at %s\n", nodeID, member.Addr)
+		}
+		c.racks[nodeID] = member.Rack
+	}
+}
+
+// updateLiveness marks the remote nodes the metadata server reported as
+// stopped in its reply to a heartbeat, and every other one as running.
+func (c *ChunkServer) updateLiveness(stopped []int) {
+	isStopped := map[int]bool{}
+	for _, nodeID := range stopped {
+		isStopped[nodeID] = true
+	}
+	for nodeID, node := range c.nodeList() {
+		if remote, ok := node.(*RemoteNode); ok {
+			remote.setRunning(!isStopped[nodeID])
+		}
+	}
+}
+
+// handleNodeCommand serves a command on a node held by this server. Nodes
+// held elsewhere are refused rather than forwarded, so a request never goes
+// around in circles.
+func (c *ChunkServer) handleNodeCommand(s *session, msg *Message) {
+	var err error
+	nodeID, _ := strconv.Atoi(msg.Args[0])
+	node := c.localNode(nodeID)
+	var notServed string
+	if node == nil {
+		notServed = fmt.Sprintf("node %d is not served here", nodeID)
+	}
+	switch msg.Command {
+	case "chunkwrite":
+		var rmsg struct {
+			Result Copy
+			Err    string
+		}
+		// the data follows the command even if it cannot be stored
+		var data []byte
+		if err = s.decoder.Decode(&data); err != nil {
+			log.Println(err.Error())
+			return
+		}
+		if node == nil {
+			rmsg.Err = notServed
+		} else {
+			checksum, _ := strconv.ParseUint(msg.Args[1], 10, 32)
+			dataChannel := make(chan []byte, 1)
+			dataChannel <- data
+			rmsg.Result = c.hanleDataWrite(nodeID, dataChannel, uint32(checksum))
+			if !rmsg.Result.Valid {
+				rmsg.Err = fmt.Sprintf("unable to write chunk to node %d", nodeID)
+			}
+		}
+		err = s.encoder.Encode(rmsg)
+		break
+	case "chunkread":
+		var rmsg struct {
+			Result []byte
+			Err    string
+		}
+		if node == nil {
+			rmsg.Err = notServed
+		} else {
+			addr, _ := strconv.Atoi(msg.Args[1])
+			c.countOp(nodeID)
+			data, readErr := readLocal(nodeID, node, addr)
+			if readErr != nil {
+				rmsg.Err = readErr.Error()
+			}
+			rmsg.Result = data
+		}
+		err = s.encoder.Encode(rmsg)
+		break
+	case "chunkchecksums":
+		var rmsg struct {
+			Result map[int]uint32
+			Err    string
+		}
+		if node == nil {
+			rmsg.Err = notServed
+		} else {
+			rmsg.Result = node.Checksums()
+		}
+		err = s.encoder.Encode(rmsg)
+		break
+	case "chunkchecksum":
+		var rmsg struct {
+			Result  uint32
+			Checked bool
+			Err     string
+		}
+		if node == nil {
+			rmsg.Err = notServed
+		} else {
+			addr, _ := strconv.Atoi(msg.Args[1])
+			rmsg.Result, rmsg.Checked = node.Checksum(addr)
+		}
+		err = s.encoder.Encode(rmsg)
+		break
+	case "nodesize":
+		var rmsg struct {
+			Result int
+			Err    string
+		}
+		if node == nil {
+			rmsg.Err = notServed
+		} else {
+			rmsg.Result = node.GetSize()
+		}
+		err = s.encoder.Encode(rmsg)
+		break
+	}
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// JoinNode records where a node process runs, has the chunk server reach
+// the node there and reconciles the chunks it holds like RegisterNode. It
+// returns the chunk server configuration and the nodes running in processes.
+func (m *MasterNode) JoinNode(nodeID int, rack int, addr string, held map[int]uint32) (map[string]interface{}, map[int]NodeMember, error) {
+	m.mutex.Lock()
+	if nodeID < 0 || nodeID >= m.ROW {
+		m.mutex.Unlock()
+		return nil, nil, fmt.Errorf("no node with id %d", nodeID)
+	} else if m.decommissioned[nodeID] {
+		m.mutex.Unlock()
+		return nil, nil, fmt.Errorf("node %d was decommissioned", nodeID)
+	}
+	if rack < 0 {
+		rack = m.rackOf(nodeID)
+	}
+	member := NodeMember{Addr: addr, Rack: rack}
+	m.members[nodeID] = member
+	m.mutex.Unlock()
+	if err := m.attachNode(nodeID, member); err != nil {
+		return nil, nil, err
+	}
+	result, err := m.RegisterNode(nodeID, held)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("node %d joined from %s on rack %d, %s\n", nodeID, addr, rack, result)
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.chunkServerConfig(), m.memberList(), nil
+}
+
+// attachNode tells the chunk server where a node process runs.
+func (m *MasterNode) attachNode(nodeID int, member NodeMember) error {
+	var rmsg struct {
+		Err string
+	}
+	msg := &Message{Command: "attachnode", Args: []string{strconv.Itoa(nodeID), member.Addr, strconv.Itoa(member.Rack)}}
+	if err := m.callChunkServer(msg, &rmsg); err != nil {
+		return err
+	}
+	if len(rmsg.Err) > 0 {
+		return errors.New(rmsg.Err)
+	}
+	return nil
+}
+
+// memberList copies the node processes and expects the caller to hold the
+// metadata lock.
+func (m *MasterNode) memberList() map[int]NodeMember {
+	members := map[int]NodeMember{}
+	for nodeID, member := range m.members {
+		members[nodeID] = member
+	}
+	return members
+}
+
+// rackOf returns the rack of a node and expects the caller to hold the
+// metadata lock.
+func (m *MasterNode) rackOf(nodeID int) int {
+	if member, ok := m.members[nodeID]; ok {
+		return member.Rack
+	} else if rack, ok := m.nodeRacks[nodeID]; ok {
+		return rack
+	}
+	return nodeID / m.COLUMN
+}
+
+// memberStat describes where a node runs for nodestat and expects the
+// caller to hold the metadata lock.
+func (m *MasterNode) memberStat(nodeID int) string {
+	if member, ok := m.members[nodeID]; ok {
+		return fmt.Sprintf("(rack %d, at %s) ", member.Rack, member.Addr)
+	}
+	return fmt.Sprintf("(rack %d) ", m.rackOf(nodeID))
+}
+
+// memberAddr returns the address of a node process, or an empty string if
+// the node is held by the chunk server.
+func (m *MasterNode) memberAddr(nodeID int) string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.members[nodeID].Addr
+}
+
+// readAddr picks the node process holding a valid copy of the first chunk
+// of a file, or returns an empty string if there is none.
+func (m *MasterNode) readAddr(entry FileEntry) string {
+	chunks := entry.Read()
+	if len(chunks) == 0 {
+		return ""
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	for _, chunkCopy := range chunks[0].Read() {
+		member, ok := m.members[chunkCopy.Node]
+		if ok && chunkCopy.Valid && !m.downNodes[chunkCopy.Node] {
+			return member.Addr
+		}
+	}
+	return ""
+}
+
+// primaryAddr returns the address of the node process holding the lease on
+// a file, granting one if needed, or an empty string if the primary is held
+// by the chunk server.
+func (m *MasterNode) primaryAddr(filename string) string {
+	m.mutex.RLock()
+	processes := len(m.members)
+	m.mutex.RUnlock()
+	if processes == 0 {
+		return ""
+	}
+	lease, err := m.GrantLease(filename)
+	if err != nil {
+		return ""
+	}
+	return m.memberAddr(lease.Primary)
+}
@@ -2,10 +2,11 @@ package server
 
 import (
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"log"
-	"math/rand"
 	"net"
 	"os"
 	"strconv"
@@ -14,10 +15,15 @@ import (
 )
 
 type Copy struct {
-	Node  int
-	Addr  int
-	Valid bool
-	Size  int
+	Node     int
+	Addr     int
+	Valid    bool
+	Size     int
+	Checksum uint32
+	// version of the chunk the copy holds, see version.go
+	Version int
+	// shard of an erasure coded chunk the copy holds, see erasure.go
+	Shard int
 }
 
 type Chunk interface {
@@ -25,12 +31,14 @@ type Chunk interface {
 	Read() []byte
 	Write([]byte)
 	Size() int
+	Checksum() uint32
 }
 
 type ChunkFile struct {
-	data    []byte
-	valid   bool
-	maxSize int
+	data     []byte
+	valid    bool
+	maxSize  int
+	checksum uint32
 }
 
 type ChunkEntry interface {
@@ -38,33 +46,87 @@ type ChunkEntry interface {
 	Read() []Copy
 	stopNode(int)
 	Size() int
+	GetChecksum() uint32
+	HasChecksum() bool
+	GetVersion() int
+	clone() ChunkEntry
 }
 
 type ChunkMetadata struct {
-	Index  int
-	Copies []Copy
+	Index    int
+	Copies   []Copy
+	Checksum uint32
+	// whether Checksum was recorded, chunks written before checksums were
+	// kept have none
+	Checked bool
+	Version int
+	// coding of the chunk and its size before it was split into shards,
+	// zero for replicated chunks, see erasure.go
+	Erasure ErasureScheme
+	Length  int
 }
 
 type ChunkServer struct {
 	serverName  string
 	socket      net.Listener
 	CHUNKSIZE   int
+	REPLICAS    int
+	CAPACITY    int
 	NODEPERRACK int
 	RACKNUMBER  int
 	nodes       []DataNode
+	placement   PlacementPolicy
 	PORT        int
-	encoder     *gob.Encoder
-	decoder     *gob.Decoder
+	// address of the metadata server
+	metaAddr string
+	// the node a chunk node process serves, -1 for the chunk server of the
+	// metadata server, the address it is reached at and the racks of nodes
+	// that joined with one, see chunk_node.go
+	self       int
+	addr       string
+	chunkAddr  string
+	racks      map[int]int
+	nodesMutex sync.RWMutex
+	// capacities of nodes added at runtime, draining nodes and where new
+	// nodes keep their chunks, see membership.go
+	capacities map[int]int
+	draining   map[int]bool
+	dataDir    string
+	// serial order of the mutations of every file, see lease.go
+	mutations     map[string]*mutationOrder
+	mutationMutex sync.Mutex
+	// parallel reads, see fetchChunks and readChunk
+	readConcurrency int
+	hedgeDelay      time.Duration
+	// heartbeats to the metadata server and the load of every node since
+	// the last one, see heartbeat.go
+	heartbeatInterval time.Duration
+	load              []int64
+	// scrubber settings, see scrubber.go
+	scrubInterval time.Duration
+	scrubRate     int
+	scrubStats    []ScrubStat
+	scrubMutex    sync.Mutex
+	// closed by Close to stop the server and its background work
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 type DataNode interface {
 	GetSize() int
 	Run()
-	Write(<-chan []byte) (int, int)
+	// Write stores the next chunk of the channel together with its checksum
+	Write(<-chan []byte, uint32) (int, int)
 	Kill()
 	Read(int) string
 	Delete(int) (bool, error)
 	IsRunning() bool
+	Load() error
+	// Checksums returns the stored checksum of every chunk by address
+	Checksums() map[int]uint32
+	// Checksum returns the checksum stored with the chunk at an address, or
+	// false if the chunk has none
+	Checksum(int) (uint32, bool)
 }
 
 type Node struct {
@@ -76,6 +138,27 @@ type Node struct {
 	mutex    sync.Mutex
 }
 
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// chunkChecksum returns the CRC32C checksum stored for every chunk.
+func chunkChecksum(data []byte) uint32 {
+	return crc32.Checksum(data, castagnoliTable)
+}
+
+// verifyChunk reports whether data matches checksum. Chunks written before
+// checksums were recorded have none, checked is false for them, and are
+// accepted as is.
+func verifyChunk(data []byte, checksum uint32, checked bool) bool {
+	return !checked || chunkChecksum(data) == checksum
+}
+
+func init() {
+	// chunk entries travel inside File values as the ChunkEntry interface
+	gob.Register(&ChunkMetadata{})
+	// part of the chunk server configuration sent to joining node processes
+	gob.Register(map[int]int{})
+}
+
 func (c *Copy) stopNode() {
 	c.Valid = false
 }
@@ -88,6 +171,10 @@ func (c *ChunkFile) Write(fragment []byte) {
 	c.data = fragment
 }
 
+func (c *ChunkFile) Checksum() uint32 {
+	return c.checksum
+}
+
 func (c *ChunkFile) Size() int {
 	return len(c.data)
 }
@@ -98,14 +185,31 @@ func (c *ChunkFile) GetMaxSize() int {
 
 func (c *ChunkMetadata) stopNode(nodeID int) {
 
-	for _, chunkCopy := range c.Copies {
-		if chunkCopy.Node == nodeID {
-			chunkCopy.stopNode()
+	for i := range c.Copies {
+		if c.Copies[i].Node == nodeID {
+			c.Copies[i].stopNode()
 			break
 		}
 	}
 }
 
+func (c *ChunkMetadata) clone() ChunkEntry {
+	return &ChunkMetadata{Index: c.Index, Copies: append([]Copy(nil), c.Copies...), Checksum: c.Checksum, Checked: c.Checked,
+		Version: c.Version, Erasure: c.Erasure, Length: c.Length}
+}
+
+func (c *ChunkMetadata) GetVersion() int {
+	return c.Version
+}
+
+func (c *ChunkMetadata) GetChecksum() uint32 {
+	return c.Checksum
+}
+
+func (c *ChunkMetadata) HasChecksum() bool {
+	return c.Checked
+}
+
 func (c *ChunkMetadata) Read() []Copy {
 	return c.Copies
 }
@@ -115,6 +219,9 @@ func (c *ChunkMetadata) Id() int {
 }
 
 func (c *ChunkMetadata) Size() int {
+	if c.Erasure.Data > 0 {
+		return c.Length
+	}
 	if len(c.Copies) > 0 {
 		return c.Copies[0].Size
 	}
@@ -123,22 +230,65 @@ func (c *ChunkMetadata) Size() int {
 
 func NewChunkServer(serverName string, serverConfig map[string]interface{}) *ChunkServer {
 
-	var newChunkServer = ChunkServer{serverName: serverName}
+	var newChunkServer = ChunkServer{serverName: serverName, mutations: map[string]*mutationOrder{}, self: -1, done: make(chan struct{}),
+		racks: map[int]int{}, capacities: map[int]int{}, draining: map[int]bool{}}
 	portString, _ := serverConfig["port"].(string)
 	newChunkServer.PORT, _ = strconv.Atoi(portString)
+	newChunkServer.addr = fmt.Sprintf(":%d", newChunkServer.PORT)
 	newChunkServer.NODEPERRACK, _ = serverConfig["NO_PER_RACK"].(int)
 	newChunkServer.CHUNKSIZE, _ = serverConfig["chunksize"].(int)
+	newChunkServer.REPLICAS, _ = serverConfig["replicas"].(int)
+	newChunkServer.CAPACITY, _ = serverConfig["capacity"].(int)
+	newChunkServer.metaAddr, _ = serverConfig["metaaddr"].(string)
+	if len(newChunkServer.metaAddr) == 0 {
+		newChunkServer.metaAddr = ":" + os.Getenv("META_SERVER_PORT")
+	}
+	policyName, _ := serverConfig["placement"].(string)
+	var err error
+	newChunkServer.placement, err = NewPlacementPolicy(policyName)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
 	nodesCount, _ := serverConfig["nodes"].(int)
 	newChunkServer.RACKNUMBER = nodesCount / newChunkServer.NODEPERRACK
+	dataDir, _ := serverConfig["datadir"].(string)
+	newChunkServer.dataDir = dataDir
+	racks, _ := serverConfig["racks"].(map[int]int)
+	for nodeID, rack := range racks {
+		newChunkServer.racks[nodeID] = rack
+	}
+	capacities, _ := serverConfig["capacities"].(map[int]int)
+	for nodeID, capacity := range capacities {
+		newChunkServer.capacities[nodeID] = capacity
+	}
+	draining, _ := serverConfig["draining"].([]int)
+	for _, nodeID := range draining {
+		newChunkServer.draining[nodeID] = true
+	}
+	newChunkServer.readConcurrency, _ = serverConfig["readconcurrency"].(int)
+	hedgeDelay, _ := serverConfig["hedgedelay"].(int)
+	newChunkServer.hedgeDelay = time.Duration(hedgeDelay) * time.Millisecond
+	scrubInterval, _ := serverConfig["scrubinterval"].(int)
+	newChunkServer.scrubInterval = time.Duration(scrubInterval) * time.Second
+	newChunkServer.scrubRate, _ = serverConfig["scrubrate"].(int)
+	heartbeatInterval, _ := serverConfig["heartbeatinterval"].(int)
+	newChunkServer.heartbeatInterval = time.Duration(heartbeatInterval) * time.Millisecond
+	newChunkServer.load = make([]int64, nodesCount)
 
+	newChunkServer.scrubStats = make([]ScrubStat, nodesCount)
 	for i := 0; i < nodesCount; i++ {
-		newChunkServer.nodes = append(newChunkServer.nodes, &Node{})
+		newChunkServer.scrubStats[i].Node = i
+		if len(dataDir) > 0 {
+			newChunkServer.nodes = append(newChunkServer.nodes, NewDiskNode(i, dataDir))
+		} else {
+			newChunkServer.nodes = append(newChunkServer.nodes, &Node{id: i})
+		}
 	}
 	return &newChunkServer
 }
 
 func (c *ChunkServer) sendMsg(msg *Message) error {
-	conn, err := net.Dial("tcp", ":"+os.Getenv("META_SERVER_PORT"))
+	conn, err := net.Dial("tcp", c.metaAddr)
 	defer conn.Close()
 	if err != nil {
 		return err
@@ -155,24 +305,55 @@ func (c *ChunkServer) sendMsg(msg *Message) error {
 
 func (c *ChunkServer) Run() {
 	var err error
-	c.socket, err = net.Listen("tcp", fmt.Sprintf(":%d", c.PORT))
-	if err != nil {
-		log.Fatalf("unable to start %s server: %v\n", c.serverName, err.Error())
+	// a chunk node process listens before it joins the metadata server
+	if c.socket == nil {
+		c.socket, err = net.Listen("tcp", fmt.Sprintf(":%d", c.PORT))
+		if err != nil {
+			log.Fatalf("unable to start %s server: %v\n", c.serverName, err.Error())
+		}
 	}
 	fmt.Printf("starting %v server at port %d\n", c.serverName, c.PORT)
 
+	for id, node := range c.nodeList() {
+		if err := node.Load(); err != nil {
+			log.Fatalf("unable to load chunks for node %d: %v\n", id, err.Error())
+		}
+	}
+	if c.scrubInterval > 0 {
+		go c.runScrubber()
+	}
+	if c.heartbeatInterval > 0 {
+		go c.runHeartbeats()
+	}
+
 	for {
 		conn, err := c.socket.Accept()
 		if err != nil {
+			select {
+			case <-c.done:
+				return
+			default:
+			}
 			log.Fatal(err.Error())
 		}
-		c.encoder = gob.NewEncoder(conn)
-		c.decoder = gob.NewDecoder(conn)
-		go c.handleConnection(conn)
+		go c.handleConnection(newSession(conn))
 
 	}
 }
 
+// Close stops a running server: it takes no more connections and its nodes
+// stop sending heartbeats, so the metadata server sees them die.
+func (c *ChunkServer) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if c.socket != nil {
+			err = c.socket.Close()
+		}
+	})
+	return err
+}
+
 func (c *ChunkServer) GetInfo() string {
 
 	return fmt.Sprintf(`server type: %s server
@@ -180,13 +361,13 @@ total avialable nodes: %d
 nodes per rack:        %d
 total available racks: %d
 running nodes:         %d`,
-		c.serverName, len(c.nodes), c.NODEPERRACK, c.RACKNUMBER,
+		c.serverName, len(c.nodeList()), c.NODEPERRACK, c.RACKNUMBER,
 		c.RunningNodes())
 }
 
 func (c *ChunkServer) RunningNodes() int {
 	var totalRunningNodes int
-	for _, node := range c.nodes {
+	for _, node := range c.nodeList() {
 		if node.IsRunning() {
 			totalRunningNodes++
 		}
@@ -194,12 +375,12 @@ func (c *ChunkServer) RunningNodes() int {
 	return totalRunningNodes
 }
 
-func (c *ChunkServer) handleConnection(conn net.Conn) {
-	defer conn.Close()
-	var msg Message
+func (c *ChunkServer) handleConnection(s *session) {
+	defer s.conn.Close()
 	var err error
 	for {
-		err = c.decoder.Decode(&msg)
+		var msg Message
+		err = s.decoder.Decode(&msg)
 		if err != nil {
 			if err == io.EOF {
 				break
@@ -207,36 +388,149 @@ func (c *ChunkServer) handleConnection(conn net.Conn) {
 			log.Println("decode error: ", err.Error())
 			break
 		}
-		c.handleClientCommands(&msg)
+		c.handleClientCommands(s, &msg)
 	}
 }
 
-func (c *ChunkServer) handleClientCommands(msg *Message) {
+func (c *ChunkServer) handleClientCommands(s *session, msg *Message) {
 	var err error
 	switch msg.Command {
 	case "read":
 		var entry File
-		err = c.decoder.Decode(&entry)
+		err = s.decoder.Decode(&entry)
 		if err != nil {
 			if err != io.EOF {
 				log.Println(err.Error())
 			}
 			break
 		}
-		c.handleReadConnection(entry.Read())
+		offset, length := 0, -1
+		if len(msg.Args) > 2 {
+			offset, _ = strconv.Atoi(msg.Args[1])
+			length, _ = strconv.Atoi(msg.Args[2])
+		}
+		c.handleReadConnection(s, &entry, offset, length)
 		break
 	case "write":
 		var entry File
-		err = c.decoder.Decode(&entry)
+		err = s.decoder.Decode(&entry)
+		if err != nil {
+			log.Println(err.Error())
+			break
+		}
+		c.handleWriteConnection(s, &entry)
+		break
+	case "append":
+		var entry File
+		err = s.decoder.Decode(&entry)
 		if err != nil {
 			log.Println(err.Error())
 			break
 		}
-		c.handleWriteConnection(&entry)
+		c.handleAppendConnection(s, &entry)
+		break
+	case "recordappend":
+		var record []byte
+		var rmsg struct {
+			Result int
+			Err    string
+		}
+		err = s.decoder.Decode(&record)
+		if err != nil {
+			log.Println(err.Error())
+			break
+		}
+		rmsg.Result, err = c.RecordAppend(msg.Args[0], record)
+		if err != nil {
+			rmsg.Err = err.Error()
+		}
+		err = s.encoder.Encode(rmsg)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		break
+	case "replicate":
+		c.handleReplicateConnection(s, msg.Args)
+		break
+	case "reconstruct":
+		c.handleReconstructConnection(s, msg.Args)
+		break
+	case "deletechunk":
+		var rmsg struct {
+			Err string
+		}
+		nodeID, _ := strconv.Atoi(msg.Args[0])
+		addr, _ := strconv.Atoi(msg.Args[1])
+		if node := c.node(nodeID); node == nil {
+			rmsg.Err = fmt.Sprintf("no node with id %d", nodeID)
+		} else if _, err = node.Delete(addr); err != nil {
+			rmsg.Err = err.Error()
+		}
+		err = s.encoder.Encode(rmsg)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		break
+	case "chunkread", "chunkwrite", "chunkchecksums", "chunkchecksum", "nodesize":
+		c.handleNodeCommand(s, msg)
+		break
+	case "addnode", "drainnode":
+		// addnode <id> <rack> <capacity>, drainnode <id>, sent by the
+		// metadata server, see membership.go
+		var rmsg struct {
+			Err string
+		}
+		nodeID, _ := strconv.Atoi(msg.Args[0])
+		if msg.Command == "drainnode" {
+			c.drainNode(nodeID)
+		} else if len(msg.Args) < 3 {
+			rmsg.Err = "missing rack and capacity of the new node"
+		} else {
+			rack, _ := strconv.Atoi(msg.Args[1])
+			capacity, _ := strconv.Atoi(msg.Args[2])
+			if err = c.addNode(nodeID, rack, capacity); err != nil {
+				rmsg.Err = err.Error()
+			}
+		}
+		err = s.encoder.Encode(rmsg)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		break
+	case "attachnode":
+		// attachnode <id> <addr> <rack>, sent by the metadata server when a
+		// node process joins
+		var rmsg struct {
+			Err string
+		}
+		nodeID, _ := strconv.Atoi(msg.Args[0])
+		rack, _ := strconv.Atoi(msg.Args[2])
+		c.attachMembers(map[int]NodeMember{nodeID: {Addr: msg.Args[1], Rack: rack}})
+		err = s.encoder.Encode(rmsg)
+		if err != nil {
+			log.Println(err.Error())
+		}
 		break
 	case "killnode":
 		nodeID, _ := strconv.Atoi(msg.Args[0])
-		c.handleKillConnection(nodeID)
+		c.handleKillConnection(s, nodeID)
+		break
+	case "startnode", "restartnode":
+		var rmsg struct {
+			Result string
+			Err    string
+		}
+		nodeID, err := strconv.Atoi(msg.Args[0])
+		if err == nil {
+			rmsg.Result, err = c.StartNode(nodeID, msg.Command == "restartnode")
+		}
+		if err != nil {
+			rmsg.Err = err.Error()
+		}
+		err = s.encoder.Encode(rmsg)
+		if err != nil {
+			log.Println(err.Error())
+		}
 		break
 	case "nodestat":
 		var rmsg struct {
@@ -244,7 +538,18 @@ func (c *ChunkServer) handleClientCommands(msg *Message) {
 			Err    string
 		}
 		rmsg.Result = c.GetInfo()
-		err = c.encoder.Encode(rmsg)
+		err = s.encoder.Encode(rmsg)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		break
+	case "scrubstat":
+		var rmsg struct {
+			Result string
+			Err    string
+		}
+		rmsg.Result = formatScrubStats(c.ScrubStats())
+		err = s.encoder.Encode(rmsg)
 		if err != nil {
 			log.Println(err.Error())
 		}
@@ -254,176 +559,479 @@ func (c *ChunkServer) handleClientCommands(msg *Message) {
 	}
 }
 
-func (c *ChunkServer) handleReadConnection(entries []ChunkEntry) {
-	var fileString string
-	var foundvalidCopy bool
-	var err error
-	for _, entry := range entries {
-		foundvalidCopy = false
-		copies := entry.Read()
-		for _, copy := range copies {
-			if copy.Valid {
-				foundvalidCopy = true
-				fileString += c.nodes[copy.Node].Read(copy.Addr)
-				break
-			}
+// ReadPiece is one reply to a read. The chunks overlapping the requested
+// range are sent one piece each, followed by an empty piece; a piece with
+// Err set ends the read early.
+type ReadPiece struct {
+	Data []byte
+	Err  string
+}
+
+// handleReadConnection streams the chunks of file overlapping the byte range
+// [offset, offset+length) in order. A negative length reads to the end of the
+// file.
+func (c *ChunkServer) handleReadConnection(s *session, file FileEntry, offset int, length int) {
+	end := offset + length
+	var start int
+	var fetches []chunkFetch
+	for index, entry := range file.Read() {
+		chunkStart := start
+		start += entry.Size()
+		if start <= offset {
+			continue
 		}
-		if !foundvalidCopy {
-			err = c.encoder.Encode("no valid chunk data found for file entry")
-			if err != nil {
-				log.Println(err.Error())
-			}
+		if length >= 0 && chunkStart >= end {
 			break
 		}
+		fetch := chunkFetch{index: index, entry: entry, low: 0, high: entry.Size()}
+		if offset > chunkStart {
+			fetch.low = offset - chunkStart
+		}
+		if length >= 0 && end-chunkStart < fetch.high {
+			fetch.high = end - chunkStart
+		}
+		fetches = append(fetches, fetch)
 	}
-	if err == nil {
-		err := c.encoder.Encode(fileString)
+
+	var failed bool
+	c.fetchChunks(file.GetName(), fetches, func(fetch chunkFetch, data []byte, err error) bool {
+		var piece ReadPiece
 		if err != nil {
+			piece.Err = err.Error()
+			failed = true
+		} else {
+			low, high := fetch.low, fetch.high
+			if high > len(data) {
+				high = len(data)
+			}
+			if low >= high {
+				// an empty piece would end the read
+				return true
+			}
+			piece.Data = data[low:high]
+		}
+		if err = s.encoder.Encode(piece); err != nil {
 			log.Println(err.Error())
+			failed = true
 		}
+		return !failed
+	})
+	if failed {
+		return
 	}
+	if err := s.encoder.Encode(ReadPiece{}); err != nil {
+		log.Println(err.Error())
+	}
+}
 
+// chunkFetch is a chunk to read and the part of it the reader asked for.
+type chunkFetch struct {
+	index     int
+	entry     ChunkEntry
+	low, high int
 }
 
-func (c *ChunkServer) handleWriteConnection(entry FileEntry) {
-	var buf = make([]byte, c.CHUNKSIZE)
-	dataChannel := make(chan []byte, 3)
-	var chunkCopies []Copy
-	// ensure no chunk copies exists for this file entry
-	for _, chunk := range entry.Read() {
-		copies := chunk.Read()
-		if len(copies) > 0 {
-			for _, copy := range copies {
-				ok, err := c.nodes[copy.Node].Delete(copy.Addr)
-				if ok {
-					log.Println("deleted chunk copy at address ", copy.Addr)
-				} else {
-					log.Println(err.Error())
-				}
+type fetchResult struct {
+	data []byte
+	err  error
+}
+
+// fetchChunks reads chunks with up to readConcurrency reads in flight and
+// hands them to emit in order, until emit returns false. A slot is only
+// freed once its chunk was emitted, so no more than readConcurrency chunks
+// are held in memory while waiting for a slow one.
+func (c *ChunkServer) fetchChunks(filename string, fetches []chunkFetch, emit func(chunkFetch, []byte, error) bool) {
+	concurrency := c.readConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+	done := make(chan struct{})
+	defer close(done)
+	results := make([]chan fetchResult, len(fetches))
+	for i := range results {
+		results[i] = make(chan fetchResult, 1)
+	}
+	go func() {
+		for i, fetch := range fetches {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			go func(i int, fetch chunkFetch) {
+				data, err := c.readChunk(filename, fetch.index, fetch.entry)
+				results[i] <- fetchResult{data: data, err: err}
+			}(i, fetch)
+		}
+	}()
+	for i, fetch := range fetches {
+		result := <-results[i]
+		<-slots
+		if !emit(fetch, result.data, result.err) || result.err != nil {
+			return
+		}
+	}
+}
+
+type copyRead struct {
+	copy Copy
+	data []byte
+	ok   bool
+	err  error
+}
+
+// readChunk returns the data of a valid copy of a chunk that passes
+// verification. Reads of consecutive chunks start on different copies to
+// spread the load, and when a copy does not answer within hedgeDelay the
+// next one is read as well and the first good answer wins.
+func (c *ChunkServer) readChunk(filename string, index int, entry ChunkEntry) ([]byte, error) {
+	if metadata, ok := entry.(*ChunkMetadata); ok && metadata.Erasure.Data > 0 {
+		return c.readStripe(filename, index, metadata)
+	}
+	var copies []Copy
+	for _, copy := range entry.Read() {
+		// stale copies missed mutations of the chunk
+		if node := c.node(copy.Node); copy.Valid && copy.Version >= entry.GetVersion() && node != nil && node.IsRunning() {
+			copies = append(copies, copy)
+		}
+	}
+	if len(copies) == 0 {
+		return nil, fmt.Errorf("no valid chunk data found for chunk %d of %s", index, filename)
+	}
+	reads := make(chan copyRead, len(copies))
+	next, pending := 0, 0
+	readNext := func() {
+		copy := copies[(index+next)%len(copies)]
+		next++
+		pending++
+		go func() {
+			c.countOp(copy.Node)
+			data, err := c.readCopy(copy.Node, copy.Addr)
+			reads <- copyRead{copy: copy, data: data, ok: err == nil && verifyChunk(data, entry.GetChecksum(), entry.HasChecksum()), err: err}
+		}()
+	}
+	readNext()
+	for pending > 0 {
+		var hedge <-chan time.Time
+		if c.hedgeDelay > 0 && next < len(copies) {
+			hedge = time.After(c.hedgeDelay)
+		}
+		select {
+		case read := <-reads:
+			pending--
+			if read.ok {
+				return read.data, nil
+			}
+			if read.err != nil {
+				// the node may be back for the next read, its copy is kept
+				log.Printf("unable to read chunk %d of %s from node %d: %v\n", index, filename, read.copy.Node, read.err)
+			} else {
+				// fall back to the next copy and let the master repair this one
+				log.Printf("checksum mismatch for chunk %d of %s on node %d\n", index, filename, read.copy.Node)
+				c.reportBadCopy(filename, index, read.copy)
+			}
+			if next < len(copies) {
+				readNext()
 			}
+		case <-hedge:
+			readNext()
 		}
 	}
-	entry.DeleteChunks()
+	return nil, fmt.Errorf("no valid chunk data found for chunk %d of %s", index, filename)
+}
+
+// handleWriteConnection stores the pieces the client streams after the file
+// entry, one chunk of at most CHUNKSIZE bytes each, so a file of any size is
+// written in constant memory. An empty piece ends the file and is answered
+// with the outcome of the write. The new chunks replace the previous contents
+// of the file only once the metadata server accepts them.
+func (c *ChunkServer) handleWriteConnection(s *session, file FileEntry) {
+	mu, writeErr := c.beginMutation(file.GetName())
+	defer c.endMutation(mu)
+	entry := &File{Name: file.GetName()}
+	if current, ok := file.(*File); ok {
+		entry.Replicas = current.Replicas
+		entry.Erasure = current.Erasure
+	}
+	replicas := c.REPLICAS
+	if entry.Replicas > 0 {
+		replicas = entry.Replicas
+	}
 	var err error
-	nodeID := c.pickWriteNode()
-	for {
-		err = c.decoder.Decode(&buf)
+	var size int
+	var ended bool
+	writer := mu.Lease.Primary
+	for !ended {
+		// a fresh slice per piece, since the decoder reuses the backing array
+		var data []byte
+		err = s.decoder.Decode(&data)
 		if err != nil {
-			if err == io.EOF {
-				break
+			if err != io.EOF {
+				log.Println("decode error: ", err.Error())
 			}
-			log.Println("decode error: ", err.Error())
 			break
 		}
-		// add 3 copies of buffered chunk
-		dataChannel <- buf
-		dataChannel <- buf
-		dataChannel <- buf
-		chunkCopies = append(chunkCopies, c.hanleDataWrite(nodeID, dataChannel))
-		of1, of2 := c.computeReplica(nodeID)
-		chunkCopies = append(chunkCopies, c.hanleDataWrite((nodeID+of1)%len(c.nodes), dataChannel))
-		chunkCopies = append(chunkCopies, c.hanleDataWrite((nodeID+of2)%len(c.nodes), dataChannel))
-		entry.Write(nodeID, chunkCopies)
+		ended = len(data) == 0
+		// larger pieces, e.g. from clients that send the whole file, are split
+		for len(data) > 0 && writeErr == nil {
+			piece := data
+			if len(piece) > c.CHUNKSIZE {
+				piece = data[:c.CHUNKSIZE]
+			}
+			data = data[len(piece):]
+			if writeErr = c.writeChunk(entry, writer, replicas, piece); writeErr == nil {
+				size += len(piece)
+			}
+		}
+	}
+
+	if !ended {
+		// the client went away before the end of the file
+		c.dropChunks(entry)
+		return
+	}
+	if writeErr == nil {
+		writeErr = c.updateFileEntry(entry, mu.Lease.ID)
+	}
+	var rmsg struct {
+		Result string
+		Err    string
+	}
+	if writeErr != nil {
+		c.dropChunks(entry)
+		rmsg.Err = writeErr.Error()
+	} else {
+		rmsg.Result = fmt.Sprintf("%s written, %d bytes in %d chunks", entry.GetName(), size, len(entry.Read()))
 	}
+	err = s.encoder.Encode(rmsg)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
 
-	c.updateFileEntry(entry)
+// writeChunk stores one copy of data per replica, or the shards of data for
+// erasure coded files, and adds the chunk to the end of entry.
+func (c *ChunkServer) writeChunk(entry FileEntry, writer int, replicas int, data []byte) error {
+	if file, ok := entry.(*File); ok && file.Erasure.Data > 0 {
+		return c.writeStripe(file, writer, data)
+	}
+	replicaNodes := c.placement.Place(PlacementRequest{Writer: writer, Count: replicas, Size: len(data)}, c.nodeInfos())
+	if len(replicaNodes) == 0 {
+		return fmt.Errorf("no running node available for chunk %d of %s", len(entry.Read()), entry.GetName())
+	}
+	dataChannel := make(chan []byte, 1)
+	var chunkCopies []Copy
+	checksum := chunkChecksum(data)
+	for _, replicaID := range replicaNodes {
+		dataChannel <- data
+		chunkCopy := c.hanleDataWrite(replicaID, dataChannel, checksum)
+		if !chunkCopy.Valid {
+			// the replication manager makes up for the missing copy
+			log.Printf("unable to store chunk %d of %s on node %d\n", len(entry.Read()), entry.GetName(), replicaID)
+			continue
+		}
+		chunkCopies = append(chunkCopies, chunkCopy)
+	}
+	if len(chunkCopies) == 0 {
+		return fmt.Errorf("unable to store chunk %d of %s on any node", len(entry.Read()), entry.GetName())
+	}
+	entry.Write(len(entry.Read()), chunkCopies)
+	return nil
 }
 
-func (c *ChunkServer) updateFileEntry(entry FileEntry) {
-	var cmd = &Message{Command: "updateFileEntry", Args: []string{entry.GetName()}}
-	conn, err := net.Dial("tcp", ":"+os.Getenv("META_SERVER_PORT"))
-	defer conn.Close()
+// updateFileEntry hands the chunks of a written file to the metadata server
+// and waits until it has logged them, so the file can be read right after.
+// The metadata server rejects them unless leaseID is the current lease on
+// the file.
+func (c *ChunkServer) updateFileEntry(entry FileEntry, leaseID uint64) error {
+	var cmd = &Message{Command: "updateFileEntry", Args: []string{entry.GetName(), strconv.FormatUint(leaseID, 10)}}
+	conn, err := net.Dial("tcp", c.metaAddr)
 	if err != nil {
 		log.Println(err.Error())
+		return err
 	}
-	enc := gob.NewEncoder(conn)
-	err = enc.Encode(cmd)
+	defer conn.Close()
+	s := newSession(conn)
+	err = s.encoder.Encode(cmd)
 	if err != nil {
 		log.Println(err.Error())
+		return err
 	}
 	var msg struct {
 		Entry *File
 	}
-
 	msg.Entry, _ = entry.(*File)
-	gob.Register(msg.Entry.Chunks[0])
-	err = enc.Encode(msg)
+	err = s.encoder.Encode(msg)
 	if err != nil {
 		log.Println(err.Error())
+		return err
 	}
+	var rmsg struct {
+		Err string
+	}
+	if err = s.decoder.Decode(&rmsg); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	if len(rmsg.Err) > 0 {
+		return errors.New(rmsg.Err)
+	}
+	return nil
 }
 
-func (c *ChunkServer) handleKillConnection(nodeID int) {
+func (c *ChunkServer) handleKillConnection(s *session, nodeID int) {
 	var rmsg struct {
 		Result string
 		Err    string
 	}
-	node := c.nodes[nodeID]
-	node.Kill()
-	rmsg.Result = fmt.Sprintf("node with id %d successfully killed", nodeID)
-	_ = c.encoder.Encode(rmsg)
+	if node := c.node(nodeID); node == nil {
+		rmsg.Err = fmt.Sprintf("no node with id %d", nodeID)
+	} else {
+		node.Kill()
+		rmsg.Result = fmt.Sprintf("node with id %d successfully killed", nodeID)
+	}
+	_ = s.encoder.Encode(rmsg)
 }
 
-func (c *ChunkServer) hanleDataWrite(nodeID int, dataChannel <-chan []byte) Copy {
-	node := c.nodes[nodeID]
-	addr, size := node.Write(dataChannel)
-	return Copy{Node: nodeID, Addr: addr, Valid: true, Size: size}
+// handleReplicateConnection copies the chunk at a source node address to a
+// target node and replies with the new copy.
+func (c *ChunkServer) handleReplicateConnection(s *session, args []string) {
+	var rmsg struct {
+		Result Copy
+		Err    string
+	}
+	source, _ := strconv.Atoi(args[0])
+	addr, _ := strconv.Atoi(args[1])
+	target, _ := strconv.Atoi(args[2])
+	// an empty checksum stands for a chunk that has none
+	checksum, err := strconv.ParseUint(args[3], 10, 32)
+	checked := err == nil
+	sourceNode, targetNode := c.node(source), c.node(target)
+	if sourceNode == nil || targetNode == nil {
+		rmsg.Err = "invalid node id for replication"
+	} else if !sourceNode.IsRunning() || !targetNode.IsRunning() {
+		rmsg.Err = "replication node is not running"
+	} else {
+		c.countOp(source)
+		data, readErr := c.readCopy(source, addr)
+		if readErr != nil {
+			rmsg.Err = fmt.Sprintf("unable to read chunk at address %d on node %d: %v", addr, source, readErr)
+		} else if !verifyChunk(data, uint32(checksum), checked) {
+			// never spread a corrupt copy
+			rmsg.Err = fmt.Sprintf("checksum mismatch for chunk at address %d on node %d", addr, source)
+		} else {
+			if !checked {
+				// the new copy is at least checked from now on
+				checksum = uint64(chunkChecksum(data))
+			}
+			dataChannel := make(chan []byte, 1)
+			dataChannel <- data
+			rmsg.Result = c.hanleDataWrite(target, dataChannel, uint32(checksum))
+			if !rmsg.Result.Valid {
+				rmsg.Err = fmt.Sprintf("unable to write chunk copy to node %d", target)
+			}
+		}
+	}
+	err = s.encoder.Encode(rmsg)
+	if err != nil {
+		log.Println(err.Error())
+	}
 }
 
-func (c *ChunkServer) computeReplica(nodeID int) (int, int) {
+func (c *ChunkServer) hanleDataWrite(nodeID int, dataChannel <-chan []byte, checksum uint32) Copy {
+	node := c.node(nodeID)
+	c.countOp(nodeID)
+	addr, size := node.Write(dataChannel, checksum)
+	return Copy{Node: nodeID, Addr: addr, Valid: addr >= 0, Size: size, Checksum: checksum}
+}
 
-	offset1 := 1
-	offset2 := c.NODEPERRACK - 1
-	if (nodeID+offset1) >= len(c.nodes) && (nodeID-offset1) >= 0 {
-		offset1 = -offset1
+// callMetaServer sends msg to the metadata server and decodes its reply.
+func (c *ChunkServer) callMetaServer(msg *Message, reply interface{}) error {
+	conn, err := net.Dial("tcp", c.metaAddr)
+	if err != nil {
+		return err
 	}
-	if (nodeID+offset2) >= len(c.nodes) && (offset2-nodeID) >= 0 {
-		offset2 = offset2 - nodeID
+	defer conn.Close()
+	s := newSession(conn)
+	if err = s.encoder.Encode(msg); err != nil {
+		return err
 	}
-
-	return offset1, offset2
+	return s.decoder.Decode(reply)
 }
 
-func (c *ChunkServer) pickWriteNode() int {
-
-	rand.Seed(time.Now().UnixNano())
-	var availableNodes []int
-
-	for index, node := range c.nodes {
-		if node.IsRunning() {
-			availableNodes = append(availableNodes, index)
-		}
+// reportBadCopy tells the metadata server that a copy failed verification.
+func (c *ChunkServer) reportBadCopy(filename string, index int, chunkCopy Copy) {
+	var rmsg struct {
+		Err string
+	}
+	msg := &Message{Command: "badcopy", Args: []string{
+		filename, strconv.Itoa(index), strconv.Itoa(chunkCopy.Node), strconv.Itoa(chunkCopy.Addr)}}
+	if err := c.callMetaServer(msg, &rmsg); err != nil {
+		log.Println(err.Error())
+	} else if len(rmsg.Err) > 0 {
+		log.Println(rmsg.Err)
 	}
-	return availableNodes[rand.Intn(len(availableNodes)-1)]
+}
 
+// nodeInfos describes the nodes for the placement policy.
+func (c *ChunkServer) nodeInfos() []NodeInfo {
+	var nodes []NodeInfo
+	for id, node := range c.nodeList() {
+		nodes = append(nodes, NodeInfo{
+			ID:        id,
+			Rack:      c.rackOf(id),
+			Running:   !c.isDraining(id) && node.IsRunning(),
+			SpaceLeft: c.capacityOf(id) - node.GetSize(),
+		})
+	}
+	return nodes
 }
 
 func (n *Node) GetSize() int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
 	var size int
 	for _, chunk := range n.content {
-		size += chunk.Size()
+		if chunk != nil {
+			size += chunk.Size()
+		}
 	}
 	return size
 }
 
+// Load is a no-op since in-memory nodes have nothing to reload.
+func (n *Node) Load() error {
+	return nil
+}
+
 func (n *Node) Run() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
 	n.isKilled = false
 }
 
 func (n *Node) Read(offset int) string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if offset < 0 || offset >= len(n.content) || n.content[offset] == nil {
+		return ""
+	}
 	return string(n.content[offset].Read())
 }
 
 func (n *Node) Kill() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
 	n.isKilled = true
 }
 
 func (n *Node) Delete(addr int) (bool, error) {
 	var err error
 	n.mutex.Lock()
-	if len(n.content) > addr {
-		n.content[addr] = n.content[len(n.content)-1]
-		n.content = n.content[:len(n.content)-1]
+	if addr >= 0 && len(n.content) > addr && n.content[addr] != nil {
+		// leave an empty slot so the addresses of other chunks stay valid
+		n.content[addr] = nil
 		err = nil
 	} else {
 		err = fmt.Errorf("invalid chunk address at %d", addr)
@@ -435,14 +1043,39 @@ func (n *Node) Delete(addr int) (bool, error) {
 	return true, nil
 }
 
-func (n *Node) Write(dataChannel <-chan []byte) (int, int) {
+func (n *Node) Write(dataChannel <-chan []byte, checksum uint32) (int, int) {
 	data := <-dataChannel
-	var chunk ChunkFile
+	chunk := ChunkFile{checksum: checksum}
 	chunk.Write(data)
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
 	n.content = append(n.content, &chunk)
-	return len(n.content) - 1, cap(data)
+	return len(n.content) - 1, len(data)
+}
+
+func (n *Node) Checksums() map[int]uint32 {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	checksums := map[int]uint32{}
+	for addr, chunk := range n.content {
+		if chunk != nil {
+			checksums[addr] = chunk.Checksum()
+		}
+	}
+	return checksums
+}
+
+func (n *Node) Checksum(addr int) (uint32, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if addr < 0 || addr >= len(n.content) || n.content[addr] == nil {
+		return 0, false
+	}
+	return n.content[addr].Checksum(), true
 }
 
 func (n *Node) IsRunning() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
 	return !n.isKilled
 }
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// rootDir is the top of the namespace. Every path the metadata server
+// stores is absolute and cleaned, e.g. "/logs/today.txt".
+const rootDir = "/"
+
+// DirEntry is a single result of a directory listing.
+type DirEntry struct {
+	Name  string
+	IsDir bool
+	Size  int
+}
+
+// cleanPath turns a client supplied name into a namespace path, so that
+// "a//b/", "./a/b" and "/a/b" all name the same file.
+func cleanPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// isAncestor reports whether dir is a directory above name.
+func isAncestor(dir string, name string) bool {
+	if dir == rootDir {
+		return name != rootDir
+	}
+	return strings.HasPrefix(name, dir+"/")
+}
+
+// ancestors returns the directories above the cleaned path name, starting
+// with the root.
+func ancestors(name string) []string {
+	var dirs []string
+	for name != rootDir {
+		name = path.Dir(name)
+		dirs = append([]string{name}, dirs...)
+	}
+	return dirs
+}
+
+// The helpers below expect the caller to hold the metadata lock.
+
+func (m *MasterNode) isDir(name string) bool {
+	_, ok := m.dirs[name]
+	return ok
+}
+
+// checkCreate returns an error if name cannot be created because it, or a
+// file in place of one of its parent directories, already exists.
+func (m *MasterNode) checkCreate(name string) error {
+	if _, ok := m.files[name]; ok || m.isDir(name) {
+		return fmt.Errorf("%s already exists", name)
+	}
+	for _, dir := range ancestors(name) {
+		if _, ok := m.files[dir]; ok {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+	}
+	return nil
+}
+
+// makeDirs creates dir along with any missing parent directory.
+func (m *MasterNode) makeDirs(dir string) {
+	if m.isDir(dir) {
+		return
+	}
+	m.makeDirs(path.Dir(dir))
+	m.dirs[dir] = map[string]bool{}
+	m.dirs[path.Dir(dir)][path.Base(dir)] = true
+}
+
+// addFile stores entry under name and links it into its directory.
+func (m *MasterNode) addFile(name string, entry FileEntry) {
+	m.makeDirs(path.Dir(name))
+	entry.Rename(name)
+	m.files[name] = entry
+	m.dirs[path.Dir(name)][path.Base(name)] = true
+}
+
+// unlink removes name from the children of its directory.
+func (m *MasterNode) unlink(name string) {
+	delete(m.dirs[path.Dir(name)], path.Base(name))
+}
+
+// moveDir rekeys the directory oldDir and everything below it to newDir.
+func (m *MasterNode) moveDir(oldDir string, newDir string) {
+	children := m.dirs[oldDir]
+	delete(m.dirs, oldDir)
+	m.dirs[newDir] = children
+	for child := range children {
+		oldName, newName := path.Join(oldDir, child), path.Join(newDir, child)
+		if entry, ok := m.files[oldName]; ok {
+			delete(m.files, oldName)
+			entry.Rename(newName)
+			m.files[newName] = entry
+		} else {
+			m.moveDir(oldName, newName)
+		}
+	}
+}
+
+func (m *MasterNode) applyMkdir(dir string) {
+	m.makeDirs(dir)
+}
+
+func (m *MasterNode) applyRmdir(dir string) {
+	if dir == rootDir || !m.isDir(dir) || len(m.dirs[dir]) > 0 {
+		return
+	}
+	delete(m.dirs, dir)
+	m.unlink(dir)
+}
+
+// Mkdir creates a directory and any missing parent directory.
+func (m *MasterNode) Mkdir(dir string) error {
+	dir = cleanPath(dir)
+	m.namespace.Lock(dir)
+	defer m.namespace.Unlock(dir)
+	m.mutex.RLock()
+	err := m.checkCreate(dir)
+	m.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	return m.commit(&logRecord{Op: "mkdir", Args: []string{dir}})
+}
+
+// Rmdir removes an empty directory.
+func (m *MasterNode) Rmdir(dir string) error {
+	dir = cleanPath(dir)
+	if dir == rootDir {
+		return fmt.Errorf("cannot remove the root directory")
+	}
+	m.namespace.Lock(dir)
+	defer m.namespace.Unlock(dir)
+	m.mutex.RLock()
+	children, ok := m.dirs[dir]
+	_, isFile := m.files[dir]
+	m.mutex.RUnlock()
+	if isFile {
+		return fmt.Errorf("%s is not a directory", dir)
+	} else if !ok {
+		return fmt.Errorf("%s does not exist", dir)
+	} else if len(children) > 0 {
+		return fmt.Errorf("%s is not empty", dir)
+	}
+	return m.commit(&logRecord{Op: "rmdir", Args: []string{dir}})
+}
+
+// ListDir returns the entries of a directory sorted by name. Listing a file
+// returns the file itself.
+func (m *MasterNode) ListDir(dir string) ([]DirEntry, error) {
+	dir = cleanPath(dir)
+	m.namespace.RLock(dir)
+	defer m.namespace.RUnlock(dir)
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if entry, ok := m.files[dir]; ok {
+		return []DirEntry{{Name: path.Base(dir), Size: entry.GetSize()}}, nil
+	}
+	children, ok := m.dirs[dir]
+	if !ok {
+		return nil, fmt.Errorf("%s does not exist", dir)
+	}
+	var entries []DirEntry
+	for child := range children {
+		name := path.Join(dir, child)
+		if entry, ok := m.files[name]; ok {
+			entries = append(entries, DirEntry{Name: child, Size: entry.GetSize()})
+		} else {
+			entries = append(entries, DirEntry{Name: child, IsDir: true})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, nil
+}
+
+func formatDirEntries(entries []DirEntry) string {
+	var listing string
+	for _, entry := range entries {
+		if entry.IsDir {
+			listing += fmt.Sprintf("%s/  ", entry.Name)
+		} else {
+			listing += fmt.Sprintf("%s  ", entry.Name)
+		}
+	}
+	return listing
+}
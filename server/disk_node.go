@@ -0,0 +1,202 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	chunkFileExt    = ".chunk"
+	checksumFileExt = ".crc"
+	// holds the address of the next chunk, so that addresses are never
+	// handed out twice, also not once the chunks that had them are deleted
+	nextAddrFile = "next"
+)
+
+// DiskNode is a DataNode that keeps every chunk as a file under
+// <dir>/<node id>/<addr>.chunk, so chunk addresses stay valid across restarts.
+// The checksum of a chunk is kept next to it in <addr>.crc, and the address
+// the next chunk gets in <dir>/<node id>/next.
+type DiskNode struct {
+	id        int
+	dir       string
+	next      int
+	isKilled  bool
+	chunks    map[int]int
+	checksums map[int]uint32
+	mutex     sync.Mutex
+}
+
+func NewDiskNode(id int, root string) *DiskNode {
+	return &DiskNode{
+		id:        id,
+		dir:       filepath.Join(root, strconv.Itoa(id)),
+		chunks:    map[int]int{},
+		checksums: map[int]uint32{},
+	}
+}
+
+func (n *DiskNode) chunkPath(addr int) string {
+	return filepath.Join(n.dir, strconv.Itoa(addr)+chunkFileExt)
+}
+
+func (n *DiskNode) checksumPath(addr int) string {
+	return filepath.Join(n.dir, strconv.Itoa(addr)+checksumFileExt)
+}
+
+// replaceFile atomically replaces path with data.
+func replaceFile(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// Load rebuilds the chunk index from the files found in the node directory.
+func (n *DiskNode) Load() error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if err := os.MkdirAll(n.dir, 0755); err != nil {
+		return err
+	}
+	infos, err := ioutil.ReadDir(n.dir)
+	if err != nil {
+		return err
+	}
+	n.chunks = map[int]int{}
+	n.checksums = map[int]uint32{}
+	n.next = 0
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || strings.HasSuffix(name, checksumFileExt) || name == nextAddrFile {
+			continue
+		}
+		if !strings.HasSuffix(name, chunkFileExt) {
+			// leftover from an interrupted write
+			_ = os.Remove(filepath.Join(n.dir, name))
+			continue
+		}
+		addr, err := strconv.Atoi(strings.TrimSuffix(name, chunkFileExt))
+		if err != nil {
+			continue
+		}
+		n.chunks[addr] = int(info.Size())
+		// chunks written before checksums were kept have none
+		if data, err := ioutil.ReadFile(n.checksumPath(addr)); err == nil && len(data) == 4 {
+			n.checksums[addr] = binary.BigEndian.Uint32(data)
+		}
+		if addr >= n.next {
+			n.next = addr + 1
+		}
+	}
+	// the deleted chunks may have had higher addresses than those left
+	if data, err := ioutil.ReadFile(filepath.Join(n.dir, nextAddrFile)); err == nil {
+		if next, err := strconv.Atoi(string(data)); err == nil && next > n.next {
+			n.next = next
+		}
+	}
+	return nil
+}
+
+func (n *DiskNode) GetSize() int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	var size int
+	for _, chunkSize := range n.chunks {
+		size += chunkSize
+	}
+	return size
+}
+
+func (n *DiskNode) Run() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.isKilled = false
+}
+
+func (n *DiskNode) Kill() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.isKilled = true
+}
+
+func (n *DiskNode) IsRunning() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return !n.isKilled
+}
+
+func (n *DiskNode) Read(addr int) string {
+	data, err := ioutil.ReadFile(n.chunkPath(addr))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func (n *DiskNode) Write(dataChannel <-chan []byte, checksum uint32) (int, int) {
+	data := <-dataChannel
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	addr := n.next
+	if err := replaceFile(filepath.Join(n.dir, nextAddrFile), []byte(strconv.Itoa(addr+1))); err != nil {
+		return -1, 0
+	}
+	var encoded [4]byte
+	binary.BigEndian.PutUint32(encoded[:], checksum)
+	// the checksum goes first so that a chunk file never exists without it
+	if err := replaceFile(n.checksumPath(addr), encoded[:]); err != nil {
+		return -1, 0
+	}
+	if err := replaceFile(n.chunkPath(addr), data); err != nil {
+		_ = os.Remove(n.checksumPath(addr))
+		return -1, 0
+	}
+	n.next++
+	n.chunks[addr] = len(data)
+	n.checksums[addr] = checksum
+	return addr, len(data)
+}
+
+func (n *DiskNode) Checksums() map[int]uint32 {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	checksums := map[int]uint32{}
+	for addr := range n.chunks {
+		checksums[addr] = n.checksums[addr]
+	}
+	return checksums
+}
+
+func (n *DiskNode) Checksum(addr int) (uint32, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	checksum, ok := n.checksums[addr]
+	return checksum, ok
+}
+
+func (n *DiskNode) Delete(addr int) (bool, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if _, ok := n.chunks[addr]; !ok {
+		return false, fmt.Errorf("invalid chunk address at %d", addr)
+	}
+	if err := os.Remove(n.chunkPath(addr)); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	_ = os.Remove(n.checksumPath(addr))
+	delete(n.chunks, addr)
+	delete(n.checksums, addr)
+	return true, nil
+}
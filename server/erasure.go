@@ -0,0 +1,646 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Files can be erasure coded instead of replicated. With Reed-Solomon
+// RS(k,m) every chunk is split into k data shards and m parity shards are
+// computed from them; any k of the k+m shards bring the chunk back, so it
+// survives the loss of m nodes while taking (k+m)/k times its size on disk
+// instead of one full copy per replica. RS(6,3) stores 1.5 times the data
+// and survives three failures, where 3x replication stores 3 times the data
+// and survives two.
+// Every shard is a copy of the chunk with its own checksum, stored on its
+// own node, and the shards are spread over the racks so that no rack holds
+// more of them than necessary. Reads decode when shards are missing or fail
+// verification, and the replication manager rebuilds missing shards on other
+// nodes. The parity shards use a Cauchy matrix over GF(2^8), which makes
+// every k of the k+m rows of the encoding matrix invertible.
+
+// ErasureScheme is the Reed-Solomon coding of a file, the zero value stands
+// for replication.
+type ErasureScheme struct {
+	Data   int
+	Parity int
+}
+
+func (s ErasureScheme) String() string {
+	if s.Data == 0 {
+		return ""
+	}
+	return fmt.Sprintf("RS(%d,%d)", s.Data, s.Parity)
+}
+
+// Shards returns the number of shards every chunk is stored as.
+func (s ErasureScheme) Shards() int {
+	return s.Data + s.Parity
+}
+
+// Overhead returns the bytes stored per byte of data.
+func (s ErasureScheme) Overhead() float64 {
+	return float64(s.Shards()) / float64(s.Data)
+}
+
+// ParseErasureScheme reads a scheme written as "6,3" or "RS(6,3)". An empty
+// value stands for replication.
+func ParseErasureScheme(value string) (ErasureScheme, error) {
+	var scheme ErasureScheme
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return scheme, nil
+	}
+	trimmed := strings.TrimSuffix(strings.TrimPrefix(strings.ToUpper(value), "RS("), ")")
+	parts := strings.Split(trimmed, ",")
+	if len(parts) != 2 {
+		return scheme, fmt.Errorf("invalid erasure coding %q, expected data and parity shards like 6,3", value)
+	}
+	var err error
+	if scheme.Data, err = strconv.Atoi(strings.TrimSpace(parts[0])); err != nil {
+		return scheme, fmt.Errorf("invalid erasure coding %q: %v", value, err)
+	}
+	if scheme.Parity, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil {
+		return scheme, fmt.Errorf("invalid erasure coding %q: %v", value, err)
+	}
+	if scheme.Data < 1 || scheme.Parity < 1 || scheme.Shards() > 256 {
+		return scheme, fmt.Errorf("invalid erasure coding %q, expected at least one data and one parity shard and at most 256 shards", value)
+	}
+	return scheme, nil
+}
+
+// arithmetic in GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1
+var gfExp [512]byte
+var gfLog [256]byte
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// gfInv expects a to be non-zero.
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// invertMatrix inverts a square matrix by Gauss-Jordan elimination.
+func invertMatrix(matrix [][]byte) ([][]byte, error) {
+	size := len(matrix)
+	work := make([][]byte, size)
+	for i := range matrix {
+		work[i] = make([]byte, 2*size)
+		copy(work[i], matrix[i])
+		work[i][size+i] = 1
+	}
+	for col := 0; col < size; col++ {
+		pivot := -1
+		for row := col; row < size; row++ {
+			if work[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, fmt.Errorf("singular matrix")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		scale := gfInv(work[col][col])
+		for j := range work[col] {
+			work[col][j] = gfMul(work[col][j], scale)
+		}
+		for row := 0; row < size; row++ {
+			if row == col || work[row][col] == 0 {
+				continue
+			}
+			factor := work[row][col]
+			for j := range work[row] {
+				work[row][j] ^= gfMul(factor, work[col][j])
+			}
+		}
+	}
+	inverse := make([][]byte, size)
+	for i := range work {
+		inverse[i] = work[i][size:]
+	}
+	return inverse, nil
+}
+
+// reedSolomon encodes and decodes the shards of one scheme.
+type reedSolomon struct {
+	scheme ErasureScheme
+	// identity on top of a Cauchy matrix, one row per shard
+	matrix [][]byte
+}
+
+func newReedSolomon(scheme ErasureScheme) *reedSolomon {
+	rs := &reedSolomon{scheme: scheme}
+	for row := 0; row < scheme.Shards(); row++ {
+		values := make([]byte, scheme.Data)
+		if row < scheme.Data {
+			values[row] = 1
+		} else {
+			for col := range values {
+				values[col] = gfInv(byte(row) ^ byte(col))
+			}
+		}
+		rs.matrix = append(rs.matrix, values)
+	}
+	return rs
+}
+
+// encode splits data into equal data shards, the last one padded with
+// zeros, and appends the parity shards.
+func (rs *reedSolomon) encode(data []byte) [][]byte {
+	size := (len(data) + rs.scheme.Data - 1) / rs.scheme.Data
+	if size == 0 {
+		size = 1
+	}
+	shards := make([][]byte, rs.scheme.Shards())
+	for i := 0; i < rs.scheme.Data; i++ {
+		shards[i] = make([]byte, size)
+		if start := i * size; start < len(data) {
+			copy(shards[i], data[start:])
+		}
+	}
+	for i := rs.scheme.Data; i < len(shards); i++ {
+		shards[i] = rs.combine(rs.matrix[i], shards[:rs.scheme.Data], size)
+	}
+	return shards
+}
+
+// combine returns the sum of the shards weighted by coefficients.
+func (rs *reedSolomon) combine(coefficients []byte, shards [][]byte, size int) []byte {
+	out := make([]byte, size)
+	for i, shard := range shards {
+		coefficient := coefficients[i]
+		if coefficient == 0 {
+			continue
+		}
+		for b := range out {
+			out[b] ^= gfMul(coefficient, shard[b])
+		}
+	}
+	return out
+}
+
+// reconstruct fills in the missing shards, those that are nil, from any
+// scheme.Data of the others.
+func (rs *reedSolomon) reconstruct(shards [][]byte) error {
+	if len(shards) != rs.scheme.Shards() {
+		return fmt.Errorf("expected %d shards, got %d", rs.scheme.Shards(), len(shards))
+	}
+	var present []int
+	size := -1
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if size >= 0 && len(shard) != size {
+			return fmt.Errorf("shards differ in size")
+		}
+		size = len(shard)
+		present = append(present, i)
+	}
+	if len(present) < rs.scheme.Data {
+		return fmt.Errorf("%d of the %d shards needed are left", len(present), rs.scheme.Data)
+	}
+	if len(present) == len(shards) {
+		return nil
+	}
+	present = present[:rs.scheme.Data]
+	var rows [][]byte
+	var inputs [][]byte
+	for _, i := range present {
+		rows = append(rows, rs.matrix[i])
+		inputs = append(inputs, shards[i])
+	}
+	decode, err := invertMatrix(rows)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < rs.scheme.Data; i++ {
+		if shards[i] == nil {
+			shards[i] = rs.combine(decode[i], inputs, size)
+		}
+	}
+	for i := rs.scheme.Data; i < len(shards); i++ {
+		if shards[i] == nil {
+			shards[i] = rs.combine(rs.matrix[i], shards[:rs.scheme.Data], size)
+		}
+	}
+	return nil
+}
+
+// join returns the first length bytes of the data shards.
+func (rs *reedSolomon) join(shards [][]byte, length int) []byte {
+	data := make([]byte, 0, length)
+	for _, shard := range shards[:rs.scheme.Data] {
+		data = append(data, shard...)
+	}
+	if len(data) > length {
+		data = data[:length]
+	}
+	return data
+}
+
+// placeShards picks one node per shard, each time on the rack holding the
+// fewest shards of the chunk so far and there on the node with the most free
+// space. The writer's node comes first when it is eligible.
+func placeShards(req PlacementRequest, nodes []NodeInfo) []int {
+	p := newPlacement(req, nodes)
+	for !p.done() {
+		perRack := map[int]int{}
+		for _, nodeID := range p.chosen {
+			perRack[p.rackOf(nodeID)]++
+		}
+		candidates := p.candidates(nil)
+		if len(candidates) == 0 {
+			break
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			a, b := candidates[i], candidates[j]
+			if (a.ID == req.Writer) != (b.ID == req.Writer) {
+				return a.ID == req.Writer
+			}
+			if perRack[a.Rack] != perRack[b.Rack] {
+				return perRack[a.Rack] < perRack[b.Rack]
+			}
+			return a.SpaceLeft > b.SpaceLeft
+		})
+		p.add(candidates[0].ID)
+	}
+	return p.placed()
+}
+
+// erasureOf returns the coding of a chunk.
+func erasureOf(chunk ChunkEntry) ErasureScheme {
+	if metadata, ok := chunk.(*ChunkMetadata); ok {
+		return metadata.Erasure
+	}
+	return ErasureScheme{}
+}
+
+// writeStripe stores the shards of data on nodes of their own and adds the
+// chunk to the end of entry. Shards that cannot be stored are rebuilt later
+// by the replication manager, as long as enough of them were.
+func (c *ChunkServer) writeStripe(entry *File, writer int, data []byte) error {
+	scheme := entry.Erasure
+	index := len(entry.Chunks)
+	shards := newReedSolomon(scheme).encode(data)
+	nodes := placeShards(PlacementRequest{Writer: writer, Count: len(shards), Size: len(shards[0])}, c.nodeInfos())
+	if len(nodes) < scheme.Data {
+		return fmt.Errorf("%d nodes available for the %d shards of chunk %d of %s", len(nodes), len(shards), index, entry.GetName())
+	}
+	dataChannel := make(chan []byte, 1)
+	var chunkCopies []Copy
+	for shard, nodeID := range nodes {
+		dataChannel <- shards[shard]
+		chunkCopy := c.hanleDataWrite(nodeID, dataChannel, chunkChecksum(shards[shard]))
+		if !chunkCopy.Valid {
+			log.Printf("unable to store shard %d of chunk %d of %s on node %d\n", shard, index, entry.GetName(), nodeID)
+			continue
+		}
+		chunkCopy.Shard = shard
+		chunkCopies = append(chunkCopies, chunkCopy)
+	}
+	if len(chunkCopies) < scheme.Data {
+		c.dropChunks(&File{Chunks: []ChunkEntry{&ChunkMetadata{Copies: chunkCopies}}})
+		return fmt.Errorf("unable to store enough shards of chunk %d of %s", index, entry.GetName())
+	}
+	entry.Chunks = append(entry.Chunks, &ChunkMetadata{Index: index, Copies: chunkCopies, Checksum: chunkChecksum(data),
+		Checked: true, Erasure: scheme, Length: len(data)})
+	return nil
+}
+
+// readStripe reads enough shards of a chunk to decode it.
+func (c *ChunkServer) readStripe(filename string, index int, chunk *ChunkMetadata) ([]byte, error) {
+	rs := newReedSolomon(chunk.Erasure)
+	shards, err := c.readShards(filename, index, chunk, rs)
+	if err != nil {
+		return nil, err
+	}
+	data := rs.join(shards, chunk.Length)
+	if !verifyChunk(data, chunk.Checksum, chunk.Checked) {
+		return nil, fmt.Errorf("decoded chunk %d of %s fails verification", index, filename)
+	}
+	return data, nil
+}
+
+type shardRead struct {
+	copy Copy
+	data []byte
+	err  error
+}
+
+// readShards reads the shards of a chunk, data shards first, until it has
+// enough of them and returns all shards with the missing ones rebuilt.
+// Shards that fail verification are reported to the metadata server.
+func (c *ChunkServer) readShards(filename string, index int, chunk *ChunkMetadata, rs *reedSolomon) ([][]byte, error) {
+	var copies []Copy
+	for _, copy := range chunk.Copies {
+		// stale copies missed mutations of the chunk
+		if node := c.node(copy.Node); copy.Valid && copy.Version >= chunk.Version && copy.Shard < chunk.Erasure.Shards() &&
+			node != nil && node.IsRunning() {
+			copies = append(copies, copy)
+		}
+	}
+	sort.SliceStable(copies, func(i, j int) bool { return copies[i].Shard < copies[j].Shard })
+
+	shards := make([][]byte, chunk.Erasure.Shards())
+	var found, next int
+	for found < chunk.Erasure.Data && next < len(copies) {
+		// read as many shards at once as are still missing
+		var batch []Copy
+		pending := map[int]bool{}
+		for ; next < len(copies) && len(batch) < chunk.Erasure.Data-found; next++ {
+			if shard := copies[next].Shard; shards[shard] == nil && !pending[shard] {
+				pending[shard] = true
+				batch = append(batch, copies[next])
+			}
+		}
+		reads := make(chan shardRead, len(batch))
+		for _, copy := range batch {
+			go func(copy Copy) {
+				c.countOp(copy.Node)
+				data, err := c.readCopy(copy.Node, copy.Addr)
+				reads <- shardRead{copy: copy, data: data, err: err}
+			}(copy)
+		}
+		for range batch {
+			read := <-reads
+			if read.err != nil {
+				log.Printf("unable to read shard %d of chunk %d of %s from node %d: %v\n", read.copy.Shard, index, filename, read.copy.Node, read.err)
+				continue
+			} else if !verifyChunk(read.data, read.copy.Checksum, true) {
+				log.Printf("checksum mismatch for shard %d of chunk %d of %s on node %d\n", read.copy.Shard, index, filename, read.copy.Node)
+				c.reportBadCopy(filename, index, read.copy)
+				continue
+			}
+			shards[read.copy.Shard] = read.data
+			found++
+		}
+	}
+	if found < chunk.Erasure.Data {
+		return nil, fmt.Errorf("%d of the %d shards needed for chunk %d of %s are readable", found, chunk.Erasure.Data, index, filename)
+	}
+	if err := rs.reconstruct(shards); err != nil {
+		return nil, err
+	}
+	return shards, nil
+}
+
+// handleReconstructConnection rebuilds shards of an erasure coded chunk from
+// the ones left and stores them on other nodes. The arguments are the file
+// name and the chunk index followed by pairs of shard and target node, and
+// the chunk comes after the message.
+func (c *ChunkServer) handleReconstructConnection(s *session, args []string) {
+	var rmsg struct {
+		Result []Copy
+		Err    string
+	}
+	var msg struct {
+		Chunk *ChunkMetadata
+	}
+	if err := s.decoder.Decode(&msg); err != nil {
+		log.Println(err.Error())
+		return
+	}
+	index, _ := strconv.Atoi(args[1])
+	var shards [][]byte
+	var err error
+	if msg.Chunk == nil || msg.Chunk.Erasure.Data == 0 {
+		err = fmt.Errorf("chunk %d of %s is not erasure coded", index, args[0])
+	} else {
+		shards, err = c.readShards(args[0], index, msg.Chunk, newReedSolomon(msg.Chunk.Erasure))
+	}
+	for i := 2; err == nil && i+1 < len(args); i += 2 {
+		shard, _ := strconv.Atoi(args[i])
+		target, _ := strconv.Atoi(args[i+1])
+		if shard < 0 || shard >= len(shards) {
+			err = fmt.Errorf("no shard %d in chunk %d of %s", shard, index, args[0])
+		} else if node := c.node(target); node == nil || !node.IsRunning() {
+			err = fmt.Errorf("node %d is not running", target)
+		} else {
+			dataChannel := make(chan []byte, 1)
+			dataChannel <- shards[shard]
+			chunkCopy := c.hanleDataWrite(target, dataChannel, chunkChecksum(shards[shard]))
+			if !chunkCopy.Valid {
+				err = fmt.Errorf("unable to write shard %d to node %d", shard, target)
+			} else {
+				chunkCopy.Shard = shard
+				rmsg.Result = append(rmsg.Result, chunkCopy)
+			}
+		}
+	}
+	if err != nil {
+		c.dropChunks(&File{Chunks: []ChunkEntry{&ChunkMetadata{Copies: rmsg.Result}}})
+		rmsg.Result = nil
+		rmsg.Err = err.Error()
+	}
+	if err = s.encoder.Encode(rmsg); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// checkErasure validates a scheme against the size of the cluster.
+func (m *MasterNode) checkErasure(scheme ErasureScheme) error {
+	if nodes := m.nodeCount(); scheme.Data < 1 || scheme.Parity < 1 || scheme.Shards() > nodes {
+		return fmt.Errorf("erasure coding needs at least one data and one parity shard and at most %d shards in total", nodes)
+	}
+	return nil
+}
+
+func (m *MasterNode) applyErasure(filename string, scheme ErasureScheme) {
+	if entry, ok := m.files[filename].(*File); ok {
+		entry.Erasure = scheme
+	}
+}
+
+// shardTask describes what an erasure coded chunk needs: the shards without
+// a valid copy outside the nodes being decommissioned, and the copies to
+// drop. It expects the caller to hold the metadata lock.
+func (m *MasterNode) shardTask(filename string, index int, chunk *ChunkMetadata) (replicationTask, bool) {
+	task := replicationTask{filename: filename, index: index, checksum: chunk.Checksum, checked: chunk.Checked,
+		holders: map[int]bool{}, stripe: chunk.clone().(*ChunkMetadata)}
+	held := map[int]bool{}
+	readable := map[int]bool{}
+	for _, chunkCopy := range chunk.Copies {
+		task.holders[chunkCopy.Node] = true
+		if m.downNodes[chunkCopy.Node] {
+			continue
+		}
+		if !chunkCopy.Valid || chunkCopy.Version < chunk.Version {
+			task.garbage = append(task.garbage, chunkCopy)
+			continue
+		}
+		readable[chunkCopy.Shard] = true
+		if _, draining := m.draining[chunkCopy.Node]; draining {
+			task.drained = append(task.drained, chunkCopy)
+		} else if held[chunkCopy.Shard] {
+			// a second copy of a shard, e.g. on a node that came back
+			task.garbage = append(task.garbage, chunkCopy)
+		} else {
+			held[chunkCopy.Shard] = true
+			task.valid = append(task.valid, chunkCopy)
+		}
+	}
+	for shard := 0; shard < chunk.Erasure.Shards(); shard++ {
+		if !held[shard] {
+			task.shards = append(task.shards, shard)
+		}
+	}
+	if len(task.shards) > 0 && len(readable) < chunk.Erasure.Data {
+		log.Printf("chunk %d of %s has %d of the %d shards it needs left\n", index, filename, len(readable), chunk.Erasure.Data)
+		return task, false
+	}
+	if len(task.valid) > 0 {
+		task.source = task.valid[0]
+	} else if len(task.drained) > 0 {
+		task.source = task.drained[0]
+	}
+	return task, len(task.shards) > 0 || len(task.garbage) > 0 || len(task.drained) > 0
+}
+
+// reconstructChunk has the chunk server rebuild the missing shards of a
+// chunk on nodes that hold none of its shards.
+func (m *MasterNode) reconstructChunk(task *replicationTask) error {
+	m.mutex.RLock()
+	var existing []int
+	for _, chunkCopy := range task.valid {
+		existing = append(existing, chunkCopy.Node)
+	}
+	req := PlacementRequest{Writer: -1, Existing: existing, Exclude: task.holders, Count: len(task.shards), Size: task.source.Size}
+	targets := placeShards(req, m.nodeInfos())
+	m.mutex.RUnlock()
+	if len(targets) == 0 {
+		return fmt.Errorf("no node available for a new shard")
+	}
+	args := []string{task.filename, strconv.Itoa(task.index)}
+	for i, target := range targets {
+		args = append(args, strconv.Itoa(task.shards[i]), strconv.Itoa(target))
+	}
+
+	conn, err := net.Dial("tcp", m.chunkAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	s := newSession(conn)
+	if err = s.encoder.Encode(&Message{Command: "reconstruct", Args: args}); err != nil {
+		return err
+	}
+	if err = s.encoder.Encode(struct{ Chunk *ChunkMetadata }{task.stripe}); err != nil {
+		return err
+	}
+	var rmsg struct {
+		Result []Copy
+		Err    string
+	}
+	if err = s.decoder.Decode(&rmsg); err != nil {
+		return err
+	}
+	if len(rmsg.Err) > 0 {
+		return errors.New(rmsg.Err)
+	}
+
+	m.namespace.Lock(task.filename)
+	if !m.hasCopy(task.filename, task.index, task.source) {
+		m.namespace.Unlock(task.filename)
+		// the file was rewritten or removed while the shards were rebuilt
+		for _, shard := range rmsg.Result {
+			m.deleteChunkCopy(shard)
+		}
+		return fmt.Errorf("chunk changed during reconstruction")
+	}
+	for _, shard := range rmsg.Result {
+		err = m.commit(&logRecord{Op: "shard", Args: []string{
+			task.filename, strconv.Itoa(task.index), strconv.Itoa(task.source.Node), strconv.Itoa(task.source.Addr),
+			strconv.Itoa(shard.Node), strconv.Itoa(shard.Addr), strconv.Itoa(shard.Size), strconv.Itoa(shard.Shard),
+			strconv.FormatUint(uint64(shard.Checksum), 10)}})
+		if err != nil {
+			m.namespace.Unlock(task.filename)
+			return err
+		}
+		log.Printf("reconstructed shard %d of chunk %d of %s on node %d\n", shard.Shard, task.index, task.filename, shard.Node)
+	}
+	m.namespace.Unlock(task.filename)
+	if len(targets) < len(task.shards) {
+		return fmt.Errorf("%d of %d shards rebuilt, no node left for the others", len(targets), len(task.shards))
+	}
+	return nil
+}
+
+func (m *MasterNode) applyShard(args []string) {
+	var values []int
+	for _, arg := range args[1:8] {
+		value, _ := strconv.Atoi(arg)
+		values = append(values, value)
+	}
+	checksum, _ := strconv.ParseUint(args[8], 10, 32)
+	index, source := values[0], Copy{Node: values[1], Addr: values[2]}
+	shard := Copy{Node: values[3], Addr: values[4], Size: values[5], Shard: values[6], Checksum: uint32(checksum), Valid: true}
+	chunk := m.findChunk(args[0], index, source)
+	if chunk == nil {
+		return
+	}
+	shard.Version = chunk.Version
+	chunk.Copies = append(chunk.Copies, shard)
+	m.adjustSpace(shard.Node, -shard.Size)
+	m.updateDiskCap()
+}
+
+// SimulateErasure places chunks of chunkSize bytes as the shards of scheme
+// on a cluster of racks*nodesPerRack nodes, like SimulatePlacement does for
+// replicas, so that the two can be compared.
+func SimulateErasure(scheme ErasureScheme, racks, nodesPerRack, capacity, chunks, chunkSize int) PlacementReport {
+	nodes := simulatedNodes(racks, nodesPerRack, capacity)
+	report := PlacementReport{Policy: scheme.String(), Chunks: chunks, Tolerates: scheme.Parity}
+	shardSize := (chunkSize + scheme.Data - 1) / scheme.Data
+	for i := 0; i < chunks; i++ {
+		writer := simulatedWriter(nodes)
+		placed := placeShards(PlacementRequest{Writer: writer, Count: scheme.Shards(), Size: shardSize}, nodes)
+		if len(placed) < scheme.Shards() {
+			report.UnderReplicated++
+		}
+		perRack := map[int]int{}
+		for idx, nodeID := range placed {
+			report.record(nodes, writer, idx, nodeID, shardSize)
+			perRack[nodes[nodeID].Rack]++
+		}
+		// losing the rack with the most shards leaves enough to decode
+		rackSafe := len(placed) > 0
+		for _, count := range perRack {
+			if len(placed)-count < scheme.Data {
+				rackSafe = false
+			}
+		}
+		if rackSafe {
+			report.RackSafe++
+		}
+	}
+	report.Logical = chunks * chunkSize
+	report.summarise(nodes, capacity)
+	return report
+}
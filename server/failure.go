@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Node failures are injected on purpose to watch the cluster recover. A
+// node can be stopped by id, a whole rack at once, or a number of nodes
+// picked at random. Random picks come from a source seeded with the seed
+// config value, or with the seed given to the command, so a run can be
+// repeated with the same failures.
+
+// StopNode stops a single node.
+func (m *MasterNode) StopNode(nodeID int) error {
+	m.mutex.RLock()
+	var err error
+	if nodeID < 0 || nodeID >= m.ROW {
+		err = fmt.Errorf("no node with id %d", nodeID)
+	} else if m.downNodes[nodeID] {
+		err = fmt.Errorf("node %d is already stopped", nodeID)
+	}
+	m.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	return m.stopNodes([]int{nodeID})
+}
+
+// StopRandomNodes stops count running nodes picked at random. A seed other
+// than 0 picks the nodes with a source of its own instead of the server one.
+func (m *MasterNode) StopRandomNodes(count int, seed int64) ([]int, error) {
+	m.mutex.RLock()
+	running := m.runningNodes()
+	m.mutex.RUnlock()
+	if len(running) == 0 {
+		return nil, fmt.Errorf("no running node left to stop")
+	} else if count < 1 || count > len(running) {
+		return nil, fmt.Errorf("can stop between 1 and %d running nodes", len(running))
+	}
+	if seed != 0 {
+		rand.New(rand.NewSource(seed)).Shuffle(len(running), func(i, j int) {
+			running[i], running[j] = running[j], running[i]
+		})
+	} else {
+		m.randomMutex.Lock()
+		m.random.Shuffle(len(running), func(i, j int) {
+			running[i], running[j] = running[j], running[i]
+		})
+		m.randomMutex.Unlock()
+	}
+	nodes := running[:count]
+	sort.Ints(nodes)
+	return nodes, m.stopNodes(nodes)
+}
+
+// StopRack stops every running node of a rack.
+func (m *MasterNode) StopRack(rack int) ([]int, error) {
+	m.mutex.RLock()
+	var exists bool
+	var nodes []int
+	for nodeID := 0; nodeID < m.ROW; nodeID++ {
+		if m.rackOf(nodeID) != rack {
+			continue
+		}
+		exists = true
+		if !m.downNodes[nodeID] {
+			nodes = append(nodes, nodeID)
+		}
+	}
+	m.mutex.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("no rack with id %d", rack)
+	} else if len(nodes) == 0 {
+		return nil, fmt.Errorf("rack %d has no running node", rack)
+	}
+	return nodes, m.stopNodes(nodes)
+}
+
+// runningNodes expects the caller to hold the metadata lock.
+func (m *MasterNode) runningNodes() []int {
+	var nodes []int
+	for nodeID := 0; nodeID < m.ROW; nodeID++ {
+		if !m.downNodes[nodeID] {
+			nodes = append(nodes, nodeID)
+		}
+	}
+	return nodes
+}
+
+// stoppedNodes expects the caller to hold the metadata lock.
+func (m *MasterNode) stoppedNodes() []int {
+	var nodes []int
+	for nodeID := 0; nodeID < m.ROW; nodeID++ {
+		if m.downNodes[nodeID] {
+			nodes = append(nodes, nodeID)
+		}
+	}
+	return nodes
+}
+
+func (m *MasterNode) stopNodes(nodes []int) error {
+	for _, nodeID := range nodes {
+		err := m.commit(&logRecord{Op: "stopnode", Args: []string{strconv.Itoa(nodeID)}})
+		if err != nil {
+			return err
+		}
+		log.Printf("stopped node %d\n", nodeID)
+	}
+	m.kickReplication()
+	return nil
+}
+
+// formatNodeIDs joins node ids for the reply to a stop command.
+func formatNodeIDs(nodes []int) string {
+	ids := make([]string, len(nodes))
+	for i, nodeID := range nodes {
+		ids[i] = strconv.Itoa(nodeID)
+	}
+	return strings.Join(ids, ",")
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Deleting a file only removes it from the namespace. Its chunk copies are
+// moved to the garbage list and reclaimed later by the garbage collector,
+// like the GFS master does, so a delete never waits on the chunk nodes and
+// copies on stopped nodes are dropped once the node can be reached again.
+
+// Delete removes a file from the namespace right away.
+func (m *MasterNode) Delete(filename string) error {
+	filename = cleanPath(filename)
+	m.namespace.Lock(filename)
+	defer m.namespace.Unlock(filename)
+	m.mutex.RLock()
+	_, ok := m.files[filename]
+	isDir := m.isDir(filename)
+	m.mutex.RUnlock()
+	if isDir {
+		return fmt.Errorf("%s is a directory", filename)
+	} else if !ok {
+		return fmt.Errorf("%s does not exist", filename)
+	}
+	return m.commit(&logRecord{Op: "delete", Args: []string{filename}})
+}
+
+func (m *MasterNode) applyDelete(filename string) {
+	entry, ok := m.files[filename]
+	if !ok {
+		return
+	}
+	for _, chunk := range entry.getChunks() {
+		m.garbage = append(m.garbage, chunk.Read()...)
+	}
+	delete(m.files, filename)
+	m.unlink(filename)
+}
+
+// applyReclaim drops a copy the chunk server deleted from the garbage list
+// and gives its space back to the node.
+func (m *MasterNode) applyReclaim(nodeID int, addr int) {
+	for i, chunkCopy := range m.garbage {
+		if chunkCopy.Node == nodeID && chunkCopy.Addr == addr {
+			m.garbage = append(m.garbage[:i], m.garbage[i+1:]...)
+			m.adjustSpace(nodeID, chunkCopy.Size)
+			m.updateDiskCap()
+			return
+		}
+	}
+}
+
+func (m *MasterNode) runGarbageCollection() {
+	ticker := time.NewTicker(m.gcInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.collectGarbage()
+	}
+}
+
+// collectGarbage asks the chunk server to delete every orphaned copy on a
+// running node.
+func (m *MasterNode) collectGarbage() {
+	m.mutex.RLock()
+	var copies []Copy
+	for _, chunkCopy := range m.garbage {
+		if !m.downNodes[chunkCopy.Node] {
+			copies = append(copies, chunkCopy)
+		}
+	}
+	m.mutex.RUnlock()
+
+	for _, chunkCopy := range copies {
+		var rmsg struct {
+			Err string
+		}
+		msg := &Message{Command: "deletechunk", Args: []string{strconv.Itoa(chunkCopy.Node), strconv.Itoa(chunkCopy.Addr)}}
+		if err := m.callChunkServer(msg, &rmsg); err != nil {
+			// the chunk server is unreachable, try again on the next pass
+			log.Println(err.Error())
+			return
+		}
+		if len(rmsg.Err) > 0 {
+			// the copy is already gone, e.g. after a failed write
+			log.Println(rmsg.Err)
+		}
+		err := m.commit(&logRecord{Op: "reclaim", Args: []string{strconv.Itoa(chunkCopy.Node), strconv.Itoa(chunkCopy.Addr)}})
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+	}
+	if len(copies) > 0 {
+		log.Printf("garbage collector reclaimed %d chunk copies\n", len(copies))
+	}
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Every running chunk node sends a heartbeat to the metadata server each
+// heartbeat interval with its free space, the number of chunks it holds and
+// its load, the chunk reads and writes it served since the last heartbeat.
+// The free space is all the metadata server knows of the space of a node;
+// only without heartbeats does it keep an estimate of its own from the
+// chunks it places and deletes, see adjustSpace. A node that misses
+// heartbeatMisses heartbeats in a row is marked as stopped, which invalidates
+// its copies so the replication manager restores them elsewhere. If its
+// heartbeats resume, e.g. after a network blip, the reply asks it to register
+// again, which reconciles its chunks like startnode does, see rejoin.go. A
+// node stopped with stopnode stays stopped until startnode. A node
+// running in a process of its own also sends its address and rack, and the
+// reply tells every chunk server where such nodes run, see chunk_node.go.
+
+// NodeHeartbeat is the last report of a chunk node.
+type NodeHeartbeat struct {
+	Node     int
+	Free     int
+	Chunks   int
+	Load     int
+	LastSeen time.Time
+	// set for nodes running in a process of their own
+	Addr string
+	Rack int
+}
+
+func (c *ChunkServer) runHeartbeats() {
+	for {
+		for nodeID, node := range c.nodeList() {
+			if _, remote := node.(*RemoteNode); !remote && node.IsRunning() {
+				c.sendHeartbeat(nodeID)
+			}
+		}
+		select {
+		case <-c.done:
+			return
+		case <-time.After(c.heartbeatInterval):
+		}
+	}
+}
+
+func (c *ChunkServer) sendHeartbeat(nodeID int) {
+	node := c.node(nodeID)
+	c.nodesMutex.RLock()
+	load := atomic.SwapInt64(&c.load[nodeID], 0)
+	c.nodesMutex.RUnlock()
+	msg := &Message{Command: "heartbeat", Args: []string{strconv.Itoa(nodeID),
+		strconv.Itoa(c.capacityOf(nodeID) - node.GetSize()), strconv.Itoa(len(node.Checksums())), strconv.FormatInt(load, 10)}}
+	if nodeID == c.self {
+		msg.Args = append(msg.Args, c.addr, strconv.Itoa(c.rackOf(nodeID)))
+	}
+	var rmsg struct {
+		Members map[int]NodeMember
+		Stopped []int
+		Rejoin  bool
+		Err     string
+	}
+	if err := c.callMetaServer(msg, &rmsg); err != nil {
+		log.Println(err.Error())
+	} else if len(rmsg.Err) > 0 {
+		log.Println(rmsg.Err)
+	} else {
+		c.attachMembers(rmsg.Members)
+		c.updateLiveness(rmsg.Stopped)
+	}
+	if rmsg.Rejoin {
+		// the node was taken as dead while it kept running
+		if result, err := c.registerNode(nodeID); err != nil {
+			log.Println(err.Error())
+		} else {
+			log.Printf("node %d rejoined, %s\n", nodeID, result)
+		}
+	}
+}
+
+// countOp adds a chunk read or write to the load of a node.
+func (c *ChunkServer) countOp(nodeID int) {
+	// the lock keeps the slice from growing under the update
+	c.nodesMutex.RLock()
+	defer c.nodesMutex.RUnlock()
+	if nodeID >= 0 && nodeID < len(c.load) {
+		atomic.AddInt64(&c.load[nodeID], 1)
+	}
+}
+
+// Heartbeat records the report of a chunk node and returns where the nodes
+// running in processes of their own are. Reports of stopped nodes are
+// ignored, a stopped node rejoins by registering its chunks, see
+// missedHeartbeats for the nodes asked to do so.
+func (m *MasterNode) Heartbeat(beat NodeHeartbeat) (map[int]NodeMember, error) {
+	m.mutex.Lock()
+	if beat.Node < 0 || beat.Node >= m.ROW {
+		m.mutex.Unlock()
+		return nil, fmt.Errorf("no node with id %d", beat.Node)
+	}
+	var joined bool
+	if len(beat.Addr) > 0 {
+		member := NodeMember{Addr: beat.Addr, Rack: beat.Rack}
+		// e.g. after a restart of the metadata server
+		joined = m.members[beat.Node] != member
+		m.members[beat.Node] = member
+	}
+	if !m.downNodes[beat.Node] {
+		beat.LastSeen = time.Now()
+		m.heartbeats[beat.Node] = beat
+		m.nodeMap[beat.Node] = beat.Free
+		m.updateDiskCap()
+	}
+	members := m.memberList()
+	m.mutex.Unlock()
+	if joined {
+		return members, m.attachNode(beat.Node, members[beat.Node])
+	}
+	return members, nil
+}
+
+// adjustSpace changes the free space of a node by delta as chunk copies are
+// placed on it or reclaimed from it. With heartbeats the node reports its free
+// space itself, which already counts those copies, so the estimate is left
+// alone. It expects the caller to hold the metadata lock.
+func (m *MasterNode) adjustSpace(nodeID int, delta int) {
+	if m.heartbeatInterval > 0 {
+		return
+	}
+	m.nodeMap[nodeID] += delta
+}
+
+// runFailureDetector stops the nodes that missed too many heartbeats.
+func (m *MasterNode) runFailureDetector() {
+	ticker := time.NewTicker(m.heartbeatInterval)
+	defer ticker.Stop()
+	// nodes get the full timeout for their first heartbeat
+	started := time.Now()
+	for range ticker.C {
+		timeout := time.Duration(m.heartbeatMisses) * m.heartbeatInterval
+		m.mutex.RLock()
+		var dead []int
+		for nodeID := 0; nodeID < m.ROW; nodeID++ {
+			lastSeen := m.heartbeats[nodeID].LastSeen
+			if lastSeen.Before(started) {
+				lastSeen = started
+			}
+			if !m.downNodes[nodeID] && time.Since(lastSeen) > timeout {
+				dead = append(dead, nodeID)
+			}
+		}
+		m.mutex.RUnlock()
+		for _, nodeID := range dead {
+			log.Printf("node %d missed %d heartbeats\n", nodeID, m.heartbeatMisses)
+		}
+		if len(dead) > 0 {
+			if err := m.stopNodes(dead); err != nil {
+				log.Println(err.Error())
+			}
+			m.mutex.Lock()
+			for _, nodeID := range dead {
+				if m.downNodes[nodeID] {
+					m.missedHeartbeats[nodeID] = true
+				}
+			}
+			m.mutex.Unlock()
+		}
+	}
+}
+
+// heartbeatStat describes the last report of a node and expects the caller
+// to hold the metadata lock.
+func (m *MasterNode) heartbeatStat(nodeID int) string {
+	if m.decommissioned[nodeID] {
+		return "decommissioned"
+	} else if m.downNodes[nodeID] {
+		return "stopped"
+	}
+	beat, ok := m.heartbeats[nodeID]
+	if !ok || beat.LastSeen.IsZero() {
+		return "no heartbeat yet"
+	}
+	return fmt.Sprintf("%d chunks, load %d, last heartbeat %v ago",
+		beat.Chunks, beat.Load, time.Since(beat.LastSeen).Round(time.Millisecond))
+}
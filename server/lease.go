@@ -0,0 +1,206 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Mutations go through a primary, like in GFS. The metadata server grants a
+// time-bounded lease on a file to one node holding its chunks, and every
+// write, append or record append of the file is ordered under that lease.
+// Mutations only ever replace a file or change its last chunk, so a lease on
+// the file covers every chunk a mutation can touch. The chunk server holding
+// the primary hands out serial numbers to the mutations of the file and
+// applies them one at a time in that order, storing the primary's copy of
+// each new chunk first and then the copies on the secondaries. Serial
+// numbers only order the mutations of one server, so a server refuses a
+// mutation under a lease whose primary it does not hold, e.g. because the
+// lease moved after the client looked it up, and forwards record appends to
+// the server that does. A mutation is only accepted by the metadata server
+// while the lease it ran under is still current, so once a lease expires or
+// is revoked because its primary was stopped, mutations still in flight
+// under it are rejected.
+
+// Lease makes Primary the node that orders the mutations of File until
+// Expires.
+type Lease struct {
+	ID      uint64
+	File    string
+	Primary int
+	Expires time.Time
+}
+
+// GrantLease returns the current lease on a file, extending it, or grants a
+// new one if there is none or it expired. A new lease raises the version of
+// the last chunk of the file, see version.go.
+func (m *MasterNode) GrantLease(filename string) (Lease, error) {
+	filename = cleanPath(filename)
+	m.namespace.Lock(filename)
+	defer m.namespace.Unlock(filename)
+	m.mutex.Lock()
+	entry, ok := m.files[filename]
+	if !ok {
+		m.mutex.Unlock()
+		return Lease{}, fmt.Errorf("%s does not exist", filename)
+	}
+	if lease, ok := m.leases[filename]; ok && time.Now().Before(lease.Expires) {
+		lease.Expires = time.Now().Add(m.leaseDuration)
+		m.mutex.Unlock()
+		return *lease, nil
+	}
+	primary := m.pickPrimary(entry)
+	hasChunks := len(entry.getChunks()) > 0
+	m.mutex.Unlock()
+	if primary < 0 && hasChunks {
+		// a new version would leave the copies on stopped nodes stale, the
+		// only ones there are
+		return Lease{}, fmt.Errorf("no running node holds a current copy of the last chunk of %s", filename)
+	} else if primary < 0 {
+		return Lease{}, fmt.Errorf("no running node available to hold the lease on %s", filename)
+	}
+	if hasChunks {
+		if err := m.commit(&logRecord{Op: "version", Args: []string{filename}}); err != nil {
+			return Lease{}, err
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.leaseSeq++
+	lease := &Lease{ID: m.leaseSeq, File: filename, Primary: primary, Expires: time.Now().Add(m.leaseDuration)}
+	m.leases[filename] = lease
+	log.Printf("granted lease %d on %s to node %d\n", lease.ID, filename, primary)
+	return *lease, nil
+}
+
+// pickPrimary returns a running node with a current copy of the last chunk
+// of entry, preferring nodes that are not being decommissioned, or -1 if
+// there is none. For a file without chunks it picks the running node with
+// the most space left. It expects the caller to hold the metadata lock.
+func (m *MasterNode) pickPrimary(entry FileEntry) int {
+	primary := -1
+	if chunks := entry.getChunks(); len(chunks) > 0 {
+		last := chunks[len(chunks)-1]
+		for _, chunkCopy := range last.Read() {
+			if !chunkCopy.Valid || m.downNodes[chunkCopy.Node] || chunkCopy.Version < last.GetVersion() {
+				continue
+			}
+			if m.isPlaceable(chunkCopy.Node) {
+				return chunkCopy.Node
+			} else if primary < 0 {
+				primary = chunkCopy.Node
+			}
+		}
+		return primary
+	}
+	for nodeID, spaceLeft := range m.nodeMap {
+		if m.isPlaceable(nodeID) && (primary < 0 || spaceLeft > m.nodeMap[primary]) {
+			primary = nodeID
+		}
+	}
+	return primary
+}
+
+// checkLease returns an error unless id is the current lease on filename. It
+// expects the caller to hold the metadata lock.
+func (m *MasterNode) checkLease(filename string, id uint64) error {
+	lease, ok := m.leases[filename]
+	if !ok || lease.ID != id || time.Now().After(lease.Expires) {
+		return fmt.Errorf("lease %d on %s is no longer valid", id, filename)
+	}
+	return nil
+}
+
+// revokeLeases drops the leases held by a stopped node, so the next mutation
+// of those files gets a new primary. It expects the caller to hold the
+// metadata lock.
+func (m *MasterNode) revokeLeases(nodeID int) {
+	for filename, lease := range m.leases {
+		if lease.Primary == nodeID {
+			delete(m.leases, filename)
+			log.Printf("revoked lease %d on %s from node %d\n", lease.ID, filename, nodeID)
+		}
+	}
+}
+
+// leaseArg parses the lease id sent along with a mutation, 0 if missing.
+func leaseArg(args []string, index int) uint64 {
+	if index >= len(args) {
+		return 0
+	}
+	id, _ := strconv.ParseUint(args[index], 10, 64)
+	return id
+}
+
+// mutationOrder is the serial order of the mutations of one file.
+type mutationOrder struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+	// serial number of the next mutation and of the mutation whose turn it is
+	next    uint64
+	applied uint64
+}
+
+// mutation is one write, append or record append running under a lease.
+type mutation struct {
+	filename string
+	order    *mutationOrder
+	Serial   uint64
+	Lease    Lease
+}
+
+// beginMutation gives the next mutation of a file its serial number, waits
+// until the mutations before it are done and then gets the lease on the file
+// from the metadata server. It fails when the primary is held by another
+// server, whose serial order this one cannot take part in. The mutation must
+// be ended with endMutation, also when beginMutation fails.
+func (c *ChunkServer) beginMutation(filename string) (*mutation, error) {
+	c.mutationMutex.Lock()
+	order, ok := c.mutations[filename]
+	if !ok {
+		order = &mutationOrder{}
+		order.cond = sync.NewCond(&order.mutex)
+		c.mutations[filename] = order
+	}
+	order.mutex.Lock()
+	mu := &mutation{filename: filename, order: order, Serial: order.next}
+	order.next++
+	c.mutationMutex.Unlock()
+	for order.applied != mu.Serial {
+		order.cond.Wait()
+	}
+	order.mutex.Unlock()
+
+	var rmsg struct {
+		Result Lease
+		Err    string
+	}
+	if err := c.callMetaServer(&Message{Command: "lease", Args: []string{filename}}, &rmsg); err != nil {
+		return mu, err
+	}
+	if len(rmsg.Err) > 0 {
+		return mu, errors.New(rmsg.Err)
+	}
+	mu.Lease = rmsg.Result
+	if c.localNode(mu.Lease.Primary) == nil {
+		return mu, fmt.Errorf("lease %d on %s is held by node %d, which is not served here", mu.Lease.ID, filename, mu.Lease.Primary)
+	}
+	return mu, nil
+}
+
+// endMutation lets the next mutation of the file go ahead.
+func (c *ChunkServer) endMutation(mu *mutation) {
+	c.mutationMutex.Lock()
+	defer c.mutationMutex.Unlock()
+	mu.order.mutex.Lock()
+	defer mu.order.mutex.Unlock()
+	mu.order.applied++
+	if mu.order.applied == mu.order.next {
+		delete(c.mutations, mu.filename)
+	}
+	mu.order.cond.Broadcast()
+}
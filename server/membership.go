@@ -0,0 +1,272 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Nodes can join and leave a running cluster. addnode adds a node with the
+// next free id to a rack, held by the chunk server of the metadata server
+// until a node process joins with that id. decommission drains a node: no
+// new chunks are placed on it, the replication manager copies every chunk
+// it holds to other nodes, and once no valid copy is left on it the node is
+// stopped for good. Node ids are never reused, so the copies and log records
+// that refer to a removed node stay unambiguous.
+
+// nodeCount returns the number of nodes ever added to the cluster.
+func (m *MasterNode) nodeCount() int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.ROW
+}
+
+// AddNode adds a node of the given capacity, or the default one when
+// capacity is 0, to a rack and returns its id.
+func (m *MasterNode) AddNode(rack int, capacity int) (int, error) {
+	if rack < 0 {
+		return -1, fmt.Errorf("invalid rack %d", rack)
+	}
+	if capacity < 0 {
+		return -1, fmt.Errorf("invalid capacity %d", capacity)
+	} else if capacity == 0 {
+		capacity = DEFAULT_ALLOCATED_DISKSPACE
+	}
+	m.membershipMutex.Lock()
+	defer m.membershipMutex.Unlock()
+	nodeID := m.nodeCount()
+	err := m.commit(&logRecord{Op: "addnode", Args: []string{strconv.Itoa(nodeID), strconv.Itoa(rack), strconv.Itoa(capacity)}})
+	if err != nil {
+		return -1, err
+	}
+	m.mutex.Lock()
+	// the node has until its first heartbeats before it counts as dead
+	m.heartbeats[nodeID] = NodeHeartbeat{Node: nodeID, Free: capacity, LastSeen: time.Now()}
+	m.mutex.Unlock()
+	err = m.notifyChunkServers(&Message{Command: "addnode", Args: []string{strconv.Itoa(nodeID), strconv.Itoa(rack), strconv.Itoa(capacity)}})
+	if err != nil {
+		return nodeID, err
+	}
+	log.Printf("added node %d to rack %d with capacity %d\n", nodeID, rack, capacity)
+	return nodeID, nil
+}
+
+func (m *MasterNode) applyAddNode(args []string) {
+	nodeID, _ := strconv.Atoi(args[0])
+	rack, _ := strconv.Atoi(args[1])
+	capacity, _ := strconv.Atoi(args[2])
+	if nodeID != m.ROW {
+		return
+	}
+	m.ROW++
+	m.nodeMap = append(m.nodeMap, capacity)
+	m.nodeRacks[nodeID] = rack
+	m.capacities[nodeID] = capacity
+	m.updateDiskCap()
+}
+
+// Decommission starts draining a node.
+func (m *MasterNode) Decommission(nodeID int) error {
+	m.membershipMutex.Lock()
+	defer m.membershipMutex.Unlock()
+	m.mutex.RLock()
+	var err error
+	if nodeID < 0 || nodeID >= m.ROW {
+		err = fmt.Errorf("no node with id %d", nodeID)
+	} else if m.decommissioned[nodeID] {
+		err = fmt.Errorf("node %d is already decommissioned", nodeID)
+	} else if _, ok := m.draining[nodeID]; ok {
+		err = fmt.Errorf("node %d is already being decommissioned", nodeID)
+	}
+	m.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	if err = m.commit(&logRecord{Op: "decommission", Args: []string{strconv.Itoa(nodeID)}}); err != nil {
+		return err
+	}
+	if err = m.notifyChunkServers(&Message{Command: "drainnode", Args: []string{strconv.Itoa(nodeID)}}); err != nil {
+		return err
+	}
+	log.Printf("decommissioning node %d\n", nodeID)
+	m.kickReplication()
+	return nil
+}
+
+func (m *MasterNode) applyDecommission(nodeID int) {
+	if nodeID < 0 || nodeID >= m.ROW {
+		return
+	}
+	m.draining[nodeID] = m.copiesOn(nodeID)
+	m.revokeLeases(nodeID)
+}
+
+// finishDecommissions stops the draining nodes that no longer hold a valid
+// copy of any chunk.
+func (m *MasterNode) finishDecommissions() {
+	m.membershipMutex.Lock()
+	defer m.membershipMutex.Unlock()
+	m.mutex.RLock()
+	var drained []int
+	for nodeID := range m.draining {
+		if m.copiesOn(nodeID) == 0 {
+			drained = append(drained, nodeID)
+		}
+	}
+	m.mutex.RUnlock()
+	for _, nodeID := range drained {
+		if err := m.commit(&logRecord{Op: "decommissioned", Args: []string{strconv.Itoa(nodeID)}}); err != nil {
+			log.Println(err.Error())
+			return
+		}
+		var rmsg struct {
+			Result string
+			Err    string
+		}
+		if err := m.callChunkServer(&Message{Command: "killnode", Args: []string{strconv.Itoa(nodeID)}}, &rmsg); err != nil {
+			log.Println(err.Error())
+		}
+		log.Printf("node %d decommissioned\n", nodeID)
+	}
+}
+
+func (m *MasterNode) applyDecommissioned(nodeID int) {
+	if nodeID < 0 || nodeID >= m.ROW {
+		return
+	}
+	delete(m.draining, nodeID)
+	m.decommissioned[nodeID] = true
+	m.applyStopNode(nodeID)
+	// the space of a removed node no longer counts
+	m.nodeMap[nodeID] = 0
+	m.updateDiskCap()
+}
+
+// copiesOn counts the valid chunk copies on a node and expects the caller
+// to hold the metadata lock.
+func (m *MasterNode) copiesOn(nodeID int) int {
+	var copies int
+	for _, entry := range m.files {
+		for _, chunk := range entry.getChunks() {
+			for _, chunkCopy := range chunk.Read() {
+				if chunkCopy.Node == nodeID && chunkCopy.Valid {
+					copies++
+				}
+			}
+		}
+	}
+	return copies
+}
+
+// drainStat describes the progress of a decommission for nodestat and
+// expects the caller to hold the metadata lock.
+func (m *MasterNode) drainStat(nodeID int) string {
+	total, ok := m.draining[nodeID]
+	if !ok {
+		return ""
+	}
+	left := m.copiesOn(nodeID)
+	moved := total - left
+	if moved < 0 {
+		moved = 0
+	}
+	return fmt.Sprintf(", decommissioning: %d of %d chunk copies moved, %d left", moved, total, left)
+}
+
+func copyIntMap(values map[int]int) map[int]int {
+	copied := map[int]int{}
+	for key, value := range values {
+		copied[key] = value
+	}
+	return copied
+}
+
+// isPlaceable reports whether new copies may go to a node and expects the
+// caller to hold the metadata lock.
+func (m *MasterNode) isPlaceable(nodeID int) bool {
+	_, draining := m.draining[nodeID]
+	return !m.downNodes[nodeID] && !draining
+}
+
+// notifyChunkServers sends msg to the chunk server and to every node
+// process. Node processes that cannot be reached learn about the change when
+// they join again.
+func (m *MasterNode) notifyChunkServers(msg *Message) error {
+	var rmsg struct {
+		Err string
+	}
+	if err := m.callChunkServer(msg, &rmsg); err != nil {
+		return err
+	}
+	if len(rmsg.Err) > 0 {
+		return errors.New(rmsg.Err)
+	}
+	m.mutex.RLock()
+	members := m.memberList()
+	m.mutex.RUnlock()
+	for nodeID, member := range members {
+		rmsg.Err = ""
+		if err := (&RemoteNode{id: nodeID, addr: member.Addr}).call(msg, &rmsg); err != nil {
+			log.Println(err.Error())
+		} else if len(rmsg.Err) > 0 {
+			log.Println(rmsg.Err)
+		}
+	}
+	return nil
+}
+
+// addNode adds a node to the chunk server. Nodes added while a node process
+// runs are held by the chunk server of the metadata server.
+func (c *ChunkServer) addNode(nodeID int, rack int, capacity int) error {
+	c.nodesMutex.Lock()
+	defer c.nodesMutex.Unlock()
+	if nodeID < len(c.nodes) {
+		// already known, e.g. from the configuration of a joining process
+		return nil
+	} else if nodeID > len(c.nodes) {
+		return fmt.Errorf("nodes before node %d are missing", nodeID)
+	}
+	var node DataNode = &Node{id: nodeID}
+	if c.self >= 0 {
+		node = &RemoteNode{id: nodeID, addr: c.chunkAddr}
+	} else if len(c.dataDir) > 0 {
+		node = NewDiskNode(nodeID, c.dataDir)
+		if err := node.Load(); err != nil {
+			return err
+		}
+	}
+	c.nodes = append(c.nodes, node)
+	c.load = append(c.load, 0)
+	c.racks[nodeID] = rack
+	c.capacities[nodeID] = capacity
+	c.scrubMutex.Lock()
+	c.scrubStats = append(c.scrubStats, ScrubStat{Node: nodeID})
+	c.scrubMutex.Unlock()
+	return nil
+}
+
+// drainNode keeps new chunks off a node being decommissioned.
+func (c *ChunkServer) drainNode(nodeID int) {
+	c.nodesMutex.Lock()
+	defer c.nodesMutex.Unlock()
+	c.draining[nodeID] = true
+}
+
+// capacityOf returns the disk space of a node.
+func (c *ChunkServer) capacityOf(nodeID int) int {
+	c.nodesMutex.RLock()
+	defer c.nodesMutex.RUnlock()
+	if capacity, ok := c.capacities[nodeID]; ok {
+		return capacity
+	}
+	return c.CAPACITY
+}
+
+// isDraining reports whether a node is being decommissioned.
+func (c *ChunkServer) isDraining(nodeID int) bool {
+	c.nodesMutex.RLock()
+	defer c.nodesMutex.RUnlock()
+	return c.draining[nodeID]
+}
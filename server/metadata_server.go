@@ -8,7 +8,10 @@ import (
 	"math/rand"
 	"net"
 	"os"
+	"path"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -28,6 +31,7 @@ type FileEntry interface {
 	Date() time.Time
 	getChunks() []ChunkEntry
 	DeleteChunks()
+	clone() FileEntry
 }
 
 type File struct {
@@ -35,16 +39,31 @@ type File struct {
 	Size        int
 	CreatedDate time.Time
 	Chunks      []ChunkEntry
+	// desired number of copies per chunk, 0 means the cluster default
+	Replicas int
+	// coding of new chunks, the zero value means replication, see erasure.go
+	Erasure ErasureScheme
 }
 
 type MetaServer interface {
 	Rename(string, string) error
 	FileSize(string) int
 	FileStat(string) (string, error)
-	ListFiles() string
+	ListDir(string) ([]DirEntry, error)
+	Mkdir(string) error
+	Rmdir(string) error
+	Delete(string) error
 	Read(string) (FileEntry, error)
-	Write(string) FileEntry
-	stopNode() int
+	Write(string, int) (FileEntry, error)
+	WriteErasureCoded(string, ErasureScheme) (FileEntry, error)
+	SetReplication(string, int) error
+	Checkpoint() error
+	StopNode(int) error
+	StopRandomNodes(int, int64) ([]int, error)
+	StopRack(int) ([]int, error)
+	AddNode(int, int) (int, error)
+	Decommission(int) error
+	Balance(int) (int, [2]float64, error)
 	GetDiskCap() int
 	sendMsg(*Message) error
 	UpdateDiskCap()
@@ -54,18 +73,67 @@ type MetaServer interface {
 	Run()
 }
 
+// disk space of every chunk node
+const DEFAULT_ALLOCATED_DISKSPACE = 4000
+
 type MasterNode struct {
 	socket     net.Listener
 	serverName string
 	diskCap    int
 	CHUNKSIZE  int
+	REPLICAS   int
 	ROW        int
 	COLUMN     int
 	nodeMap    []int
+	downNodes  map[int]bool
 	files      map[string]FileEntry
-	PORT       int
-	encoder    *gob.Encoder
-	decoder    *gob.Decoder
+	// children of every directory by directory path, see directory.go
+	dirs                map[string]map[string]bool
+	PORT                int
+	chunkAddr           string
+	chunkDir            string
+	placement           PlacementPolicy
+	oplog               *opLog
+	logMutex            sync.Mutex
+	namespace           *namespaceLocks
+	checkpointInterval  time.Duration
+	replicationInterval time.Duration
+	replicationKick     chan struct{}
+	gcInterval          time.Duration
+	// chunk server settings
+	scrubInterval   int
+	scrubRate       int
+	readConcurrency int
+	hedgeDelay      int
+	// copies of deleted chunks waiting for the garbage collector, see gc.go
+	garbage []Copy
+	// mutation leases by file, see lease.go
+	leases        map[string]*Lease
+	leaseSeq      uint64
+	leaseDuration time.Duration
+	// last report of every node and failure detection, see heartbeat.go
+	heartbeats        map[int]NodeHeartbeat
+	heartbeatInterval time.Duration
+	heartbeatMisses   int
+	// nodes stopped for missing heartbeats, asked to register when they resume
+	missedHeartbeats map[int]bool
+	// nodes running in processes of their own, see chunk_node.go
+	members map[int]NodeMember
+	// racks and capacities of nodes added at runtime, nodes being drained
+	// with the number of copies they held, and removed nodes, see
+	// membership.go
+	nodeRacks       map[int]int
+	capacities      map[int]int
+	draining        map[int]int
+	decommissioned  map[int]bool
+	membershipMutex sync.Mutex
+	// background balancer, see balancer.go
+	balancer balancer
+	// source of the random failures, see failure.go
+	random      *rand.Rand
+	randomMutex sync.Mutex
+	// mutex guards files, dirs, garbage, leases, heartbeats, members, nodeMap, diskCap and the file entries themselves
+	mutex sync.RWMutex
 }
 
 func (f *File) Rename(newFileName string) {
@@ -82,10 +150,15 @@ func (f *File) StopNode(nodeID int) {
 	}
 }
 
-func (f *File) Write(nodeID int, copies []Copy) {
+// Write adds the copies of the chunk at index to the end of the file.
+func (f *File) Write(index int, copies []Copy) {
 	var chunkEntry ChunkMetadata
-	chunkEntry.Index = nodeID
+	chunkEntry.Index = index
 	chunkEntry.Copies = copies
+	if len(copies) > 0 {
+		chunkEntry.Checksum = copies[0].Checksum
+		chunkEntry.Checked = true
+	}
 	f.Chunks = append(f.Chunks, &chunkEntry)
 }
 
@@ -109,11 +182,35 @@ func (f *File) getChunks() []ChunkEntry {
 	return f.Chunks
 }
 
+// clone returns a deep copy of the entry that can be handed to other
+// goroutines without holding the metadata lock.
+func (f *File) clone() FileEntry {
+	entry := *f
+	entry.Chunks = make([]ChunkEntry, 0, len(f.Chunks))
+	for _, chunk := range f.Chunks {
+		entry.Chunks = append(entry.Chunks, chunk.clone())
+	}
+	return &entry
+}
+
 func NewMasterServer(serverName string, serverConfig map[string]interface{}) *MasterNode {
-	const DEFAULT_ALLOCATED_DISKSPACE = 4000
 	var DefaultConfig = map[string]int{}
 	DefaultConfig["chunksize"] = 100
 	DefaultConfig["nodes"] = 4
+	DefaultConfig["replicas"] = 3
+	DefaultConfig["checkpointinterval"] = 60
+	DefaultConfig["replicationinterval"] = 5
+	DefaultConfig["gcinterval"] = 30
+	DefaultConfig["scrubinterval"] = 300
+	DefaultConfig["scrubrate"] = 1 << 20
+	DefaultConfig["readconcurrency"] = 4
+	DefaultConfig["hedgedelay"] = 50
+	DefaultConfig["leaseduration"] = 60
+	DefaultConfig["heartbeatinterval"] = 1000
+	DefaultConfig["heartbeatmisses"] = 3
+	DefaultConfig["balanceinterval"] = 600
+	DefaultConfig["balancethreshold"] = 10
+	DefaultConfig["balancebandwidth"] = 1 << 20
 	var newMasterNode = MasterNode{serverName: serverName, COLUMN: 4}
 
 	if val, ok := serverConfig["port"]; ok {
@@ -149,32 +246,229 @@ func NewMasterServer(serverName string, serverConfig map[string]interface{}) *Ma
 		newMasterNode.ROW = DefaultConfig["nodes"]
 	}
 
+	if val, ok := serverConfig["replicas"]; ok {
+		if replicas, ok := val.(int); ok {
+			newMasterNode.REPLICAS = replicas
+		} else {
+			log.Fatalln("invalid type for replicas value, expected an integer")
+		}
+	} else {
+		newMasterNode.REPLICAS = DefaultConfig["replicas"]
+	}
+	if newMasterNode.REPLICAS > newMasterNode.ROW {
+		newMasterNode.REPLICAS = newMasterNode.ROW
+	}
+
+	var policyName string
+	if val, ok := serverConfig["placement"]; ok {
+		if name, ok := val.(string); ok {
+			policyName = name
+		} else {
+			log.Fatalln("invalid type for placement value, expected a string")
+		}
+	}
+	var err error
+	newMasterNode.placement, err = NewPlacementPolicy(policyName)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	fmt.Printf("using %s placement policy\n", newMasterNode.placement.Name())
+
+	if val, ok := serverConfig["chunkdir"]; ok {
+		if chunkDir, ok := val.(string); ok {
+			newMasterNode.chunkDir = chunkDir
+		} else {
+			log.Fatalln("invalid type for chunkdir value, expected a string")
+		}
+	}
+
+	if val, ok := serverConfig["checkpointinterval"]; ok {
+		if interval, ok := val.(int); ok {
+			newMasterNode.checkpointInterval = time.Duration(interval) * time.Second
+		} else {
+			log.Fatalln("invalid type for checkpointinterval value, expected an integer")
+		}
+	} else {
+		newMasterNode.checkpointInterval = time.Duration(DefaultConfig["checkpointinterval"]) * time.Second
+	}
+
+	if val, ok := serverConfig["replicationinterval"]; ok {
+		if interval, ok := val.(int); ok {
+			newMasterNode.replicationInterval = time.Duration(interval) * time.Second
+		} else {
+			log.Fatalln("invalid type for replicationinterval value, expected an integer")
+		}
+	} else {
+		newMasterNode.replicationInterval = time.Duration(DefaultConfig["replicationinterval"]) * time.Second
+	}
+
+	if val, ok := serverConfig["gcinterval"]; ok {
+		if interval, ok := val.(int); ok {
+			newMasterNode.gcInterval = time.Duration(interval) * time.Second
+		} else {
+			log.Fatalln("invalid type for gcinterval value, expected an integer")
+		}
+	} else {
+		newMasterNode.gcInterval = time.Duration(DefaultConfig["gcinterval"]) * time.Second
+	}
+
+	if val, ok := serverConfig["readconcurrency"]; ok {
+		if concurrency, ok := val.(int); ok {
+			newMasterNode.readConcurrency = concurrency
+		} else {
+			log.Fatalln("invalid type for readconcurrency value, expected an integer")
+		}
+	} else {
+		newMasterNode.readConcurrency = DefaultConfig["readconcurrency"]
+	}
+
+	if val, ok := serverConfig["hedgedelay"]; ok {
+		if delay, ok := val.(int); ok {
+			newMasterNode.hedgeDelay = delay
+		} else {
+			log.Fatalln("invalid type for hedgedelay value, expected an integer")
+		}
+	} else {
+		newMasterNode.hedgeDelay = DefaultConfig["hedgedelay"]
+	}
+
+	if val, ok := serverConfig["scrubinterval"]; ok {
+		if interval, ok := val.(int); ok {
+			newMasterNode.scrubInterval = interval
+		} else {
+			log.Fatalln("invalid type for scrubinterval value, expected an integer")
+		}
+	} else {
+		newMasterNode.scrubInterval = DefaultConfig["scrubinterval"]
+	}
+
+	if val, ok := serverConfig["scrubrate"]; ok {
+		if rate, ok := val.(int); ok {
+			newMasterNode.scrubRate = rate
+		} else {
+			log.Fatalln("invalid type for scrubrate value, expected an integer")
+		}
+	} else {
+		newMasterNode.scrubRate = DefaultConfig["scrubrate"]
+	}
+
+	if val, ok := serverConfig["heartbeatinterval"]; ok {
+		if interval, ok := val.(int); ok {
+			newMasterNode.heartbeatInterval = time.Duration(interval) * time.Millisecond
+		} else {
+			log.Fatalln("invalid type for heartbeatinterval value, expected an integer")
+		}
+	} else {
+		newMasterNode.heartbeatInterval = time.Duration(DefaultConfig["heartbeatinterval"]) * time.Millisecond
+	}
+
+	if val, ok := serverConfig["heartbeatmisses"]; ok {
+		if misses, ok := val.(int); ok {
+			newMasterNode.heartbeatMisses = misses
+		} else {
+			log.Fatalln("invalid type for heartbeatmisses value, expected an integer")
+		}
+	} else {
+		newMasterNode.heartbeatMisses = DefaultConfig["heartbeatmisses"]
+	}
+
+	if val, ok := serverConfig["balanceinterval"]; ok {
+		if interval, ok := val.(int); ok {
+			newMasterNode.balancer.interval = time.Duration(interval) * time.Second
+		} else {
+			log.Fatalln("invalid type for balanceinterval value, expected an integer")
+		}
+	} else {
+		newMasterNode.balancer.interval = time.Duration(DefaultConfig["balanceinterval"]) * time.Second
+	}
+
+	if val, ok := serverConfig["balancethreshold"]; ok {
+		if threshold, ok := val.(int); ok {
+			newMasterNode.balancer.threshold = threshold
+		} else {
+			log.Fatalln("invalid type for balancethreshold value, expected an integer")
+		}
+	} else {
+		newMasterNode.balancer.threshold = DefaultConfig["balancethreshold"]
+	}
+
+	if val, ok := serverConfig["balancebandwidth"]; ok {
+		if bandwidth, ok := val.(int); ok {
+			newMasterNode.balancer.bandwidth = bandwidth
+		} else {
+			log.Fatalln("invalid type for balancebandwidth value, expected an integer")
+		}
+	} else {
+		newMasterNode.balancer.bandwidth = DefaultConfig["balancebandwidth"]
+	}
+
+	seed := time.Now().UnixNano()
+	if val, ok := serverConfig["seed"]; ok {
+		if value, ok := val.(int); ok {
+			seed = int64(value)
+		} else {
+			log.Fatalln("invalid type for seed value, expected an integer")
+		}
+	}
+	newMasterNode.random = rand.New(rand.NewSource(seed))
+
+	if val, ok := serverConfig["leaseduration"]; ok {
+		if duration, ok := val.(int); ok {
+			newMasterNode.leaseDuration = time.Duration(duration) * time.Second
+		} else {
+			log.Fatalln("invalid type for leaseduration value, expected an integer")
+		}
+	} else {
+		newMasterNode.leaseDuration = time.Duration(DefaultConfig["leaseduration"]) * time.Second
+	}
+
 	for i := 0; i < newMasterNode.ROW; i++ {
 		newMasterNode.nodeMap = append(newMasterNode.nodeMap, DEFAULT_ALLOCATED_DISKSPACE)
 	}
+	newMasterNode.chunkAddr = ":" + os.Getenv("CHUNK_SERVER_PORT")
 	newMasterNode.files = map[string]FileEntry{}
+	newMasterNode.dirs = map[string]map[string]bool{rootDir: {}}
+	newMasterNode.downNodes = map[int]bool{}
+	newMasterNode.leases = map[string]*Lease{}
+	newMasterNode.heartbeats = map[int]NodeHeartbeat{}
+	newMasterNode.missedHeartbeats = map[int]bool{}
+	newMasterNode.members = map[int]NodeMember{}
+	newMasterNode.nodeRacks = map[int]int{}
+	newMasterNode.capacities = map[int]int{}
+	newMasterNode.draining = map[int]int{}
+	newMasterNode.decommissioned = map[int]bool{}
+	// lease ids never repeat across restarts of the metadata server
+	newMasterNode.leaseSeq = uint64(time.Now().UnixNano())
+	newMasterNode.replicationKick = make(chan struct{}, 1)
+	newMasterNode.namespace = newNamespaceLocks()
+
+	if val, ok := serverConfig["metadir"]; ok {
+		metaDir, ok := val.(string)
+		if !ok {
+			log.Fatalln("invalid type for metadir value, expected a string")
+		}
+		if len(metaDir) > 0 {
+			newMasterNode.oplog, err = openOpLog(metaDir)
+			if err != nil {
+				log.Fatalf("unable to open operation log: %v\n", err.Error())
+			}
+			if err = newMasterNode.recover(); err != nil {
+				log.Fatalf("unable to recover metadata: %v\n", err.Error())
+			}
+		}
+	}
 	return &newMasterNode
 
 }
 
-func (m *MasterNode) ListFiles() string {
-	var fileString string
-	if len(m.files) == 0 {
-		return fileString
-	}
-	for _, entry := range m.files {
-		fileString += fmt.Sprintf("%s  ", entry.GetName())
-	}
-	return fileString
-}
 func (m *MasterNode) sendMsg(msg *Message) error {
-	conn, err := net.Dial("tcp", ":"+os.Getenv("CHUNK_SERVER_PORT"))
+	conn, err := net.Dial("tcp", m.chunkAddr)
 	defer conn.Close()
 	if err != nil {
 		return err
 	}
-	m.encoder = gob.NewEncoder(conn)
-	err = m.encoder.Encode(msg)
+	enc := gob.NewEncoder(conn)
+	err = enc.Encode(msg)
 	if err != nil {
 		return fmt.Errorf("Error: could not accept incomming request: %v", err.Error())
 	}
@@ -185,31 +479,64 @@ func (m *MasterNode) sendMsg(msg *Message) error {
 
 func (m *MasterNode) FileSize(filename string) int {
 	// return file entry size with the specified filename or return -1 if entry is non-existent
+	filename = cleanPath(filename)
+	m.namespace.RLock(filename)
+	defer m.namespace.RUnlock(filename)
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 	if entry, ok := m.files[filename]; ok {
 		return entry.GetSize()
 	}
 	return -1
 }
 
+// Rename moves a file, or a directory with everything below it. Moving onto
+// an existing directory moves the source into that directory.
 func (m *MasterNode) Rename(oldFileName string, newFileName string) error {
-
-	if entry, ok := m.files[oldFileName]; ok {
-		entry.Rename(newFileName)
-		m.files[newFileName] = entry
-		delete(m.files, oldFileName)
-		return nil
+	oldFileName, newFileName = cleanPath(oldFileName), cleanPath(newFileName)
+	if oldFileName == rootDir {
+		return fmt.Errorf("cannot move the root directory")
 	}
+	m.namespace.Lock(oldFileName, newFileName)
+	defer m.namespace.Unlock(oldFileName, newFileName)
 
-	return fmt.Errorf("%s does not exist", oldFileName)
-
+	m.mutex.RLock()
+	_, isFile := m.files[oldFileName]
+	exists := isFile || m.isDir(oldFileName)
+	if m.isDir(newFileName) {
+		newFileName = path.Join(newFileName, path.Base(oldFileName))
+	}
+	var err error
+	if !exists {
+		err = fmt.Errorf("%s does not exist", oldFileName)
+	} else if oldFileName == newFileName || isAncestor(oldFileName, newFileName) {
+		err = fmt.Errorf("cannot move %s into itself", oldFileName)
+	} else if !m.isDir(path.Dir(newFileName)) {
+		err = fmt.Errorf("directory %s does not exist", path.Dir(newFileName))
+	} else {
+		err = m.checkCreate(newFileName)
+	}
+	m.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	return m.commit(&logRecord{Op: "rename", Args: []string{oldFileName, newFileName}})
 }
 
 func (m *MasterNode) GetDiskCap() int {
-
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 	return m.diskCap
 }
 
 func (m *MasterNode) UpdateDiskCap() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.updateDiskCap()
+}
+
+// updateDiskCap expects the caller to hold the metadata lock.
+func (m *MasterNode) updateDiskCap() {
 	var totalDiskCap int
 	for _, spaceLeft := range m.nodeMap {
 		totalDiskCap += spaceLeft
@@ -218,12 +545,46 @@ func (m *MasterNode) UpdateDiskCap() {
 }
 
 func (m *MasterNode) FileStat(filename string) (string, error) {
+	filename = cleanPath(filename)
+	m.namespace.RLock(filename)
+	defer m.namespace.RUnlock(filename)
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 
-	if entry, ok := m.files[filename]; ok {
+	if children, ok := m.dirs[filename]; ok {
 		return fmt.Sprintf(
+			`directory:   %s
+             entries:     %d`, filename, len(children)), nil
+	}
+	if entry, ok := m.files[filename]; ok {
+		stat := fmt.Sprintf(
 			`file name:   %s
              created:     %v
-             size:        %d bytes`, entry.GetName(), entry.Date(), entry.GetSize()), nil
+             size:        %d bytes`, entry.GetName(), entry.Date(), entry.GetSize())
+		if coding := entry.(*File).Erasure; coding.Data > 0 {
+			stat += fmt.Sprintf(`
+             coding:      %s, %d data and %d parity shards per chunk`, coding, coding.Data, coding.Parity)
+		} else {
+			stat += fmt.Sprintf(`
+             replicas:    %d`, m.replicationOf(entry))
+		}
+		var stored int
+		for _, chunk := range entry.getChunks() {
+			for _, chunkCopy := range chunk.Read() {
+				if chunkCopy.Valid {
+					stored += chunkCopy.Size
+				}
+			}
+		}
+		if entry.GetSize() > 0 {
+			stat += fmt.Sprintf(`
+             stored:      %d bytes, %.2fx the file size`, stored, float64(stored)/float64(entry.GetSize()))
+		}
+		if lease, ok := m.leases[filename]; ok && time.Now().Before(lease.Expires) {
+			stat += fmt.Sprintf(`
+             lease:       node %d until %s`, lease.Primary, lease.Expires.Format(time.RFC3339))
+		}
+		return stat, nil
 	}
 	return "", fmt.Errorf("file does not exist")
 }
@@ -239,9 +600,11 @@ func (m *MasterNode) GetNodeStat(param interface{}) string {
 }
 
 func (m *MasterNode) nodeStatByID(nodeID int) string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 	var statString string
 	if nodeID > -1 && nodeID < m.ROW {
-		statString = fmt.Sprintf("node %d available space: %d", nodeID, m.nodeMap[nodeID])
+		statString = fmt.Sprintf("node %d %savailable space: %d, %s%s", nodeID, m.memberStat(nodeID), m.nodeMap[nodeID], m.heartbeatStat(nodeID), m.drainStat(nodeID))
 	} else {
 		statString = fmt.Sprintf("no Node with ID %d", nodeID)
 	}
@@ -249,40 +612,375 @@ func (m *MasterNode) nodeStatByID(nodeID int) string {
 }
 
 func (m *MasterNode) nodeStat() string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 
 	var statString string
-	statString = fmt.Sprintf("totaldiskspace: %d", m.diskCap)
+	statString = fmt.Sprintf("totaldiskspace: %d\n", m.diskCap)
 	for idx, spaceLeft := range m.nodeMap {
-		statString += fmt.Sprintf("node %d available space: %d\n", idx+1, spaceLeft)
+		statString += fmt.Sprintf("node %d %savailable space: %d, %s%s\n", idx, m.memberStat(idx), spaceLeft, m.heartbeatStat(idx), m.drainStat(idx))
 	}
 	return statString
 }
 
-func (m *MasterNode) stopNode() int {
-	rand.Seed(time.Now().UnixNano())
-	nodeID := rand.Intn(m.ROW - 1)
-	for _, entries := range m.files {
-		entries.StopNode(nodeID)
-	}
-	return nodeID
-}
-
 func (m *MasterNode) Read(fileName string) (FileEntry, error) {
+	fileName = cleanPath(fileName)
+	m.namespace.RLock(fileName)
+	defer m.namespace.RUnlock(fileName)
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 	if entry, ok := m.files[fileName]; ok {
-		return entry, nil
+		return entry.clone(), nil
 	}
 	return nil, fmt.Errorf("file does not exist")
 }
 
-func (m *MasterNode) Write(filename string) FileEntry {
+func (m *MasterNode) Write(filename string, replicas int) (FileEntry, error) {
 	// if file exists return file entry else create a new entry using filename
+	if nodes := m.nodeCount(); replicas < 0 || replicas > nodes {
+		return nil, fmt.Errorf("replication factor must be between 1 and %d, or 0 for the cluster default", nodes)
+	}
+	return m.write(filename, replicas, ErasureScheme{})
+}
+
+// WriteErasureCoded is Write for files whose chunks are stored as the shards
+// of scheme rather than as copies.
+func (m *MasterNode) WriteErasureCoded(filename string, scheme ErasureScheme) (FileEntry, error) {
+	if err := m.checkErasure(scheme); err != nil {
+		return nil, err
+	}
+	return m.write(filename, 0, scheme)
+}
+
+// write creates a file or, when it exists, switches it to the given coding.
+// A replication factor turns an erasure coded file back into a replicated
+// one.
+func (m *MasterNode) write(filename string, replicas int, scheme ErasureScheme) (FileEntry, error) {
+	filename = cleanPath(filename)
+	m.namespace.Lock(filename)
+	defer m.namespace.Unlock(filename)
+	m.mutex.RLock()
+	entry, ok := m.files[filename]
+	var err error
+	if m.isDir(filename) {
+		err = fmt.Errorf("%s is a directory", filename)
+	} else if !ok {
+		err = m.checkCreate(filename)
+	}
+	m.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		args := []string{filename, strconv.Itoa(replicas)}
+		if scheme.Data > 0 {
+			args = append(args, scheme.String())
+		}
+		err := m.commit(&logRecord{Op: "write", Args: args})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		coding := entry.(*File).Erasure
+		if (scheme.Data > 0 && coding != scheme) || (replicas > 0 && coding.Data > 0) {
+			// the chunks keep their coding until the file is rewritten
+			err := m.commit(&logRecord{Op: "erasure", Args: []string{filename, scheme.String()}})
+			if err != nil {
+				return nil, err
+			}
+		}
+		if replicas > 0 && entry.(*File).Replicas != replicas {
+			err := m.commit(&logRecord{Op: "setrep", Args: []string{filename, strconv.Itoa(replicas)}})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.files[filename].clone(), nil
+
+}
+
+// SetReplication changes the desired number of copies of a file. The
+// replication manager then adds or trims copies to match.
+func (m *MasterNode) SetReplication(filename string, replicas int) error {
+	if nodes := m.nodeCount(); replicas < 1 || replicas > nodes {
+		return fmt.Errorf("replication factor must be between 1 and %d", nodes)
+	}
+	filename = cleanPath(filename)
+	m.namespace.Lock(filename)
+	defer m.namespace.Unlock(filename)
+	m.mutex.RLock()
+	entry, ok := m.files[filename]
+	m.mutex.RUnlock()
+	if !ok {
+		return fmt.Errorf("%s does not exist", filename)
+	}
+	if coding := entry.(*File).Erasure; coding.Data > 0 {
+		return fmt.Errorf("%s is erasure coded with %s, rewrite it with a replication factor instead", filename, coding)
+	}
+	err := m.commit(&logRecord{Op: "setrep", Args: []string{filename, strconv.Itoa(replicas)}})
+	if err != nil {
+		return err
+	}
+	m.kickReplication()
+	return nil
+}
+
+// replicationOf returns the desired number of copies for entry and expects
+// the caller to hold the metadata lock.
+func (m *MasterNode) replicationOf(entry FileEntry) int {
+	if file, ok := entry.(*File); ok && file.Replicas > 0 {
+		return file.Replicas
+	}
+	return m.REPLICAS
+}
+
+// storedCopies returns the bytes stored per byte of a file with the given
+// replication factor, 0 for the cluster default, or erasure coding.
+func (m *MasterNode) storedCopies(replicas int, scheme ErasureScheme) float64 {
+	if scheme.Data > 0 {
+		return scheme.Overhead()
+	} else if replicas > 0 {
+		return float64(replicas)
+	}
+	return float64(m.REPLICAS)
+}
+
+// Checkpoint saves a snapshot of the metadata and clears the operation log.
+func (m *MasterNode) Checkpoint() error {
+	if m.oplog == nil {
+		return fmt.Errorf("metadata persistence is not enabled")
+	}
+	m.logMutex.Lock()
+	defer m.logMutex.Unlock()
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	cp := checkpoint{Files: map[string]*File{}, NodeMap: append([]int(nil), m.nodeMap...), DownNodes: map[int]bool{},
+		Nodes: m.ROW, NodeRacks: m.nodeRacks, Capacities: m.capacities, Draining: m.draining, Decommissioned: m.decommissioned}
+	for dir := range m.dirs {
+		cp.Dirs = append(cp.Dirs, dir)
+	}
+	cp.Garbage = append([]Copy(nil), m.garbage...)
+	for nodeID := range m.downNodes {
+		cp.DownNodes[nodeID] = true
+	}
+	for name, entry := range m.files {
+		cp.Files[name] = entry.(*File)
+	}
+	return m.oplog.SaveCheckpoint(&cp)
+}
+
+// commit appends rec to the operation log before applying it, so a mutation
+// never becomes visible to clients unless it is durable. Callers changing the
+// namespace hold the path locks involved; lock order is namespace locks, then
+// logMutex, then mutex.
+func (m *MasterNode) commit(rec *logRecord) error {
+	m.logMutex.Lock()
+	defer m.logMutex.Unlock()
+	if m.oplog != nil {
+		if err := m.oplog.Append(rec); err != nil {
+			return fmt.Errorf("unable to log %s operation: %v", rec.Op, err)
+		}
+	}
+	m.apply(rec)
+	return nil
+}
+
+func (m *MasterNode) apply(rec *logRecord) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	switch rec.Op {
+	case "stopnode", "startnode", "reclaim", "addnode", "decommission", "decommissioned":
+		// these carry node ids or addresses rather than paths
+	default:
+		// records written before directories existed hold relative paths
+		rec.Args[0] = cleanPath(rec.Args[0])
+		if rec.Op == "rename" {
+			rec.Args[1] = cleanPath(rec.Args[1])
+		}
+	}
+	switch rec.Op {
+	case "write":
+		var replicas int
+		var scheme ErasureScheme
+		if len(rec.Args) > 1 {
+			replicas, _ = strconv.Atoi(rec.Args[1])
+		}
+		if len(rec.Args) > 2 {
+			scheme, _ = ParseErasureScheme(rec.Args[2])
+		}
+		m.applyWrite(rec.Args[0], replicas, scheme)
+	case "erasure":
+		scheme, _ := ParseErasureScheme(rec.Args[1])
+		m.applyErasure(rec.Args[0], scheme)
+	case "setrep":
+		replicas, _ := strconv.Atoi(rec.Args[1])
+		m.applySetReplication(rec.Args[0], replicas)
+	case "rename":
+		m.applyRename(rec.Args[0], rec.Args[1])
+	case "mkdir":
+		m.applyMkdir(rec.Args[0])
+	case "rmdir":
+		m.applyRmdir(rec.Args[0])
+	case "delete":
+		m.applyDelete(rec.Args[0])
+	case "append":
+		from, _ := strconv.Atoi(rec.Args[1])
+		m.applyAppend(rec.Args[0], from, rec.Entry)
+	case "reclaim":
+		nodeID, _ := strconv.Atoi(rec.Args[0])
+		addr, _ := strconv.Atoi(rec.Args[1])
+		m.applyReclaim(nodeID, addr)
+	case "updateFileEntry":
+		m.applyUpdateFileEntry(rec.Args[0], rec.Entry)
+	case "version":
+		m.applyVersion(rec.Args[0])
+	case "stopnode":
+		nodeID, _ := strconv.Atoi(rec.Args[0])
+		m.applyStopNode(nodeID)
+	case "startnode":
+		nodeID, _ := strconv.Atoi(rec.Args[0])
+		m.applyStartNode(nodeID, parseHeldChunks(rec.Args[1:]))
+	case "replicate":
+		m.applyReplicate(rec.Args)
+	case "trim":
+		m.applyTrim(rec.Args)
+	case "move":
+		m.applyMove(rec.Args)
+	case "shard":
+		m.applyShard(rec.Args)
+	case "invalidate":
+		m.applyInvalidate(rec.Args)
+	case "addnode":
+		m.applyAddNode(rec.Args)
+	case "decommission":
+		nodeID, _ := strconv.Atoi(rec.Args[0])
+		m.applyDecommission(nodeID)
+	case "decommissioned":
+		nodeID, _ := strconv.Atoi(rec.Args[0])
+		m.applyDecommissioned(nodeID)
+	default:
+		log.Printf("unknown operation %q in operation log\n", rec.Op)
+	}
+}
+
+func (m *MasterNode) applyWrite(filename string, replicas int, scheme ErasureScheme) {
+	if _, ok := m.files[filename]; !ok {
+		m.addFile(filename, &File{Name: filename, Replicas: replicas, Erasure: scheme})
+	}
+}
+
+func (m *MasterNode) applySetReplication(filename string, replicas int) {
 	if entry, ok := m.files[filename]; ok {
-		return entry
+		entry.(*File).Replicas = replicas
 	}
-	entry := &File{Name: filename}
-	m.files[entry.GetName()] = entry
-	return entry
+}
 
+func (m *MasterNode) applyRename(oldFileName string, newFileName string) {
+	if entry, ok := m.files[oldFileName]; ok {
+		delete(m.files, oldFileName)
+		m.unlink(oldFileName)
+		m.addFile(newFileName, entry)
+	} else if m.isDir(oldFileName) && oldFileName != rootDir {
+		m.unlink(oldFileName)
+		m.makeDirs(path.Dir(newFileName))
+		m.moveDir(oldFileName, newFileName)
+		m.dirs[path.Dir(newFileName)][path.Base(newFileName)] = true
+	}
+}
+
+func (m *MasterNode) applyUpdateFileEntry(filename string, newEntry *File) {
+	// the copies of the previous contents are left to the garbage collector
+	entry, ok := m.files[filename]
+	if ok {
+		for _, chunk := range entry.getChunks() {
+			m.garbage = append(m.garbage, chunk.Read()...)
+		}
+	}
+	for _, chunk := range newEntry.getChunks() {
+		for _, chunkCopy := range chunk.Read() {
+			m.adjustSpace(chunkCopy.Node, -chunkCopy.Size)
+			if !ok {
+				// the file was deleted or moved while it was written
+				m.garbage = append(m.garbage, chunkCopy)
+			}
+		}
+	}
+	if !ok {
+		m.updateDiskCap()
+		return
+	}
+	stampVersions(newEntry.getChunks(), entry.getChunks(), 0)
+	newEntry.Size = 0
+	for _, chunk := range newEntry.getChunks() {
+		newEntry.Size += chunk.Size()
+	}
+	m.addFile(filename, newEntry)
+	m.updateDiskCap()
+}
+
+func (m *MasterNode) applyStopNode(nodeID int) {
+	m.downNodes[nodeID] = true
+	for _, entries := range m.files {
+		entries.StopNode(nodeID)
+	}
+	m.revokeLeases(nodeID)
+}
+
+// recover rebuilds the metadata from the last checkpoint and the operation
+// log records written after it.
+func (m *MasterNode) recover() error {
+	cp, err := m.oplog.LoadCheckpoint()
+	if err != nil {
+		return err
+	}
+	var after uint64
+	if cp != nil {
+		for _, dir := range cp.Dirs {
+			m.makeDirs(cleanPath(dir))
+		}
+		for name, entry := range cp.Files {
+			m.addFile(cleanPath(name), entry)
+		}
+		m.garbage = cp.Garbage
+		// nodes added at runtime
+		for nodeID := m.ROW; nodeID < cp.Nodes; nodeID++ {
+			m.nodeMap = append(m.nodeMap, cp.Capacities[nodeID])
+		}
+		if cp.Nodes > m.ROW {
+			m.ROW = cp.Nodes
+		}
+		for nodeID, rack := range cp.NodeRacks {
+			m.nodeRacks[nodeID] = rack
+		}
+		for nodeID, capacity := range cp.Capacities {
+			m.capacities[nodeID] = capacity
+		}
+		for nodeID, copies := range cp.Draining {
+			m.draining[nodeID] = copies
+		}
+		for nodeID := range cp.Decommissioned {
+			m.decommissioned[nodeID] = true
+		}
+		copy(m.nodeMap, cp.NodeMap)
+		for nodeID := range cp.DownNodes {
+			m.downNodes[nodeID] = true
+		}
+		after = cp.Seq
+	}
+	return m.oplog.Replay(after, m.apply)
+}
+
+func (m *MasterNode) runCheckpoints() {
+	ticker := time.NewTicker(m.checkpointInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := m.Checkpoint(); err != nil {
+			log.Println("checkpoint error: ", err.Error())
+		}
+	}
 }
 
 func (m *MasterNode) Run() {
@@ -294,41 +992,82 @@ func (m *MasterNode) Run() {
 	fmt.Printf("starting %v server at port %d\n", m.serverName, m.PORT)
 	m.UpdateDiskCap()
 
-	chunkServerConfig := map[string]interface{}{
-		"port":        os.Getenv("CHUNK_SERVER_PORT"),
-		"nodes":       m.ROW,
-		"chunksize":   m.CHUNKSIZE,
-		"NO_PER_RACK": m.COLUMN,
-	}
+	m.mutex.RLock()
+	chunkServerConfig := m.chunkServerConfig()
+	m.mutex.RUnlock()
 	chunkServer := NewChunkServer("chunk", chunkServerConfig)
 	go chunkServer.Run()
 
+	if m.oplog != nil && m.checkpointInterval > 0 {
+		go m.runCheckpoints()
+	}
+	if m.replicationInterval > 0 {
+		go m.runReplication()
+	}
+	if m.gcInterval > 0 {
+		go m.runGarbageCollection()
+	}
+	if m.heartbeatInterval > 0 && m.heartbeatMisses > 0 {
+		go m.runFailureDetector()
+	}
+	if m.balancer.interval > 0 {
+		go m.runBalancer()
+	}
+
 	for {
 		conn, err := m.socket.Accept()
 		if err != nil {
 			log.Fatal(err.Error())
 		}
-		m.encoder = gob.NewEncoder(conn)
-		m.decoder = gob.NewDecoder(conn)
-		go m.handleConnection(conn)
+		go m.handleConnection(newSession(conn))
 
 	}
 
 }
 
-func (m *MasterNode) handleConnection(conn net.Conn) {
+// chunkServerConfig is the configuration of the chunk server, which chunk
+// node processes get when they join. It expects the caller to hold the
+// metadata lock.
+func (m *MasterNode) chunkServerConfig() map[string]interface{} {
+	var draining []int
+	for nodeID := range m.draining {
+		draining = append(draining, nodeID)
+	}
+	return map[string]interface{}{
+		"racks":             copyIntMap(m.nodeRacks),
+		"capacities":        copyIntMap(m.capacities),
+		"draining":          draining,
+		"port":              strings.TrimPrefix(m.chunkAddr, ":"),
+		"chunkaddr":         m.chunkAddr,
+		"metaaddr":          fmt.Sprintf(":%d", m.PORT),
+		"nodes":             m.ROW,
+		"chunksize":         m.CHUNKSIZE,
+		"NO_PER_RACK":       m.COLUMN,
+		"replicas":          m.REPLICAS,
+		"capacity":          DEFAULT_ALLOCATED_DISKSPACE,
+		"placement":         m.placement.Name(),
+		"datadir":           m.chunkDir,
+		"scrubinterval":     m.scrubInterval,
+		"scrubrate":         m.scrubRate,
+		"readconcurrency":   m.readConcurrency,
+		"hedgedelay":        m.hedgeDelay,
+		"heartbeatinterval": int(m.heartbeatInterval / time.Millisecond),
+	}
+}
+
+func (m *MasterNode) handleConnection(s *session) {
 
-	defer conn.Close()
-	var msg Message
+	defer s.conn.Close()
 	var err error
 	for {
-		err = m.decoder.Decode(&msg)
+		var msg Message
+		err = s.decoder.Decode(&msg)
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
 			log.Println("decode error: ", err.Error())
-			m.encoder.Encode(err.Error())
+			s.encoder.Encode(err.Error())
 			break
 		}
 		if msg.Command == "killserver" {
@@ -339,27 +1078,207 @@ func (m *MasterNode) handleConnection(conn net.Conn) {
 			}
 
 			rmsg.Result = "servers stopped running"
-			err = m.encoder.Encode(rmsg)
+			err = s.encoder.Encode(rmsg)
 			if err != nil {
 				log.Println(err.Error())
 			}
 			os.Exit(1)
 		}
-		m.handleClientCommands(&msg)
+		m.handleClientCommands(s, &msg)
 
 	}
 
 }
 
-func (m *MasterNode) handleClientCommands(msg *Message) {
+func (m *MasterNode) handleClientCommands(s *session, msg *Message) {
 	switch msg.Command {
-	case "stopnode":
+	case "stopnode", "stoprack":
+		// stopnode [<id> | --count <n> [<seed>]], stoprack <rack>
+		var rmsg struct {
+			Result string
+			Err    string
+		}
+		var nodes []int
+		var err error
+		if msg.Command == "stoprack" {
+			var rack int
+			if rack, err = strconv.Atoi(msg.Args[0]); err == nil {
+				nodes, err = m.StopRack(rack)
+			}
+		} else if len(msg.Args) > 1 && msg.Args[0] == "--count" {
+			var count int
+			var seed int64
+			if count, err = strconv.Atoi(msg.Args[1]); err == nil && len(msg.Args) > 2 {
+				seed, err = strconv.ParseInt(msg.Args[2], 10, 64)
+			}
+			if err == nil {
+				nodes, err = m.StopRandomNodes(count, seed)
+			}
+		} else if len(msg.Args) > 0 {
+			var nodeID int
+			if nodeID, err = strconv.Atoi(msg.Args[0]); err == nil {
+				if err = m.StopNode(nodeID); err == nil {
+					nodes = []int{nodeID}
+				}
+			}
+		} else {
+			nodes, err = m.StopRandomNodes(1, 0)
+		}
+		if err != nil {
+			rmsg.Err = err.Error()
+		} else {
+			rmsg.Result = formatNodeIDs(nodes)
+		}
+		err = s.encoder.Encode(rmsg)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		break
+	case "addnode":
+		// addnode <rack> [<capacity>]
+		var rmsg struct {
+			Result string
+			Err    string
+		}
+		var rack, capacity, nodeID int
+		var err error
+		if len(msg.Args) < 1 {
+			err = fmt.Errorf("missing rack of the new node")
+		} else if rack, err = strconv.Atoi(msg.Args[0]); err == nil && len(msg.Args) > 1 {
+			capacity, err = strconv.Atoi(msg.Args[1])
+		}
+		if err == nil {
+			nodeID, err = m.AddNode(rack, capacity)
+		}
+		if err != nil {
+			rmsg.Err = err.Error()
+		} else {
+			rmsg.Result = fmt.Sprintf("added node %d to rack %d", nodeID, rack)
+		}
+		err = s.encoder.Encode(rmsg)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		break
+	case "decommission":
+		var rmsg struct {
+			Result string
+			Err    string
+		}
+		nodeID, err := strconv.Atoi(msg.Args[0])
+		if err == nil {
+			err = m.Decommission(nodeID)
+		}
+		if err != nil {
+			rmsg.Err = err.Error()
+		} else {
+			rmsg.Result = fmt.Sprintf("decommissioning node %d, see nodestat %d for progress", nodeID, nodeID)
+		}
+		err = s.encoder.Encode(rmsg)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		break
+	case "balance":
+		var rmsg struct {
+			Result string
+			Err    string
+		}
+		threshold := m.balancer.threshold
+		var err error
+		if len(msg.Args) > 0 {
+			threshold, err = strconv.Atoi(strings.TrimSuffix(msg.Args[0], "%"))
+		}
+		var moved int
+		var spread [2]float64
+		if err == nil {
+			moved, spread, err = m.Balance(threshold)
+		}
+		if err != nil {
+			rmsg.Err = err.Error()
+		} else {
+			rmsg.Result = fmt.Sprintf("moved %d chunk copies, usage gap between nodes went from %.1f%% to %.1f%%", moved, spread[0], spread[1])
+		}
+		err = s.encoder.Encode(rmsg)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		break
+	case "heartbeat":
+		// heartbeat <id> <free> <chunks> <load> [<addr> <rack>]
+		var rmsg struct {
+			Members map[int]NodeMember
+			Stopped []int
+			Rejoin  bool
+			Err     string
+		}
+		var values []int
+		for _, arg := range msg.Args {
+			value, _ := strconv.Atoi(arg)
+			values = append(values, value)
+		}
+		var err error
+		if len(values) < 4 {
+			err = fmt.Errorf("invalid heartbeat")
+		} else {
+			beat := NodeHeartbeat{Node: values[0], Free: values[1], Chunks: values[2], Load: values[3]}
+			if len(msg.Args) > 5 {
+				beat.Addr, beat.Rack = msg.Args[4], values[5]
+			}
+			rmsg.Members, err = m.Heartbeat(beat)
+			m.mutex.RLock()
+			rmsg.Stopped = m.stoppedNodes()
+			rmsg.Rejoin = m.missedHeartbeats[beat.Node]
+			m.mutex.RUnlock()
+		}
+		if err != nil {
+			rmsg.Err = err.Error()
+		}
+		err = s.encoder.Encode(rmsg)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		break
+	case "joinnode":
+		// joinnode <id> <rack> <addr> [<addr>:<checksum>...]
+		var rmsg struct {
+			Result  map[string]interface{}
+			Members map[int]NodeMember
+			Err     string
+		}
+		var nodeID, rack int
+		var err error
+		if len(msg.Args) < 3 {
+			err = fmt.Errorf("missing arguments to join")
+		} else if nodeID, err = strconv.Atoi(msg.Args[0]); err == nil {
+			if rack, err = strconv.Atoi(msg.Args[1]); err == nil {
+				rmsg.Result, rmsg.Members, err = m.JoinNode(nodeID, rack, msg.Args[2], parseHeldChunks(msg.Args[3:]))
+			}
+		}
+		if err != nil {
+			rmsg.Err = err.Error()
+		}
+		err = s.encoder.Encode(rmsg)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		break
+	case "registernode":
 		var rmsg struct {
 			Result string
 			Err    string
 		}
-		rmsg.Result = strconv.Itoa(m.stopNode())
-		_ = m.encoder.Encode(rmsg)
+		nodeID, err := strconv.Atoi(msg.Args[0])
+		if err == nil {
+			rmsg.Result, err = m.RegisterNode(nodeID, parseHeldChunks(msg.Args[1:]))
+		}
+		if err != nil {
+			rmsg.Err = err.Error()
+		}
+		err = s.encoder.Encode(rmsg)
+		if err != nil {
+			log.Println(err.Error())
+		}
 		break
 	case "stat":
 		stat, err := m.FileStat(msg.Args[0])
@@ -370,11 +1289,11 @@ func (m *MasterNode) handleClientCommands(msg *Message) {
 
 		if err != nil {
 			rmsg.Err = err.Error()
-			_ = m.encoder.Encode(rmsg)
+			_ = s.encoder.Encode(rmsg)
 			break
 		}
 		rmsg.Result = stat
-		err = m.encoder.Encode(rmsg)
+		err = s.encoder.Encode(rmsg)
 		if err != nil {
 			log.Println(err.Error())
 		}
@@ -384,13 +1303,15 @@ func (m *MasterNode) handleClientCommands(msg *Message) {
 			Result string
 			Err    string
 		}
-		nodeID, err := strconv.Atoi(msg.Args[0])
-		if err != nil {
+		// every node, with the progress of decommissions, when no id is given
+		if len(msg.Args) == 0 {
+			rmsg.Result = m.GetNodeStat(nil)
+		} else if nodeID, err := strconv.Atoi(msg.Args[0]); err != nil {
 			rmsg.Err = err.Error()
 		} else {
 			rmsg.Result = m.GetNodeStat(nodeID)
 		}
-		err = m.encoder.Encode(rmsg)
+		err := s.encoder.Encode(rmsg)
 		if err != nil {
 			log.Println(err.Error())
 		}
@@ -399,8 +1320,48 @@ func (m *MasterNode) handleClientCommands(msg *Message) {
 			Result string
 			Err    string
 		}
-		rmsg.Result = m.ListFiles()
-		err := m.encoder.Encode(rmsg)
+		dir := rootDir
+		if len(msg.Args) > 0 {
+			dir = msg.Args[0]
+		}
+		entries, err := m.ListDir(dir)
+		if err != nil {
+			rmsg.Err = err.Error()
+		} else {
+			rmsg.Result = formatDirEntries(entries)
+		}
+		err = s.encoder.Encode(rmsg)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		break
+	case "delete":
+		var rmsg struct {
+			Err string
+		}
+		err := m.Delete(msg.Args[0])
+		if err != nil {
+			rmsg.Err = err.Error()
+		}
+		err = s.encoder.Encode(rmsg)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		break
+	case "mkdir", "rmdir":
+		var rmsg struct {
+			Err string
+		}
+		var err error
+		if msg.Command == "mkdir" {
+			err = m.Mkdir(msg.Args[0])
+		} else {
+			err = m.Rmdir(msg.Args[0])
+		}
+		if err != nil {
+			rmsg.Err = err.Error()
+		}
+		err = s.encoder.Encode(rmsg)
 		if err != nil {
 			log.Println(err.Error())
 		}
@@ -411,7 +1372,7 @@ func (m *MasterNode) handleClientCommands(msg *Message) {
 			Err    string
 		}
 		rmsg.Result = fmt.Sprintf("total diskcapacity: %d", m.GetDiskCap())
-		_ = m.encoder.Encode(rmsg)
+		_ = s.encoder.Encode(rmsg)
 		break
 	case "rename":
 		var rmsg struct {
@@ -421,7 +1382,7 @@ func (m *MasterNode) handleClientCommands(msg *Message) {
 		if err != nil {
 			rmsg.Err = err.Error()
 		}
-		err = m.encoder.Encode(rmsg)
+		err = s.encoder.Encode(rmsg)
 		if err != nil {
 			log.Println(err)
 		}
@@ -429,7 +1390,9 @@ func (m *MasterNode) handleClientCommands(msg *Message) {
 	case "read":
 		var rmsg struct {
 			Result *File
-			Err    string
+			// node process to read from, empty for the chunk server
+			Addr string
+			Err  string
 		}
 		filename := msg.Args[0]
 		entry, err := m.Read(filename)
@@ -437,26 +1400,126 @@ func (m *MasterNode) handleClientCommands(msg *Message) {
 			rmsg.Err = err.Error()
 		} else {
 			rmsg.Result = entry.(*File)
+			rmsg.Addr = m.readAddr(entry)
 		}
-		err = m.encoder.Encode(rmsg)
+		err = s.encoder.Encode(rmsg)
 		if err != nil {
 			log.Println(err.Error())
 		}
 		break
 	case "write":
+		// write <filename> <size> <replicas> [<erasure coding>]
 		var rmsg struct {
 			Result *File
-			Err    string
+			// size of the pieces the client streams to the chunk server
+			ChunkSize int
+			// node process holding the lease, empty for the chunk server
+			Addr string
+			Err  string
 		}
+		rmsg.ChunkSize = m.CHUNKSIZE
 		filename := msg.Args[0]
-		filesize, _ := strconv.Atoi(msg.Args[0])
-		if filesize >= m.GetDiskCap() {
+		var filesize, replicas int
+		if len(msg.Args) > 1 {
+			filesize, _ = strconv.Atoi(msg.Args[1])
+		}
+		if len(msg.Args) > 2 {
+			replicas, _ = strconv.Atoi(msg.Args[2])
+		}
+		var scheme ErasureScheme
+		var err error
+		if len(msg.Args) > 3 {
+			scheme, err = ParseErasureScheme(msg.Args[3])
+		}
+		if err != nil {
+			rmsg.Err = err.Error()
+		} else if float64(filesize)*m.storedCopies(replicas, scheme) >= float64(m.GetDiskCap()) {
+			rmsg.Err = "not enough availabe disk space for file"
+		} else {
+			var entry FileEntry
+			if scheme.Data > 0 {
+				entry, err = m.WriteErasureCoded(filename, scheme)
+			} else {
+				entry, err = m.Write(filename, replicas)
+			}
+			if err != nil {
+				rmsg.Err = err.Error()
+			} else {
+				rmsg.Result = entry.(*File)
+				rmsg.Addr = m.primaryAddr(filename)
+			}
+		}
+		err = s.encoder.Encode(rmsg)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		break
+	case "append":
+		var rmsg struct {
+			Result    *File
+			ChunkSize int
+			Addr      string
+			Err       string
+		}
+		rmsg.ChunkSize = m.CHUNKSIZE
+		var filesize int
+		if len(msg.Args) > 1 {
+			filesize, _ = strconv.Atoi(msg.Args[1])
+		}
+		entry, err := m.Read(msg.Args[0])
+		if err != nil {
+			rmsg.Err = err.Error()
+		} else if file := entry.(*File); float64(filesize)*m.storedCopies(file.Replicas, file.Erasure) >= float64(m.GetDiskCap()) {
 			rmsg.Err = "not enough availabe disk space for file"
 		} else {
-			entry := m.Write(filename)
 			rmsg.Result = entry.(*File)
+			rmsg.Addr = m.primaryAddr(msg.Args[0])
+		}
+		err = s.encoder.Encode(rmsg)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		break
+	case "appendchunks":
+		var entry struct {
+			Entry *File
+		}
+		var rmsg struct {
+			Result int
+			Err    string
+		}
+		err := s.decoder.Decode(&entry)
+		if err != nil {
+			log.Println(err.Error())
+			break
+		}
+		from, _ := strconv.Atoi(msg.Args[1])
+		count, _ := strconv.Atoi(msg.Args[2])
+		lastChecksum, _ := strconv.ParseUint(msg.Args[3], 10, 32)
+		rmsg.Result, err = m.CommitAppend(msg.Args[0], from, count, uint32(lastChecksum), leaseArg(msg.Args, 4), entry.Entry)
+		if err != nil {
+			rmsg.Err = err.Error()
+		}
+		err = s.encoder.Encode(rmsg)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		break
+	case "lease":
+		var rmsg struct {
+			Result Lease
+			// node process of the primary, empty for the chunk server
+			Addr string
+			Err  string
+		}
+		lease, err := m.GrantLease(msg.Args[0])
+		if err != nil {
+			rmsg.Err = err.Error()
+		} else {
+			rmsg.Result = lease
+			rmsg.Addr = m.memberAddr(lease.Primary)
 		}
-		err := m.encoder.Encode(rmsg)
+		err = s.encoder.Encode(rmsg)
 		if err != nil {
 			log.Println(err.Error())
 		}
@@ -468,7 +1531,7 @@ func (m *MasterNode) handleClientCommands(msg *Message) {
 		}
 		filename := msg.Args[0]
 		rmsg.Result = m.FileSize(filename)
-		err := m.encoder.Encode(rmsg)
+		err := s.encoder.Encode(rmsg)
 		if err != nil {
 			log.Println(err.Error())
 		}
@@ -477,27 +1540,104 @@ func (m *MasterNode) handleClientCommands(msg *Message) {
 		var rmsg struct {
 			Entry *File
 		}
-		err := m.decoder.Decode(&rmsg)
+		err := s.decoder.Decode(&rmsg)
 		if err != nil {
 			log.Println(err.Error())
+			break
 		}
-		if entry, ok := m.files[msg.Args[0]]; ok {
-			if len(entry.getChunks()) == 0 {
-				for _, chunk := range rmsg.Entry.getChunks() {
-					m.nodeMap[chunk.Id()] = m.nodeMap[chunk.Id()] - chunk.Size()
-				}
-			}
+		filename := cleanPath(msg.Args[0])
+		m.namespace.Lock(filename)
+		m.mutex.RLock()
+		err = m.checkLease(filename, leaseArg(msg.Args, 1))
+		m.mutex.RUnlock()
+		if err == nil {
+			err = m.commit(&logRecord{Op: "updateFileEntry", Args: []string{filename}, Entry: rmsg.Entry})
+		}
+		m.namespace.Unlock(filename)
+		var reply struct {
+			Err string
+		}
+		if err != nil {
+			log.Println(err.Error())
+			reply.Err = err.Error()
+		}
+		err = s.encoder.Encode(reply)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		break
+	case "badcopy":
+		var rmsg struct {
+			Err string
+		}
+		index, _ := strconv.Atoi(msg.Args[1])
+		nodeID, _ := strconv.Atoi(msg.Args[2])
+		addr, _ := strconv.Atoi(msg.Args[3])
+		err := m.ReportBadCopy(msg.Args[0], index, Copy{Node: nodeID, Addr: addr})
+		if err != nil {
+			rmsg.Err = err.Error()
+		}
+		err = s.encoder.Encode(rmsg)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		break
+	case "badchunk":
+		var rmsg struct {
+			Err string
+		}
+		nodeID, _ := strconv.Atoi(msg.Args[0])
+		addr, _ := strconv.Atoi(msg.Args[1])
+		err := m.ReportBadChunk(nodeID, addr)
+		if err != nil {
+			rmsg.Err = err.Error()
+		}
+		err = s.encoder.Encode(rmsg)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		break
+	case "setrep":
+		var rmsg struct {
+			Result string
+			Err    string
+		}
+		replicas, err := strconv.Atoi(msg.Args[1])
+		if err == nil {
+			err = m.SetReplication(msg.Args[0], replicas)
+		}
+		if err != nil {
+			rmsg.Err = err.Error()
+		} else {
+			rmsg.Result = fmt.Sprintf("replication of %s set to %d", msg.Args[0], replicas)
+		}
+		err = s.encoder.Encode(rmsg)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		break
+	case "checkpoint":
+		var rmsg struct {
+			Result string
+			Err    string
+		}
+		err := m.Checkpoint()
+		if err != nil {
+			rmsg.Err = err.Error()
+		} else {
+			rmsg.Result = "metadata checkpoint saved"
+		}
+		err = s.encoder.Encode(rmsg)
+		if err != nil {
+			log.Println(err.Error())
 		}
-		rmsg.Entry.Size = rmsg.Entry.Chunks[0].Size()
-		m.files[msg.Args[0]] = rmsg.Entry
-		m.UpdateDiskCap()
 		break
 	default:
 		var rmsg struct {
 			Err string
 		}
 		rmsg.Err = fmt.Sprintf("%s is not a valid command", msg.Command)
-		err := m.encoder.Encode(rmsg)
+		err := s.encoder.Encode(rmsg)
 		if err != nil {
 			log.Println(err.Error())
 		}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"sort"
+	"sync"
+)
+
+type pathLock struct {
+	sync.RWMutex
+	refs int
+}
+
+// namespaceLocks hands out a read-write lock per path, similar to the GFS
+// master namespace locks. Operations on different paths never wait on each
+// other, while a rename or write excludes readers of the same path. Every
+// operation also read-locks the directories above its paths, so a directory
+// cannot be renamed or removed while something below it changes. Locks are
+// created on demand and dropped once nobody holds or waits for them.
+type namespaceLocks struct {
+	mutex sync.Mutex
+	locks map[string]*pathLock
+}
+
+func newNamespaceLocks() *namespaceLocks {
+	return &namespaceLocks{locks: map[string]*pathLock{}}
+}
+
+func (n *namespaceLocks) acquire(path string) *pathLock {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	lock, ok := n.locks[path]
+	if !ok {
+		lock = &pathLock{}
+		n.locks[path] = lock
+	}
+	lock.refs++
+	return lock
+}
+
+func (n *namespaceLocks) release(path string) *pathLock {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	lock := n.locks[path]
+	lock.refs--
+	if lock.refs == 0 {
+		delete(n.locks, path)
+	}
+	return lock
+}
+
+// lockSet returns the paths to lock, together with their ancestors, in a
+// fixed order so that operations locking several paths cannot deadlock each
+// other. The value tells whether the write lock is needed; a path that is
+// both given and an ancestor of another one is write locked.
+func lockSet(paths []string, write bool) ([]string, map[string]bool) {
+	modes := map[string]bool{}
+	for _, path := range paths {
+		for _, dir := range ancestors(cleanPath(path)) {
+			if _, ok := modes[dir]; !ok {
+				modes[dir] = false
+			}
+		}
+	}
+	for _, path := range paths {
+		modes[cleanPath(path)] = write
+	}
+	sorted := make([]string, 0, len(modes))
+	for path := range modes {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+	return sorted, modes
+}
+
+// Lock takes the write lock of every given path.
+func (n *namespaceLocks) Lock(paths ...string) {
+	n.lock(paths, true)
+}
+
+func (n *namespaceLocks) Unlock(paths ...string) {
+	n.unlock(paths, true)
+}
+
+// RLock takes the read lock of every given path.
+func (n *namespaceLocks) RLock(paths ...string) {
+	n.lock(paths, false)
+}
+
+func (n *namespaceLocks) RUnlock(paths ...string) {
+	n.unlock(paths, false)
+}
+
+func (n *namespaceLocks) lock(paths []string, write bool) {
+	sorted, modes := lockSet(paths, write)
+	for _, path := range sorted {
+		if modes[path] {
+			n.acquire(path).Lock()
+		} else {
+			n.acquire(path).RLock()
+		}
+	}
+}
+
+func (n *namespaceLocks) unlock(paths []string, write bool) {
+	sorted, modes := lockSet(paths, write)
+	for _, path := range sorted {
+		if modes[path] {
+			n.release(path).Unlock()
+		} else {
+			n.release(path).RUnlock()
+		}
+	}
+}
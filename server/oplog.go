@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	opLogFile      = "oplog"
+	checkpointFile = "checkpoint"
+)
+
+// logRecord is a single metadata mutation as stored in the operation log.
+type logRecord struct {
+	Seq   uint64
+	Op    string
+	Args  []string
+	Entry *File
+}
+
+// checkpoint is a snapshot of the metadata state. Records with a sequence
+// number up to Seq are already reflected in it.
+type checkpoint struct {
+	Seq       uint64
+	Files     map[string]*File
+	Dirs      []string
+	Garbage   []Copy
+	NodeMap   []int
+	DownNodes map[int]bool
+	// nodes added at runtime, drained and removed ones, see membership.go
+	Nodes          int
+	NodeRacks      map[int]int
+	Capacities     map[int]int
+	Draining       map[int]int
+	Decommissioned map[int]bool
+}
+
+// opLog is an append-only log of metadata mutations, modelled after the GFS
+// master operation log. Every record is framed with its length so that a
+// record torn by a crash can be detected and dropped on replay.
+type opLog struct {
+	dir  string
+	file *os.File
+	seq  uint64
+}
+
+func openOpLog(dir string) (*opLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, opLogFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &opLog{dir: dir, file: file}, nil
+}
+
+// Append assigns the next sequence number to rec and syncs it to disk.
+func (l *opLog) Append(rec *logRecord) error {
+	rec.Seq = l.seq + 1
+	var body bytes.Buffer
+	if err := gob.NewEncoder(&body).Encode(rec); err != nil {
+		return err
+	}
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(body.Len()))
+	if _, err := l.file.Write(append(header[:], body.Bytes()...)); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.seq = rec.Seq
+	return nil
+}
+
+// Replay calls apply for every record newer than the given sequence number.
+// A torn record at the tail of the log is truncated away.
+func (l *opLog) Replay(after uint64, apply func(*logRecord)) error {
+	if _, err := l.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	l.seq = after
+	var offset int64
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(l.file, header[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header[:]))
+		if _, err := io.ReadFull(l.file, body); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+		var rec logRecord
+		if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&rec); err != nil {
+			break
+		}
+		offset += int64(len(header) + len(body))
+		if rec.Seq <= after {
+			continue
+		}
+		apply(&rec)
+		l.seq = rec.Seq
+	}
+	if err := l.file.Truncate(offset); err != nil {
+		return err
+	}
+	_, err := l.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// LoadCheckpoint returns the last saved snapshot, or nil if none exists.
+func (l *opLog) LoadCheckpoint() (*checkpoint, error) {
+	file, err := os.Open(filepath.Join(l.dir, checkpointFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	var cp checkpoint
+	if err := gob.NewDecoder(file).Decode(&cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// SaveCheckpoint atomically replaces the snapshot on disk and then empties
+// the log, since every record in it is covered by cp.
+func (l *opLog) SaveCheckpoint(cp *checkpoint) error {
+	cp.Seq = l.seq
+	tmpPath := filepath.Join(l.dir, checkpointFile+".tmp")
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err = gob.NewEncoder(file).Encode(cp); err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(l.dir, checkpointFile)); err != nil {
+		return err
+	}
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = l.file.Seek(0, io.SeekStart)
+	return err
+}
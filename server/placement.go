@@ -0,0 +1,365 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// NodeInfo is what a placement policy knows about a chunk node.
+type NodeInfo struct {
+	ID        int
+	Rack      int
+	Running   bool
+	SpaceLeft int
+}
+
+// PlacementRequest describes the copies a policy has to place for one chunk.
+type PlacementRequest struct {
+	// node local to the writing client, -1 when there is none
+	Writer int
+	// nodes already holding a valid copy of the chunk
+	Existing []int
+	// nodes that must not receive a copy
+	Exclude map[int]bool
+	Count   int
+	Size    int
+}
+
+// PlacementPolicy chooses the nodes that receive the copies of a chunk.
+// Policies are rack aware: they take the racks of existing copies into
+// account so that a chunk survives the loss of a whole rack.
+type PlacementPolicy interface {
+	Name() string
+	// Place returns up to req.Count distinct running nodes with enough space
+	Place(req PlacementRequest, nodes []NodeInfo) []int
+}
+
+// names accepted by NewPlacementPolicy
+var PlacementPolicies = []string{"hdfs", "leastused", "roundrobin"}
+
+func NewPlacementPolicy(name string) (PlacementPolicy, error) {
+	switch name {
+	case "", "hdfs":
+		return &hdfsPlacement{}, nil
+	case "leastused":
+		return &leastUsedPlacement{}, nil
+	case "roundrobin":
+		return &roundRobinPlacement{}, nil
+	default:
+		return nil, fmt.Errorf("unknown placement policy %q, expected one of %s", name, strings.Join(PlacementPolicies, ", "))
+	}
+}
+
+// placement tracks the nodes chosen so far for a single request.
+type placement struct {
+	req    PlacementRequest
+	nodes  []NodeInfo
+	chosen []int
+	taken  map[int]bool
+}
+
+func newPlacement(req PlacementRequest, nodes []NodeInfo) *placement {
+	p := &placement{req: req, nodes: nodes, taken: map[int]bool{}}
+	for _, nodeID := range req.Existing {
+		p.chosen = append(p.chosen, nodeID)
+		p.taken[nodeID] = true
+	}
+	return p
+}
+
+func (p *placement) eligible(node NodeInfo) bool {
+	return node.Running && !p.taken[node.ID] && !p.req.Exclude[node.ID] && node.SpaceLeft >= p.req.Size
+}
+
+func (p *placement) rackOf(nodeID int) int {
+	for _, node := range p.nodes {
+		if node.ID == nodeID {
+			return node.Rack
+		}
+	}
+	return -1
+}
+
+func (p *placement) usedRacks() map[int]bool {
+	racks := map[int]bool{}
+	for _, nodeID := range p.chosen {
+		racks[p.rackOf(nodeID)] = true
+	}
+	return racks
+}
+
+// candidates returns the eligible nodes accepted by filter.
+func (p *placement) candidates(filter func(NodeInfo) bool) []NodeInfo {
+	var nodes []NodeInfo
+	for _, node := range p.nodes {
+		if p.eligible(node) && (filter == nil || filter(node)) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+func (p *placement) add(nodeID int) {
+	p.chosen = append(p.chosen, nodeID)
+	p.taken[nodeID] = true
+}
+
+// placed returns the nodes chosen for this request, leaving out the
+// existing copies.
+func (p *placement) placed() []int {
+	return p.chosen[len(p.req.Existing):]
+}
+
+func (p *placement) done() bool {
+	return len(p.placed()) >= p.req.Count
+}
+
+func randomNode(nodes []NodeInfo) int {
+	return nodes[rand.Intn(len(nodes))].ID
+}
+
+// hdfsPlacement follows the HDFS default policy: the first copy goes to the
+// writer's node, the second to a node on another rack and the third to a
+// different node on the same rack as the second. Further copies are random.
+type hdfsPlacement struct{}
+
+func (h *hdfsPlacement) Name() string {
+	return "hdfs"
+}
+
+func (h *hdfsPlacement) Place(req PlacementRequest, nodes []NodeInfo) []int {
+	p := newPlacement(req, nodes)
+	for !p.done() {
+		var candidates []NodeInfo
+		switch len(p.chosen) {
+		case 0:
+			candidates = p.candidates(func(node NodeInfo) bool { return node.ID == req.Writer })
+		case 1:
+			firstRack := p.rackOf(p.chosen[0])
+			candidates = p.candidates(func(node NodeInfo) bool { return node.Rack != firstRack })
+		case 2:
+			firstRack, secondRack := p.rackOf(p.chosen[0]), p.rackOf(p.chosen[1])
+			if firstRack == secondRack {
+				candidates = p.candidates(func(node NodeInfo) bool { return node.Rack != firstRack })
+			} else {
+				candidates = p.candidates(func(node NodeInfo) bool { return node.Rack == secondRack })
+			}
+		}
+		if len(candidates) == 0 {
+			candidates = p.candidates(nil)
+		}
+		if len(candidates) == 0 {
+			break
+		}
+		p.add(randomNode(candidates))
+	}
+	return p.placed()
+}
+
+// leastUsedPlacement puts every copy on the node with the most free space,
+// preferring racks that hold no copy of the chunk yet.
+type leastUsedPlacement struct{}
+
+func (l *leastUsedPlacement) Name() string {
+	return "leastused"
+}
+
+func (l *leastUsedPlacement) Place(req PlacementRequest, nodes []NodeInfo) []int {
+	p := newPlacement(req, nodes)
+	for !p.done() {
+		racks := p.usedRacks()
+		candidates := p.candidates(func(node NodeInfo) bool { return !racks[node.Rack] })
+		if len(candidates) == 0 {
+			candidates = p.candidates(nil)
+		}
+		if len(candidates) == 0 {
+			break
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].SpaceLeft > candidates[j].SpaceLeft
+		})
+		p.add(candidates[0].ID)
+	}
+	return p.placed()
+}
+
+// roundRobinPlacement cycles through the racks and, within every rack,
+// through its nodes. Racks that already hold a copy of the chunk are skipped
+// while another rack is still available.
+type roundRobinPlacement struct {
+	mutex    sync.Mutex
+	nextRack int
+	nextNode map[int]int
+}
+
+func (r *roundRobinPlacement) Name() string {
+	return "roundrobin"
+}
+
+func (r *roundRobinPlacement) Place(req PlacementRequest, nodes []NodeInfo) []int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.nextNode == nil {
+		r.nextNode = map[int]int{}
+	}
+	racks := map[int][]NodeInfo{}
+	var rackIDs []int
+	for _, node := range nodes {
+		if _, ok := racks[node.Rack]; !ok {
+			rackIDs = append(rackIDs, node.Rack)
+		}
+		racks[node.Rack] = append(racks[node.Rack], node)
+	}
+	sort.Ints(rackIDs)
+
+	p := newPlacement(req, nodes)
+	// pick returns the next eligible node of the rack in turn, or -1
+	pick := func(rack int) int {
+		rackNodes := racks[rack]
+		for i := 0; i < len(rackNodes); i++ {
+			idx := (r.nextNode[rack] + i) % len(rackNodes)
+			if p.eligible(rackNodes[idx]) {
+				r.nextNode[rack] = idx + 1
+				return rackNodes[idx].ID
+			}
+		}
+		return -1
+	}
+	for !p.done() && len(rackIDs) > 0 {
+		used := p.usedRacks()
+		nodeID := -1
+		for _, preferNewRack := range []bool{true, false} {
+			for i := 0; i < len(rackIDs) && nodeID < 0; i++ {
+				rack := rackIDs[(r.nextRack+i)%len(rackIDs)]
+				if preferNewRack && used[rack] {
+					continue
+				}
+				if nodeID = pick(rack); nodeID >= 0 {
+					r.nextRack = (r.nextRack + i + 1) % len(rackIDs)
+				}
+			}
+			if nodeID >= 0 {
+				break
+			}
+		}
+		if nodeID < 0 {
+			break
+		}
+		p.add(nodeID)
+	}
+	return p.placed()
+}
+
+// PlacementReport summarises how a policy spread the chunks of a simulation.
+type PlacementReport struct {
+	Policy string
+	Chunks int
+	// chunks that did not get all their copies
+	UnderReplicated int
+	// chunks that survive the failure of any one rack
+	RackSafe int
+	// copies written to a rack other than the writer's, i.e. cross-rack traffic
+	CrossRackCopies  int
+	LocalFirstCopies int
+	MinUsed          int
+	MaxUsed          int
+	UsedStdDev       float64
+	// bytes of data and bytes stored for them, and the number of node
+	// failures every chunk survives
+	Logical   int
+	Stored    int
+	Tolerates int
+}
+
+// SimulatePlacement places chunks of chunkSize bytes with the given number of
+// copies on a cluster of racks*nodesPerRack nodes and reports the result.
+// Writers are picked at random.
+func SimulatePlacement(policy PlacementPolicy, racks, nodesPerRack, capacity, chunks, replicas, chunkSize int) PlacementReport {
+	nodes := simulatedNodes(racks, nodesPerRack, capacity)
+	report := PlacementReport{Policy: policy.Name(), Chunks: chunks, Tolerates: replicas - 1}
+	for i := 0; i < chunks; i++ {
+		writer := simulatedWriter(nodes)
+		placed := policy.Place(PlacementRequest{Writer: writer, Count: replicas, Size: chunkSize}, nodes)
+		if len(placed) < replicas {
+			report.UnderReplicated++
+		}
+		usedRacks := map[int]bool{}
+		for idx, nodeID := range placed {
+			report.record(nodes, writer, idx, nodeID, chunkSize)
+			usedRacks[nodes[nodeID].Rack] = true
+		}
+		if len(usedRacks) > 1 {
+			report.RackSafe++
+		}
+	}
+	report.Logical = chunks * chunkSize
+	report.summarise(nodes, capacity)
+	return report
+}
+
+func simulatedNodes(racks, nodesPerRack, capacity int) []NodeInfo {
+	var nodes []NodeInfo
+	for id := 0; id < racks*nodesPerRack; id++ {
+		nodes = append(nodes, NodeInfo{ID: id, Rack: id / nodesPerRack, Running: true, SpaceLeft: capacity})
+	}
+	return nodes
+}
+
+func simulatedWriter(nodes []NodeInfo) int {
+	return rand.Intn(len(nodes))
+}
+
+// record adds the idx-th copy of a chunk, placed on nodeID, to the report.
+func (r *PlacementReport) record(nodes []NodeInfo, writer int, idx int, nodeID int, size int) {
+	nodes[nodeID].SpaceLeft -= size
+	r.Stored += size
+	if nodes[nodeID].Rack != nodes[writer].Rack {
+		r.CrossRackCopies++
+	}
+	if idx == 0 && nodeID == writer {
+		r.LocalFirstCopies++
+	}
+}
+
+// summarise adds the disk usage of the nodes to the report.
+func (r *PlacementReport) summarise(nodes []NodeInfo, capacity int) {
+	var sum, sumSquares float64
+	r.MinUsed = capacity
+	for _, node := range nodes {
+		used := capacity - node.SpaceLeft
+		if used < r.MinUsed {
+			r.MinUsed = used
+		}
+		if used > r.MaxUsed {
+			r.MaxUsed = used
+		}
+		sum += float64(used)
+		sumSquares += float64(used) * float64(used)
+	}
+	mean := sum / float64(len(nodes))
+	r.UsedStdDev = math.Sqrt(sumSquares/float64(len(nodes)) - mean*mean)
+}
+
+// Overhead returns the bytes stored per byte of data.
+func (r PlacementReport) Overhead() float64 {
+	if r.Logical == 0 {
+		return 0
+	}
+	return float64(r.Stored) / float64(r.Logical)
+}
+
+func (r PlacementReport) String() string {
+	percent := func(n int) float64 {
+		if r.Chunks == 0 {
+			return 0
+		}
+		return 100 * float64(n) / float64(r.Chunks)
+	}
+	return fmt.Sprintf("%-11s rack safe: %5.1f%%  local first copy: %5.1f%%  cross-rack copies: %6d  under-replicated: %4d  used min/max: %d/%d  stddev: %.1f  overhead: %.2fx  tolerates: %d node failures",
+		r.Policy, percent(r.RackSafe), percent(r.LocalFirstCopies), r.CrossRackCopies,
+		r.UnderReplicated, r.MinUsed, r.MaxUsed, r.UsedStdDev, r.Overhead(), r.Tolerates)
+}
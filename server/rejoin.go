@@ -0,0 +1,174 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A stopped node comes back with startnode, and restartnode stops and starts
+// a running one. Either way the node reloads its chunks and reports them to
+// the metadata server, which reconciles the report with the copies it has on
+// record for the node: copies the node still holds at the current version
+// become valid again, copies it holds with an older version or a different
+// checksum are stale and left to the garbage collector, and copies it lost
+// are dropped. Chunks no file refers to are left alone, since they may
+// belong to a mutation that is not committed yet.
+
+// StartNode starts a stopped node, or stops and starts a running one when
+// restart is set, and registers it with the metadata server.
+func (c *ChunkServer) StartNode(nodeID int, restart bool) (string, error) {
+	node := c.node(nodeID)
+	if node == nil {
+		return "", fmt.Errorf("no node with id %d", nodeID)
+	}
+	if remote, ok := node.(*RemoteNode); ok {
+		return remote.start(restart)
+	}
+	if node.IsRunning() {
+		if !restart {
+			return "", fmt.Errorf("node %d is already running", nodeID)
+		}
+		node.Kill()
+	}
+	if err := node.Load(); err != nil {
+		return "", fmt.Errorf("unable to load chunks for node %d: %v", nodeID, err)
+	}
+	node.Run()
+	return c.registerNode(nodeID)
+}
+
+// registerNode reports the chunks of a running node to the metadata server,
+// which marks the node as running again.
+func (c *ChunkServer) registerNode(nodeID int) (string, error) {
+	node := c.node(nodeID)
+	args := []string{strconv.Itoa(nodeID)}
+	for addr, checksum := range node.Checksums() {
+		args = append(args, fmt.Sprintf("%d:%d", addr, checksum))
+	}
+	var rmsg struct {
+		Result string
+		Err    string
+	}
+	if err := c.callMetaServer(&Message{Command: "registernode", Args: args}, &rmsg); err != nil {
+		return "", err
+	}
+	if len(rmsg.Err) > 0 {
+		return "", errors.New(rmsg.Err)
+	}
+	return rmsg.Result, nil
+}
+
+// parseHeldChunks reads the "addr:checksum" pairs a node reports.
+func parseHeldChunks(args []string) map[int]uint32 {
+	held := map[int]uint32{}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		addr, err := strconv.Atoi(parts[0])
+		if err != nil {
+			continue
+		}
+		checksum, _ := strconv.ParseUint(parts[1], 10, 32)
+		held[addr] = uint32(checksum)
+	}
+	return held
+}
+
+// RegisterNode marks a node as running again and reconciles the chunks it
+// holds, given as checksums by address, with the metadata.
+func (m *MasterNode) RegisterNode(nodeID int, held map[int]uint32) (string, error) {
+	m.mutex.RLock()
+	var err error
+	if nodeID < 0 || nodeID >= m.ROW {
+		err = fmt.Errorf("no node with id %d", nodeID)
+	} else if m.decommissioned[nodeID] {
+		err = fmt.Errorf("node %d was decommissioned", nodeID)
+	}
+	m.mutex.RUnlock()
+	if err != nil {
+		return "", err
+	}
+	var addrs []int
+	for addr := range held {
+		addrs = append(addrs, addr)
+	}
+	sort.Ints(addrs)
+	args := []string{strconv.Itoa(nodeID)}
+	for _, addr := range addrs {
+		args = append(args, fmt.Sprintf("%d:%d", addr, held[addr]))
+	}
+	if err := m.commit(&logRecord{Op: "startnode", Args: args}); err != nil {
+		return "", err
+	}
+	m.kickReplication()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	// the node has until its next heartbeats before it counts as dead again
+	m.heartbeats[nodeID] = NodeHeartbeat{Node: nodeID, Free: m.nodeMap[nodeID], LastSeen: time.Now()}
+	var copies int
+	for _, entry := range m.files {
+		for _, chunk := range entry.getChunks() {
+			for _, chunkCopy := range chunk.Read() {
+				if chunkCopy.Node == nodeID && chunkCopy.Valid {
+					copies++
+				}
+			}
+		}
+	}
+	return fmt.Sprintf("node %d is running with %d valid chunk copies", nodeID, copies), nil
+}
+
+func (m *MasterNode) applyStartNode(nodeID int, held map[int]uint32) {
+	if nodeID < 0 || nodeID >= m.ROW {
+		return
+	}
+	wasDown := m.downNodes[nodeID]
+	delete(m.downNodes, nodeID)
+	delete(m.missedHeartbeats, nodeID)
+	var revalidated, stale, lost int
+	for _, entry := range m.files {
+		for _, chunk := range entry.getChunks() {
+			metadata, ok := chunk.(*ChunkMetadata)
+			if !ok {
+				continue
+			}
+			var copies []Copy
+			for _, chunkCopy := range metadata.Copies {
+				if chunkCopy.Node != nodeID {
+					copies = append(copies, chunkCopy)
+					continue
+				}
+				checksum, ok := held[chunkCopy.Addr]
+				if !ok {
+					// the space of a lost chunk is free again
+					m.adjustSpace(nodeID, chunkCopy.Size)
+					lost++
+					continue
+				}
+				if checksum != chunkCopy.Checksum || chunkCopy.Version < metadata.Version {
+					m.garbage = append(m.garbage, chunkCopy)
+					stale++
+					continue
+				}
+				// copies invalidated while the node was running failed
+				// verification and stay invalid
+				if wasDown && !chunkCopy.Valid {
+					chunkCopy.Valid = true
+					revalidated++
+				}
+				copies = append(copies, chunkCopy)
+			}
+			metadata.Copies = copies
+		}
+	}
+	m.updateDiskCap()
+	log.Printf("node %d registered: %d copies revalidated, %d stale, %d lost\n", nodeID, revalidated, stale, lost)
+}
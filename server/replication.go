@@ -0,0 +1,412 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// replicationTask describes a chunk whose number of valid copies differs
+// from the replication factor of its file.
+type replicationTask struct {
+	filename string
+	index    int
+	source   Copy
+	checksum uint32
+	checked  bool
+	holders  map[int]bool
+	valid    []Copy
+	// invalid copies on running nodes, e.g. ones that failed verification
+	garbage []Copy
+	// copies on nodes being decommissioned, dropped once the chunk has
+	// enough copies elsewhere
+	drained []Copy
+	missing int
+	excess  int
+	// erasure coded chunks and their shards without a copy, see erasure.go
+	stripe *ChunkMetadata
+	shards []int
+}
+
+// callChunkServer sends msg to the chunk server and decodes its reply.
+func (m *MasterNode) callChunkServer(msg *Message, reply interface{}) error {
+	conn, err := net.Dial("tcp", m.chunkAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	s := newSession(conn)
+	if err = s.encoder.Encode(msg); err != nil {
+		return err
+	}
+	return s.decoder.Decode(reply)
+}
+
+// kickReplication wakes the replication manager without waiting for the next
+// scheduled pass.
+func (m *MasterNode) kickReplication() {
+	select {
+	case m.replicationKick <- struct{}{}:
+	default:
+	}
+}
+
+func (m *MasterNode) runReplication() {
+	ticker := time.NewTicker(m.replicationInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.replicationKick:
+		}
+		m.replicateChunks()
+	}
+}
+
+// replicateChunks copies under-replicated chunks to healthy nodes and drops
+// surplus copies of over-replicated ones until every chunk matches the
+// replication factor of its file, and rebuilds the missing shards of erasure
+// coded chunks. Copies on draining nodes are moved off
+// them, and drained nodes are then removed.
+func (m *MasterNode) replicateChunks() {
+	for _, task := range m.misReplicated() {
+		replicated := true
+		if len(task.shards) > 0 {
+			if err := m.reconstructChunk(&task); err != nil {
+				log.Printf("unable to reconstruct chunk %d of %s: %v\n", task.index, task.filename, err)
+				replicated = false
+			}
+		}
+		for i := 0; i < task.missing; i++ {
+			if err := m.replicateChunk(&task); err != nil {
+				log.Printf("unable to replicate chunk %d of %s: %v\n", task.index, task.filename, err)
+				replicated = false
+				break
+			}
+		}
+		if replicated {
+			task.garbage = append(task.garbage, task.drained...)
+		}
+		if task.excess > 0 || len(task.garbage) > 0 {
+			if err := m.trimChunk(&task); err != nil {
+				log.Printf("unable to trim chunk %d of %s: %v\n", task.index, task.filename, err)
+			}
+		}
+	}
+	m.finishDecommissions()
+}
+
+func (m *MasterNode) misReplicated() []replicationTask {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var tasks []replicationTask
+	for filename, entry := range m.files {
+		replicas := m.replicationOf(entry)
+		for index, chunk := range entry.getChunks() {
+			if metadata, ok := chunk.(*ChunkMetadata); ok && metadata.Erasure.Data > 0 {
+				if task, ok := m.shardTask(filename, index, metadata); ok {
+					tasks = append(tasks, task)
+				}
+				continue
+			}
+			task := replicationTask{filename: filename, index: index, checksum: chunk.GetChecksum(),
+				checked: chunk.HasChecksum(), holders: map[int]bool{}}
+			var validCopies int
+			for _, chunkCopy := range chunk.Read() {
+				task.holders[chunkCopy.Node] = true
+				if !chunkCopy.Valid && !m.downNodes[chunkCopy.Node] {
+					task.garbage = append(task.garbage, chunkCopy)
+				}
+				if chunkCopy.Valid && !m.downNodes[chunkCopy.Node] {
+					if _, draining := m.draining[chunkCopy.Node]; draining {
+						// only a source until the chunk has enough copies elsewhere
+						task.drained = append(task.drained, chunkCopy)
+						continue
+					}
+					if validCopies == 0 {
+						task.source = chunkCopy
+					}
+					task.valid = append(task.valid, chunkCopy)
+					validCopies++
+				}
+			}
+			if validCopies == 0 && len(task.drained) > 0 {
+				task.source = task.drained[0]
+			} else if validCopies == 0 {
+				log.Printf("chunk %d of %s has no valid copy left\n", index, filename)
+				continue
+			}
+			if validCopies < replicas {
+				task.missing = replicas - validCopies
+			} else if validCopies > replicas {
+				task.excess = validCopies - replicas
+			}
+			if task.missing > 0 || task.excess > 0 || len(task.garbage) > 0 || len(task.drained) > 0 {
+				tasks = append(tasks, task)
+			}
+		}
+	}
+	return tasks
+}
+
+// nodeInfos describes the nodes for the placement policy and expects the
+// caller to hold the metadata lock.
+func (m *MasterNode) nodeInfos() []NodeInfo {
+	var nodes []NodeInfo
+	for nodeID, spaceLeft := range m.nodeMap {
+		nodes = append(nodes, NodeInfo{
+			ID:        nodeID,
+			Rack:      m.rackOf(nodeID),
+			Running:   m.isPlaceable(nodeID),
+			SpaceLeft: spaceLeft,
+		})
+	}
+	return nodes
+}
+
+// pickReplicationTarget asks the placement policy for a node that does not
+// hold a copy of the chunk yet.
+func (m *MasterNode) pickReplicationTarget(task *replicationTask) (int, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var existing []int
+	for _, chunkCopy := range task.valid {
+		existing = append(existing, chunkCopy.Node)
+	}
+	req := PlacementRequest{Writer: -1, Existing: existing, Exclude: task.holders, Count: 1, Size: task.source.Size}
+	targets := m.placement.Place(req, m.nodeInfos())
+	if len(targets) == 0 {
+		return -1, fmt.Errorf("no node available for a new copy")
+	}
+	return targets[0], nil
+}
+
+func (m *MasterNode) replicateChunk(task *replicationTask) error {
+	target, err := m.pickReplicationTarget(task)
+	if err != nil {
+		return err
+	}
+	var rmsg struct {
+		Result Copy
+		Err    string
+	}
+	msg := &Message{Command: "replicate", Args: []string{
+		strconv.Itoa(task.source.Node), strconv.Itoa(task.source.Addr), strconv.Itoa(target),
+		checksumArg(task.checksum, task.checked)}}
+	if err = m.callChunkServer(msg, &rmsg); err != nil {
+		return err
+	}
+	if len(rmsg.Err) > 0 {
+		return errors.New(rmsg.Err)
+	}
+	replica := rmsg.Result
+	task.holders[target] = true
+	task.valid = append(task.valid, replica)
+
+	// the copy is deleted after the namespace lock is released, so that
+	// clients of the file do not wait for the chunk server
+	m.namespace.Lock(task.filename)
+	if !m.hasCopy(task.filename, task.index, task.source) {
+		m.namespace.Unlock(task.filename)
+		// the file was rewritten or removed while the data was copied
+		m.deleteChunkCopy(replica)
+		return fmt.Errorf("chunk changed during replication")
+	}
+	err = m.commit(&logRecord{Op: "replicate", Args: []string{
+		task.filename, strconv.Itoa(task.index), strconv.Itoa(task.source.Node), strconv.Itoa(task.source.Addr),
+		strconv.Itoa(replica.Node), strconv.Itoa(replica.Addr), strconv.Itoa(replica.Size)}})
+	m.namespace.Unlock(task.filename)
+	if err != nil {
+		return err
+	}
+	log.Printf("replicated chunk %d of %s from node %d to node %d\n", task.index, task.filename, task.source.Node, target)
+	return nil
+}
+
+// checksumArg formats the checksum the replicate command verifies a copy
+// against, an empty argument for chunks that have none.
+func checksumArg(checksum uint32, checked bool) string {
+	if !checked {
+		return ""
+	}
+	return strconv.FormatUint(uint64(checksum), 10)
+}
+
+// hasCopy reports whether chunk index of filename still has the given copy.
+func (m *MasterNode) hasCopy(filename string, index int, chunkCopy Copy) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.findChunk(filename, index, chunkCopy) != nil
+}
+
+// findChunk expects the caller to hold the metadata lock.
+func (m *MasterNode) findChunk(filename string, index int, chunkCopy Copy) *ChunkMetadata {
+	entry, ok := m.files[filename]
+	if !ok || index >= len(entry.getChunks()) {
+		return nil
+	}
+	chunk, ok := entry.getChunks()[index].(*ChunkMetadata)
+	if !ok {
+		return nil
+	}
+	for _, c := range chunk.Copies {
+		if c.Node == chunkCopy.Node && c.Addr == chunkCopy.Addr {
+			return chunk
+		}
+	}
+	return nil
+}
+
+func (m *MasterNode) deleteChunkCopy(chunkCopy Copy) {
+	var rmsg struct {
+		Err string
+	}
+	msg := &Message{Command: "deletechunk", Args: []string{strconv.Itoa(chunkCopy.Node), strconv.Itoa(chunkCopy.Addr)}}
+	if err := m.callChunkServer(msg, &rmsg); err != nil {
+		log.Println(err.Error())
+	} else if len(rmsg.Err) > 0 {
+		log.Println(rmsg.Err)
+	}
+}
+
+// trimChunk removes invalid copies and surplus valid ones, starting with
+// those on the fullest nodes. The metadata is updated first so that readers
+// never see a deleted copy.
+func (m *MasterNode) trimChunk(task *replicationTask) error {
+	m.mutex.RLock()
+	surplus := append([]Copy(nil), task.valid...)
+	sort.Slice(surplus, func(i, j int) bool {
+		return m.nodeMap[surplus[i].Node] < m.nodeMap[surplus[j].Node]
+	})
+	m.mutex.RUnlock()
+	if task.excess > 0 {
+		surplus = append(task.garbage, surplus[:task.excess]...)
+	} else {
+		surplus = task.garbage
+	}
+
+	var trimmed []Copy
+	var err error
+	m.namespace.Lock(task.filename)
+	for _, chunkCopy := range surplus {
+		if !m.hasCopy(task.filename, task.index, chunkCopy) {
+			err = fmt.Errorf("chunk changed during trimming")
+			break
+		}
+		err = m.commit(&logRecord{Op: "trim", Args: []string{
+			task.filename, strconv.Itoa(task.index), strconv.Itoa(chunkCopy.Node), strconv.Itoa(chunkCopy.Addr)}})
+		if err != nil {
+			break
+		}
+		trimmed = append(trimmed, chunkCopy)
+	}
+	m.namespace.Unlock(task.filename)
+	for _, chunkCopy := range trimmed {
+		m.deleteChunkCopy(chunkCopy)
+		log.Printf("removed copy of chunk %d of %s from node %d\n", task.index, task.filename, chunkCopy.Node)
+	}
+	return err
+}
+
+func (m *MasterNode) applyReplicate(args []string) {
+	var values []int
+	for _, arg := range args[1:] {
+		value, _ := strconv.Atoi(arg)
+		values = append(values, value)
+	}
+	index, source := values[0], Copy{Node: values[1], Addr: values[2]}
+	replica := Copy{Node: values[3], Addr: values[4], Size: values[5], Valid: true}
+	chunk := m.findChunk(args[0], index, source)
+	if chunk == nil {
+		return
+	}
+	replica.Checksum = chunk.Checksum
+	replica.Version = chunk.Version
+	chunk.Copies = append(chunk.Copies, replica)
+	m.adjustSpace(replica.Node, -replica.Size)
+	m.updateDiskCap()
+}
+
+func (m *MasterNode) applyTrim(args []string) {
+	index, _ := strconv.Atoi(args[1])
+	nodeID, _ := strconv.Atoi(args[2])
+	addr, _ := strconv.Atoi(args[3])
+	chunk := m.findChunk(args[0], index, Copy{Node: nodeID, Addr: addr})
+	if chunk == nil {
+		return
+	}
+	for i, chunkCopy := range chunk.Copies {
+		if chunkCopy.Node == nodeID && chunkCopy.Addr == addr {
+			chunk.Copies = append(chunk.Copies[:i], chunk.Copies[i+1:]...)
+			m.adjustSpace(nodeID, chunkCopy.Size)
+			break
+		}
+	}
+	m.updateDiskCap()
+}
+
+// ReportBadCopy marks a copy that failed checksum verification as invalid.
+// The replication manager then restores the replication factor from a
+// healthy copy and removes the bad one.
+func (m *MasterNode) ReportBadCopy(filename string, index int, chunkCopy Copy) error {
+	m.namespace.Lock(filename)
+	defer m.namespace.Unlock(filename)
+	if !m.hasCopy(filename, index, chunkCopy) {
+		return fmt.Errorf("no copy of chunk %d of %s on node %d", index, filename, chunkCopy.Node)
+	}
+	log.Printf("copy of chunk %d of %s on node %d reported bad\n", index, filename, chunkCopy.Node)
+	err := m.commit(&logRecord{Op: "invalidate", Args: []string{
+		filename, strconv.Itoa(index), strconv.Itoa(chunkCopy.Node), strconv.Itoa(chunkCopy.Addr)}})
+	if err != nil {
+		return err
+	}
+	m.kickReplication()
+	return nil
+}
+
+// ReportBadChunk marks the copy stored at addr on a node as invalid. It is
+// used by the chunk scrubber, which only knows where a chunk is stored and
+// not which file it belongs to.
+func (m *MasterNode) ReportBadChunk(nodeID int, addr int) error {
+	filename, index, ok := m.locateCopy(nodeID, addr)
+	if !ok {
+		return fmt.Errorf("no chunk at address %d on node %d", addr, nodeID)
+	}
+	return m.ReportBadCopy(filename, index, Copy{Node: nodeID, Addr: addr})
+}
+
+// locateCopy returns the file and chunk index of the copy stored at addr on
+// a node.
+func (m *MasterNode) locateCopy(nodeID int, addr int) (string, int, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	for filename, entry := range m.files {
+		for index, chunk := range entry.getChunks() {
+			for _, chunkCopy := range chunk.Read() {
+				if chunkCopy.Node == nodeID && chunkCopy.Addr == addr {
+					return filename, index, true
+				}
+			}
+		}
+	}
+	return "", 0, false
+}
+
+func (m *MasterNode) applyInvalidate(args []string) {
+	index, _ := strconv.Atoi(args[1])
+	nodeID, _ := strconv.Atoi(args[2])
+	addr, _ := strconv.Atoi(args[3])
+	chunk := m.findChunk(args[0], index, Copy{Node: nodeID, Addr: addr})
+	if chunk == nil {
+		return
+	}
+	for i := range chunk.Copies {
+		if chunk.Copies[i].Node == nodeID && chunk.Copies[i].Addr == addr {
+			chunk.Copies[i].Valid = false
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScrubStat records what the scrubber found on a node.
+type ScrubStat struct {
+	Node int
+	// end of the last completed pass, zero if the node was never scanned
+	LastScan time.Time
+	// chunks scanned and corrupt chunks found in the last completed pass
+	Scanned int
+	Corrupt int
+	// corrupt chunks found since the chunk server started
+	TotalCorrupt int
+}
+
+// runScrubber verifies the chunks of every running node against their
+// stored checksums, pausing scrubInterval between passes. Corrupt copies are
+// reported to the metadata server, which re-replicates them from a healthy
+// copy before they are ever read.
+func (c *ChunkServer) runScrubber() {
+	for {
+		for id := range c.nodeList() {
+			c.scrubNode(id)
+		}
+		select {
+		case <-c.done:
+			return
+		case <-time.After(c.scrubInterval):
+		}
+	}
+}
+
+// scrubNode reads the chunks of a node at no more than scrubRate bytes per
+// second so that scanning does not starve client reads.
+func (c *ChunkServer) scrubNode(nodeID int) {
+	// remote nodes are scrubbed by their own process
+	node := c.localNode(nodeID)
+	if node == nil || !node.IsRunning() {
+		return
+	}
+	checksums := node.Checksums()
+	var addrs []int
+	for addr := range checksums {
+		addrs = append(addrs, addr)
+	}
+	sort.Ints(addrs)
+
+	var scanned, corrupt int
+	for _, addr := range addrs {
+		if !node.IsRunning() {
+			// a pass over a stopped node does not count as a scan
+			return
+		}
+		data := []byte(node.Read(addr))
+		scanned++
+		if checksum, checked := node.Checksum(addr); !verifyChunk(data, checksum, checked) {
+			if _, ok := node.Checksums()[addr]; ok {
+				corrupt++
+				log.Printf("scrubber found corrupt chunk at address %d on node %d\n", addr, nodeID)
+				c.reportBadChunk(nodeID, addr)
+			}
+		}
+		if c.scrubRate > 0 {
+			time.Sleep(time.Duration(len(data)) * time.Second / time.Duration(c.scrubRate))
+		}
+	}
+
+	c.scrubMutex.Lock()
+	defer c.scrubMutex.Unlock()
+	stat := &c.scrubStats[nodeID]
+	stat.LastScan = time.Now()
+	stat.Scanned = scanned
+	stat.Corrupt = corrupt
+	stat.TotalCorrupt += corrupt
+}
+
+// reportBadChunk tells the metadata server that the chunk stored at addr on
+// a node failed verification.
+func (c *ChunkServer) reportBadChunk(nodeID int, addr int) {
+	var rmsg struct {
+		Err string
+	}
+	msg := &Message{Command: "badchunk", Args: []string{strconv.Itoa(nodeID), strconv.Itoa(addr)}}
+	if err := c.callMetaServer(msg, &rmsg); err != nil {
+		log.Println(err.Error())
+	} else if len(rmsg.Err) > 0 {
+		log.Println(rmsg.Err)
+	}
+}
+
+func (c *ChunkServer) ScrubStats() []ScrubStat {
+	c.scrubMutex.Lock()
+	defer c.scrubMutex.Unlock()
+	return append([]ScrubStat(nil), c.scrubStats...)
+}
+
+func formatScrubStats(stats []ScrubStat) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-6s %-20s %-8s %-8s %s", "node", "last scan", "scanned", "corrupt", "total corrupt")
+	for _, stat := range stats {
+		lastScan := "never"
+		if !stat.LastScan.IsZero() {
+			lastScan = stat.LastScan.Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(&b, "\n%-6d %-20s %-8d %-8d %d", stat.Node, lastScan, stat.Scanned, stat.Corrupt, stat.TotalCorrupt)
+	}
+	return b.String()
+}
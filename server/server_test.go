@@ -1,3 +1,2310 @@
 package server
 
 // Server interface unit tests
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func freePort(t testing.TB) int {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// startTestCluster runs a metadata server, and with it the chunk server, on
+// free loopback ports and returns the metadata server address.
+func startTestCluster(t testing.TB, config map[string]interface{}) (*MasterNode, string) {
+	metaPort, chunkPort := freePort(t), freePort(t)
+	os.Setenv("META_SERVER_PORT", strconv.Itoa(metaPort))
+	os.Setenv("CHUNK_SERVER_PORT", strconv.Itoa(chunkPort))
+	config["port"] = metaPort
+	master := NewMasterServer("metadata", config)
+	go master.Run()
+
+	waitForPorts(t, metaPort, chunkPort)
+	return master, fmt.Sprintf(":%d", metaPort)
+}
+
+// waitForPorts waits until servers listen on all of the ports.
+func waitForPorts(t testing.TB, ports ...int) {
+	for _, port := range ports {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			conn, err := net.Dial("tcp", fmt.Sprintf(":%d", port))
+			if err == nil {
+				conn.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("server on port %d did not start: %v", port, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func dialSession(t testing.TB, addr string) *session {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newSession(conn)
+}
+
+func call(s *session, reply interface{}, command string, args ...string) error {
+	if err := s.encoder.Encode(&Message{Command: command, Args: args}); err != nil {
+		return err
+	}
+	return s.decoder.Decode(reply)
+}
+
+// appendOps logs a record for each op and returns the log.
+func appendOps(t *testing.T, dir string, ops ...string) *opLog {
+	oplog, err := openOpLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range ops {
+		if err := oplog.Append(&logRecord{Op: op, Args: []string{"/" + op}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return oplog
+}
+
+// replayedOps reopens the log in dir and returns the ops replayed after seq.
+func replayedOps(t *testing.T, dir string, seq uint64) ([]string, *opLog) {
+	oplog, err := openOpLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []string
+	err = oplog.Replay(seq, func(rec *logRecord) {
+		ops = append(ops, fmt.Sprintf("%d:%s", rec.Seq, rec.Op))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ops, oplog
+}
+
+func TestOpLogDropsTornTail(t *testing.T) {
+	appendBytes := func(data ...byte) func(path string) error {
+		return func(path string) error {
+			file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			_, err = file.Write(data)
+			return err
+		}
+	}
+	for _, torn := range []struct {
+		name string
+		tear func(path string) error
+		// records that survive the tear
+		kept string
+	}{
+		{"truncated record", func(path string) error {
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			return os.Truncate(path, info.Size()-3)
+		}, "1:mkdir 2:write"},
+		{"partial header", appendBytes(0, 0), "1:mkdir 2:write 3:delete"},
+		{"undecodable record", appendBytes(0, 0, 0, 4, 1, 2, 3, 4), "1:mkdir 2:write 3:delete"},
+	} {
+		dir, err := ioutil.TempDir("", "oplog")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, opLogFile)
+		oplog := appendOps(t, dir, "mkdir", "write")
+		sizes := map[int]int64{}
+		info, _ := os.Stat(path)
+		sizes[2] = info.Size()
+		if err := oplog.Append(&logRecord{Op: "delete", Args: []string{"/delete"}}); err != nil {
+			t.Fatal(err)
+		}
+		oplog.file.Close()
+		info, _ = os.Stat(path)
+		sizes[3] = info.Size()
+		if err := torn.tear(path); err != nil {
+			t.Fatal(err)
+		}
+
+		ops, oplog := replayedOps(t, dir, 0)
+		if strings.Join(ops, " ") != torn.kept {
+			t.Errorf("%s: replayed %v, expected %s", torn.name, ops, torn.kept)
+		}
+		// the torn record is cut off, so the next one follows the last intact
+		// record
+		if info, _ := os.Stat(path); info.Size() != sizes[len(ops)] {
+			t.Errorf("%s: log is %d bytes after the replay, expected %d", torn.name, info.Size(), sizes[len(ops)])
+		}
+		if err := oplog.Append(&logRecord{Op: "rename", Args: []string{"/rename", "/renamed"}}); err != nil {
+			t.Fatal(err)
+		}
+		oplog.file.Close()
+		expected := fmt.Sprintf("%s %d:rename", torn.kept, len(ops)+1)
+		if ops, _ := replayedOps(t, dir, 0); strings.Join(ops, " ") != expected {
+			t.Errorf("%s: replayed %v after appending to the repaired log, expected %s", torn.name, ops, expected)
+		}
+	}
+}
+
+func TestOpLogReplaysAfterCheckpointSeq(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oplog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oplog := appendOps(t, dir, "mkdir", "write", "append")
+	if err := oplog.SaveCheckpoint(&checkpoint{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range []string{"rename", "delete"} {
+		if err := oplog.Append(&logRecord{Op: op, Args: []string{"/" + op}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oplog.file.Close()
+
+	cp, err := oplog.LoadCheckpoint()
+	if err != nil || cp == nil || cp.Seq != 3 {
+		t.Fatalf("checkpoint %+v: %v", cp, err)
+	}
+	ops, oplog := replayedOps(t, dir, cp.Seq)
+	oplog.file.Close()
+	if strings.Join(ops, " ") != "4:rename 5:delete" {
+		t.Errorf("replayed %v after the checkpoint", ops)
+	}
+
+	// a crash between saving a checkpoint and emptying the log leaves records
+	// the checkpoint already covers, which the replay skips
+	crashed, err := ioutil.TempDir("", "oplog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(crashed)
+	appendOps(t, crashed, "mkdir", "write", "append", "rename", "delete").file.Close()
+	if ops, _ := replayedOps(t, crashed, 3); strings.Join(ops, " ") != "4:rename 5:delete" {
+		t.Errorf("replayed %v after sequence number 3", ops)
+	}
+}
+
+// metadataOf describes the files, directories, copies and nodes a metadata
+// server knows about.
+func metadataOf(m *MasterNode) string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var lines []string
+	for name, entry := range m.files {
+		line := fmt.Sprintf("file %s %d:", name, entry.GetSize())
+		for _, chunk := range entry.getChunks() {
+			line += fmt.Sprintf(" v%d %+v", chunk.GetVersion(), chunk.Read())
+		}
+		lines = append(lines, line)
+	}
+	for dir := range m.dirs {
+		lines = append(lines, "dir "+dir)
+	}
+	sort.Strings(lines)
+	return fmt.Sprintf("%s\ngarbage %+v\nnodes %v down %v", strings.Join(lines, "\n"), m.garbage, m.nodeMap, m.downNodes)
+}
+
+func TestCheckpointAndLogRecoverSameMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oplog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	master, addr := startTestCluster(t, map[string]interface{}{"metadir": dir, "chunksize": 10, "checkpointinterval": 0,
+		"heartbeatinterval": 0, "replicationinterval": 0, "gcinterval": 0, "balanceinterval": 0})
+	if err := master.Mkdir("/kept"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, addr, "/kept/a", []byte("before the checkpoint"))
+	writeFile(t, addr, "b", []byte("deleted after the checkpoint"))
+	if err := master.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, addr, "/kept/c", []byte("after the checkpoint"))
+	sendFile(t, addr, "append", "/kept/a", []byte(", appended"))
+	if err := master.Rename("/kept/a", "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := master.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := master.StopNode(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// without heartbeats the free space of the nodes is replayed too
+	recovered := NewMasterServer("metadata", map[string]interface{}{"port": 0, "metadir": dir, "heartbeatinterval": 0})
+	if got, want := metadataOf(recovered), metadataOf(master); got != want {
+		t.Errorf("recovered\n%s\nexpected\n%s", got, want)
+	}
+	if size := recovered.FileSize("/a"); size != len("before the checkpoint, appended") {
+		t.Errorf("/a recovered with %d bytes", size)
+	}
+}
+
+func TestMasterNodeConcurrentClients(t *testing.T) {
+	const clients = 200
+	dir, err := ioutil.TempDir("", "godfs-meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// no background replication, its made up chunks would be copied on the
+	// chunk servers of later tests, and no heartbeats, the free space they
+	// report would not match the made up chunks
+	master, addr := startTestCluster(t, map[string]interface{}{
+		"metadir": dir, "checkpointinterval": 0, "replicationinterval": 0, "gcinterval": 0, "heartbeatinterval": 0})
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s := dialSession(t, addr)
+			defer s.conn.Close()
+			name := fmt.Sprintf("file-%d", i)
+			renamed := fmt.Sprintf("renamed-%d", i)
+
+			var writeReply struct {
+				Result *File
+				Err    string
+			}
+			if err := call(s, &writeReply, "write", name, "10"); err != nil || len(writeReply.Err) > 0 {
+				t.Errorf("write %s: %v %s", name, err, writeReply.Err)
+				return
+			}
+			var renameReply struct {
+				Err string
+			}
+			if err := call(s, &renameReply, "rename", name, renamed); err != nil || len(renameReply.Err) > 0 {
+				t.Errorf("rename %s: %v %s", name, err, renameReply.Err)
+				return
+			}
+
+			// report the stored chunk the way the chunk server does after a
+			// write, again with a new lease if a stopnode revoked the first
+			var updateReply struct {
+				Err string
+			}
+			for attempt := 0; attempt < 3; attempt++ {
+				var leaseReply struct {
+					Result Lease
+					Err    string
+				}
+				if err := call(s, &leaseReply, "lease", renamed); err != nil || len(leaseReply.Err) > 0 {
+					t.Errorf("lease %s: %v %s", renamed, err, leaseReply.Err)
+					return
+				}
+				update := dialSession(t, addr)
+				entry := &File{Name: renamed, Chunks: []ChunkEntry{&ChunkMetadata{
+					Index:  i % 4,
+					Copies: []Copy{{Node: i % 4, Addr: i, Valid: true, Size: 10}},
+				}}}
+				leaseID := strconv.FormatUint(leaseReply.Result.ID, 10)
+				if err := update.encoder.Encode(&Message{Command: "updateFileEntry", Args: []string{renamed, leaseID}}); err != nil {
+					t.Error(err)
+				}
+				if err := update.encoder.Encode(struct{ Entry *File }{entry}); err != nil {
+					t.Error(err)
+				}
+				err := update.decoder.Decode(&updateReply)
+				update.conn.Close()
+				if err != nil {
+					t.Errorf("updateFileEntry %s: %v", renamed, err)
+				}
+				if len(updateReply.Err) == 0 {
+					break
+				}
+			}
+			if len(updateReply.Err) > 0 {
+				t.Errorf("updateFileEntry %s: %s", renamed, updateReply.Err)
+			}
+
+			var readReply struct {
+				Result *File
+				Err    string
+			}
+			if err := call(s, &readReply, "read", renamed); err != nil || len(readReply.Err) > 0 {
+				t.Errorf("read %s: %v %s", renamed, err, readReply.Err)
+			}
+			for _, command := range []string{"stat", "ls", "diskcapacity"} {
+				if err := call(s, &struct {
+					Result string
+					Err    string
+				}{}, command, renamed); err != nil {
+					t.Errorf("%s: %v", command, err)
+				}
+			}
+			if i%20 == 0 {
+				// node 3 keeps running, so leases can always be granted
+				if err := call(s, &struct {
+					Result string
+					Err    string
+				}{}, "stopnode", strconv.Itoa(i/20%3)); err != nil {
+					t.Errorf("stopnode: %v", err)
+				}
+			}
+			if i%50 == 0 {
+				if err := call(s, &struct {
+					Result string
+					Err    string
+				}{}, "checkpoint"); err != nil {
+					t.Errorf("checkpoint: %v", err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 0; i < clients; i++ {
+		name := fmt.Sprintf("renamed-%d", i)
+		for master.FileSize(name) != 10 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s was never updated, size %d", name, master.FileSize(name))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	master.mutex.RLock()
+	fileCount := len(master.files)
+	nodeMap := append([]int(nil), master.nodeMap...)
+	master.mutex.RUnlock()
+	if fileCount != clients {
+		t.Fatalf("expected %d files, found %d", clients, fileCount)
+	}
+
+	recovered := NewMasterServer("metadata", map[string]interface{}{"port": 0, "metadir": dir})
+	if len(recovered.files) != clients {
+		t.Fatalf("expected %d files after recovery, found %d", clients, len(recovered.files))
+	}
+	for i := 0; i < clients; i++ {
+		if size := recovered.FileSize(fmt.Sprintf("renamed-%d", i)); size != 10 {
+			t.Errorf("renamed-%d recovered with size %d", i, size)
+		}
+	}
+	for id := range nodeMap {
+		if recovered.nodeMap[id] != nodeMap[id] {
+			t.Errorf("node %d recovered with %d free, expected %d", id, recovered.nodeMap[id], nodeMap[id])
+		}
+	}
+}
+
+// writeFile stores data under name the way the client does.
+func writeFile(t testing.TB, addr string, name string, data []byte) {
+	sendFile(t, addr, "write", name, data)
+}
+
+// sendFile streams data to the node process holding the lease, or to the
+// chunk server, with a write or an append command and returns the reply.
+func sendFile(t testing.TB, addr string, command string, name string, data []byte) string {
+	meta := dialSession(t, addr)
+	defer meta.conn.Close()
+	var rmsg struct {
+		Result    *File
+		ChunkSize int
+		Addr      string
+		Err       string
+	}
+	if err := call(meta, &rmsg, command, name, strconv.Itoa(len(data))); err != nil || len(rmsg.Err) > 0 {
+		t.Fatalf("%s %s: %v %s", command, name, err, rmsg.Err)
+	}
+	if len(rmsg.Addr) == 0 {
+		rmsg.Addr = ":" + os.Getenv("CHUNK_SERVER_PORT")
+	}
+	chunk := dialSession(t, rmsg.Addr)
+	defer chunk.conn.Close()
+	if err := chunk.encoder.Encode(&Message{Command: command, Args: []string{name}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunk.encoder.Encode(rmsg.Result); err != nil {
+		t.Fatal(err)
+	}
+	for len(data) > 0 {
+		piece := data
+		if len(piece) > rmsg.ChunkSize {
+			piece = data[:rmsg.ChunkSize]
+		}
+		data = data[len(piece):]
+		if err := chunk.encoder.Encode(piece); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var reply struct {
+		Result string
+		Err    string
+	}
+	if err := chunk.encoder.Encode([]byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunk.decoder.Decode(&reply); err != nil || len(reply.Err) > 0 {
+		t.Fatalf("%s %s: %v %s", command, name, err, reply.Err)
+	}
+	return reply.Result
+}
+
+func validCopies(m *MasterNode, name string) []int {
+	entry, err := m.Read(name)
+	if err != nil || len(entry.getChunks()) == 0 {
+		return nil
+	}
+	var nodes []int
+	for _, chunkCopy := range entry.getChunks()[0].Read() {
+		if chunkCopy.Valid {
+			nodes = append(nodes, chunkCopy.Node)
+		}
+	}
+	return nodes
+}
+
+func TestDiskNodeReloadsChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godfs-chunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	master, addr := startTestCluster(t, map[string]interface{}{"chunkdir": dir, "chunksize": 16, "replicationinterval": 0})
+	data := "persisted across a chunk server restart"
+	writeFile(t, addr, "persisted", []byte(data))
+	entry, err := master.Read("persisted")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a chunk server started on the same directory, as after a restart
+	master.mutex.RLock()
+	config := master.chunkServerConfig()
+	master.mutex.RUnlock()
+	restarted := NewChunkServer("restarted", config)
+	for id, node := range restarted.nodeList() {
+		if err := node.Load(); err != nil {
+			t.Fatalf("load node %d: %v", id, err)
+		}
+	}
+	var read string
+	for index, chunk := range entry.getChunks() {
+		for _, chunkCopy := range chunk.Read() {
+			node := restarted.node(chunkCopy.Node)
+			if checksum := node.Checksums()[chunkCopy.Addr]; checksum != chunkCopy.Checksum {
+				t.Errorf("chunk %d on node %d reloaded with checksum %d, expected %d", index, chunkCopy.Node, checksum, chunkCopy.Checksum)
+			}
+			if got := node.Read(chunkCopy.Addr); len(got) != chunkCopy.Size {
+				t.Errorf("chunk %d on node %d reloaded with %d bytes, expected %d", index, chunkCopy.Node, len(got), chunkCopy.Size)
+			}
+		}
+		read += restarted.node(chunk.Read()[0].Node).Read(chunk.Read()[0].Addr)
+	}
+	if read != data {
+		t.Errorf("read back %q after reloading, expected %q", read, data)
+	}
+
+	removed := entry.getChunks()[0].Read()[0]
+	node := restarted.node(removed.Node)
+	size := node.GetSize()
+	if ok, err := node.Delete(removed.Addr); !ok || err != nil {
+		t.Fatalf("delete of a reloaded chunk failed: %v", err)
+	}
+	if got := node.GetSize(); got != size-removed.Size {
+		t.Errorf("node holds %d bytes after the delete, expected %d", got, size-removed.Size)
+	}
+	if _, err := os.Stat(NewDiskNode(removed.Node, dir).chunkPath(removed.Addr)); !os.IsNotExist(err) {
+		t.Errorf("chunk file was not removed: %v", err)
+	}
+
+	// the address of a deleted chunk is not handed out again after a
+	// restart, even when no chunk with a higher address is left
+	top := removed.Addr
+	for chunkAddr := range node.Checksums() {
+		if chunkAddr > top {
+			top = chunkAddr
+		}
+	}
+	if top != removed.Addr {
+		if ok, err := node.Delete(top); !ok || err != nil {
+			t.Fatalf("delete of the top chunk failed: %v", err)
+		}
+	}
+	reloaded := NewDiskNode(removed.Node, dir)
+	if err := reloaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	dataChannel := make(chan []byte, 1)
+	dataChannel <- []byte("written after the reload")
+	if written, _ := reloaded.Write(dataChannel, chunkChecksum([]byte("written after the reload"))); written <= top {
+		t.Errorf("new chunk got address %d, the deleted top chunk had %d", written, top)
+	}
+}
+
+func TestReplicationAfterStopNode(t *testing.T) {
+	master, addr := startTestCluster(t, map[string]interface{}{"nodes": 8, "replicationinterval": 1})
+	writeFile(t, addr, "replicated", []byte("some chunk data"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(validCopies(master, "replicated")) != master.REPLICAS {
+		if time.Now().After(deadline) {
+			t.Fatal("file was never written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stopped := validCopies(master, "replicated")[0]
+	if err := master.commit(&logRecord{Op: "stopnode", Args: []string{strconv.Itoa(stopped)}}); err != nil {
+		t.Fatal(err)
+	}
+	master.kickReplication()
+
+	for {
+		nodes := validCopies(master, "replicated")
+		if len(nodes) == master.REPLICAS {
+			for _, node := range nodes {
+				if node == stopped {
+					t.Fatalf("copy on stopped node %d is still valid", stopped)
+				}
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("chunk has %d valid copies, expected %d", len(nodes), master.REPLICAS)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSetReplicationConverges(t *testing.T) {
+	master, addr := startTestCluster(t, map[string]interface{}{"nodes": 8, "replicationinterval": 1})
+	writeFile(t, addr, "setrep", []byte("some chunk data"))
+
+	for _, replicas := range []int{5, 2} {
+		if err := master.SetReplication("setrep", replicas); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			entry, err := master.Read("setrep")
+			if err != nil {
+				t.Fatal(err)
+			}
+			copies := entry.getChunks()[0].Read()
+			if len(copies) == replicas && len(validCopies(master, "setrep")) == replicas {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("chunk has %d copies, %d valid, after setrep %d", len(copies), len(validCopies(master, "setrep")), replicas)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if err := master.SetReplication("setrep", 0); err == nil {
+		t.Error("replication factor 0 was accepted by setrep")
+	}
+	if _, err := master.Write("default", 0); err != nil {
+		t.Errorf("write with the default replication factor: %v", err)
+	}
+	if _, err := master.Write("toomany", 9); err == nil || !strings.Contains(err.Error(), "0 for the cluster default") {
+		t.Errorf("write with 9 replicas on 8 nodes returned %v", err)
+	}
+}
+
+func TestHDFSPlacement(t *testing.T) {
+	policy, _ := NewPlacementPolicy("hdfs")
+	nodes := simulatedNodes(3, 4, 1000)
+	for i := 0; i < 50; i++ {
+		placed := policy.Place(PlacementRequest{Writer: 5, Count: 3, Size: 100}, nodes)
+		if len(placed) != 3 || placed[0] != 5 {
+			t.Fatalf("placed %v, expected 3 copies starting on the writer", placed)
+		}
+		if nodes[placed[1]].Rack == nodes[5].Rack {
+			t.Fatalf("second copy %v is on the writer's rack", placed)
+		}
+		if nodes[placed[2]].Rack != nodes[placed[1]].Rack || placed[2] == placed[1] {
+			t.Fatalf("third copy %v is not on another node of the second copy's rack", placed)
+		}
+	}
+
+	// without a writer, and with two existing copies on one rack, the
+	// third goes to another rack
+	placed := policy.Place(PlacementRequest{Writer: -1, Existing: []int{0, 1}, Count: 1, Size: 100}, nodes)
+	if len(placed) != 1 || nodes[placed[0]].Rack == 0 {
+		t.Errorf("copy next to two on rack 0 placed on %v", placed)
+	}
+	// stopped, excluded and full nodes are skipped, even the writer
+	nodes[5].Running = false
+	nodes[6].SpaceLeft = 50
+	placed = policy.Place(PlacementRequest{Writer: 5, Exclude: map[int]bool{7: true}, Count: 12, Size: 100}, nodes)
+	if len(placed) != 9 || containsNode(placed, 5) || containsNode(placed, 6) || containsNode(placed, 7) {
+		t.Errorf("placed %v on a stopped, full or excluded node", placed)
+	}
+}
+
+func TestLeastUsedPlacement(t *testing.T) {
+	policy, _ := NewPlacementPolicy("leastused")
+	nodes := simulatedNodes(2, 3, 1000)
+	for i := range nodes {
+		nodes[i].SpaceLeft = 100 * (i + 1)
+	}
+	// the emptiest node, then the emptiest one on the other rack
+	placed := policy.Place(PlacementRequest{Writer: 0, Count: 3, Size: 100}, nodes)
+	if fmt.Sprint(placed) != "[5 2 4]" {
+		t.Errorf("placed %v, expected [5 2 4]", placed)
+	}
+	placed = policy.Place(PlacementRequest{Writer: -1, Existing: []int{5}, Count: 1, Size: 100}, nodes)
+	if fmt.Sprint(placed) != "[2]" {
+		t.Errorf("copy next to one on rack 1 placed on %v, expected [2]", placed)
+	}
+}
+
+func TestRoundRobinPlacement(t *testing.T) {
+	policy, _ := NewPlacementPolicy("roundrobin")
+	nodes := simulatedNodes(3, 2, 1000)
+	var order []int
+	for i := 0; i < 6; i++ {
+		order = append(order, policy.Place(PlacementRequest{Writer: -1, Count: 1, Size: 100}, nodes)...)
+	}
+	// every rack in turn, and the nodes of a rack in turn
+	if fmt.Sprint(order) != "[0 2 4 1 3 5]" {
+		t.Errorf("single copies placed in order %v, expected [0 2 4 1 3 5]", order)
+	}
+	placed := policy.Place(PlacementRequest{Writer: -1, Existing: []int{0}, Count: 2, Size: 100}, nodes)
+	if len(placed) != 2 || nodes[placed[0]].Rack == nodes[placed[1]].Rack || nodes[placed[0]].Rack == 0 || nodes[placed[1]].Rack == 0 {
+		t.Errorf("copies next to one on rack 0 placed on %v, expected one on each other rack", placed)
+	}
+}
+
+func TestSimulatePlacementReport(t *testing.T) {
+	policy, _ := NewPlacementPolicy("hdfs")
+	report := SimulatePlacement(policy, 4, 4, 100000, 200, 3, 100)
+	if report.UnderReplicated != 0 || report.RackSafe != 200 || report.LocalFirstCopies != 200 {
+		t.Errorf("unexpected hdfs report: %v", report)
+	}
+	if report.Overhead() != 3 || report.Tolerates != 2 {
+		t.Errorf("overhead %.2f tolerating %d failures, expected 3 and 2", report.Overhead(), report.Tolerates)
+	}
+}
+
+func TestReadSkipsCorruptCopy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godfs-chunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	master, addr := startTestCluster(t, map[string]interface{}{
+		"chunkdir": dir, "replicationinterval": 0, "scrubinterval": 0})
+	data := "some chunk data"
+	writeFile(t, addr, "verified", []byte(data))
+	entry, err := master.Read("verified")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reads of the first chunk start on its first copy
+	corrupted := entry.getChunks()[0].Read()[0]
+	path := NewDiskNode(corrupted.Node, dir).chunkPath(corrupted.Addr)
+	if err := ioutil.WriteFile(path, []byte("rotten chunk data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if content, _ := readRange(t, entry, 0, -1); content != data {
+		t.Errorf("read back %q, expected %q", content, data)
+	}
+	chunkCopy, ok := copyOn(master, "verified", corrupted.Node)
+	if !ok || chunkCopy.Valid {
+		t.Errorf("corrupt copy on node %d is still valid", corrupted.Node)
+	}
+	if len(validCopies(master, "verified")) != master.REPLICAS-1 {
+		t.Errorf("%d valid copies left, expected %d", len(validCopies(master, "verified")), master.REPLICAS-1)
+	}
+
+	// empty chunks and chunks with a zero checksum are verified too, only
+	// chunks without a checksum are not
+	if verifyChunk([]byte("x"), chunkChecksum(nil), true) {
+		t.Error("data accepted for an empty chunk")
+	}
+	if !verifyChunk(nil, chunkChecksum(nil), true) || !verifyChunk([]byte("x"), 0, false) {
+		t.Error("chunk rejected")
+	}
+}
+
+func TestReadKeepsUnreachableCopy(t *testing.T) {
+	master, addr := startTestCluster(t, map[string]interface{}{
+		"heartbeatinterval": 0, "replicationinterval": 0, "scrubinterval": 0})
+	data := "some chunk data"
+	writeFile(t, addr, "unreachable", []byte(data))
+	entry, err := master.Read("unreachable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reads of the first chunk start on its first copy, whose node counts as
+	// running but drops every read
+	unreachable := entry.getChunks()[0].Read()[0]
+	socket, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	go func() {
+		for {
+			conn, err := socket.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	chunk := dialSession(t, ":"+os.Getenv("CHUNK_SERVER_PORT"))
+	defer chunk.conn.Close()
+	var rmsg struct {
+		Err string
+	}
+	if err := call(chunk, &rmsg, "attachnode", strconv.Itoa(unreachable.Node), socket.Addr().String(), "0"); err != nil || len(rmsg.Err) > 0 {
+		t.Fatalf("attachnode: %v %s", err, rmsg.Err)
+	}
+
+	if content, _ := readRange(t, entry, 0, -1); content != data {
+		t.Errorf("read back %q, expected %q", content, data)
+	}
+	if chunkCopy, ok := copyOn(master, "unreachable", unreachable.Node); !ok || !chunkCopy.Valid {
+		t.Errorf("copy on unreachable node %d was invalidated", unreachable.Node)
+	}
+}
+
+func TestReadSkipsMissingCopy(t *testing.T) {
+	master, addr := startTestCluster(t, map[string]interface{}{
+		"heartbeatinterval": 0, "replicationinterval": 0, "scrubinterval": 0, "gcinterval": 0})
+	data := "some chunk data"
+	writeFile(t, addr, "missing", []byte(data))
+	entry, err := master.Read("missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reads of the first chunk start on its first copy, which is gone
+	missing := entry.getChunks()[0].Read()[0]
+	chunk := dialSession(t, ":"+os.Getenv("CHUNK_SERVER_PORT"))
+	defer chunk.conn.Close()
+	var rmsg struct {
+		Result []byte
+		Err    string
+	}
+	if err := call(chunk, &rmsg, "deletechunk", strconv.Itoa(missing.Node), strconv.Itoa(missing.Addr)); err != nil || len(rmsg.Err) > 0 {
+		t.Fatalf("deletechunk: %v %s", err, rmsg.Err)
+	}
+	if err := call(chunk, &rmsg, "chunkread", strconv.Itoa(missing.Node), strconv.Itoa(missing.Addr)); err != nil || !strings.Contains(rmsg.Err, "no chunk at address") {
+		t.Errorf("read of a missing chunk answered %q: %v", rmsg.Err, err)
+	}
+
+	if content, _ := readRange(t, entry, 0, -1); content != data {
+		t.Errorf("read back %q, expected %q", content, data)
+	}
+	// a missing copy failed no verification
+	if chunkCopy, ok := copyOn(master, "missing", missing.Node); !ok || !chunkCopy.Valid {
+		t.Errorf("missing copy on node %d was reported as bad", missing.Node)
+	}
+}
+
+func TestScrubberRepairsCorruptChunk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godfs-chunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	master, addr := startTestCluster(t, map[string]interface{}{
+		"nodes": 8, "chunkdir": dir, "replicationinterval": 1, "scrubinterval": 1, "scrubrate": 0})
+	writeFile(t, addr, "scrubbed", []byte("some chunk data"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(validCopies(master, "scrubbed")) != master.REPLICAS {
+		if time.Now().After(deadline) {
+			t.Fatal("file was never written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	entry, _ := master.Read("scrubbed")
+	corrupted := entry.getChunks()[0].Read()[0]
+	path := NewDiskNode(corrupted.Node, dir).chunkPath(corrupted.Addr)
+	if err := ioutil.WriteFile(path, []byte("rotten chunk data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline = time.Now().Add(10 * time.Second)
+	for {
+		entry, _ = master.Read("scrubbed")
+		var valid int
+		var found bool
+		for _, chunkCopy := range entry.getChunks()[0].Read() {
+			if chunkCopy.Node == corrupted.Node && chunkCopy.Addr == corrupted.Addr {
+				found = true
+			} else if chunkCopy.Valid {
+				valid++
+			}
+		}
+		if !found && valid == master.REPLICAS {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("corrupt copy was not replaced, found: %v valid copies: %d", found, valid)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	s := dialSession(t, ":"+os.Getenv("CHUNK_SERVER_PORT"))
+	defer s.conn.Close()
+	var rmsg struct {
+		Result string
+		Err    string
+	}
+	if err := call(s, &rmsg, "scrubstat"); err != nil || len(rmsg.Err) > 0 {
+		t.Fatalf("scrubstat: %v %s", err, rmsg.Err)
+	}
+	if !strings.Contains(rmsg.Result, "total corrupt") {
+		t.Errorf("unexpected scrubstat output %q", rmsg.Result)
+	}
+}
+
+func TestDirectoryNamespace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godfs-meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	master := NewMasterServer("metadata", map[string]interface{}{"port": 0, "metadir": dir, "checkpointinterval": 0})
+
+	if err := master.Mkdir("/logs/old"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"logs/a.txt", "/logs//old/b.txt", "/top.txt"} {
+		if _, err := master.Write(name, 0); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	if _, err := master.Write("/logs", 0); err == nil {
+		t.Error("writing over a directory succeeded")
+	}
+	if err := master.Mkdir("/top.txt/sub"); err == nil {
+		t.Error("created a directory below a file")
+	}
+	if err := master.Rmdir("/logs"); err == nil {
+		t.Error("removed a directory that is not empty")
+	}
+	if err := master.Rename("/logs", "/logs/old/inner"); err == nil {
+		t.Error("moved a directory into itself")
+	}
+
+	listing := func(m *MasterNode, dir string) string {
+		entries, err := m.ListDir(dir)
+		if err != nil {
+			t.Fatalf("ls %s: %v", dir, err)
+		}
+		return formatDirEntries(entries)
+	}
+	if got := listing(master, "/"); got != "logs/  top.txt  " {
+		t.Errorf("unexpected listing of /: %q", got)
+	}
+	if err := master.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := master.Mkdir("/archive"); err != nil {
+		t.Fatal(err)
+	}
+	// moving onto a directory moves into it
+	if err := master.Rename("/logs", "/archive"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := master.Read("/archive/logs/old/b.txt"); err != nil {
+		t.Errorf("file was not moved with its directory: %v", err)
+	}
+	if _, err := master.Read("/logs/a.txt"); err == nil {
+		t.Error("file is still readable at its old path")
+	}
+	if err := master.Rename("/archive/logs/old/b.txt", "/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := master.Rmdir("/archive/logs/old"); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered := NewMasterServer("metadata", map[string]interface{}{"port": 0, "metadir": dir})
+	for _, dir := range []string{"/", "/archive", "/archive/logs"} {
+		if got, want := listing(recovered, dir), listing(master, dir); got != want {
+			t.Errorf("%s recovered as %q, expected %q", dir, got, want)
+		}
+	}
+	entry, err := recovered.Read("/archive/logs/a.txt")
+	if err != nil || entry.GetName() != "/archive/logs/a.txt" {
+		t.Errorf("moved file recovered as %v: %v", entry, err)
+	}
+}
+
+func TestDeleteReclaimsSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godfs-chunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	master, addr := startTestCluster(t, map[string]interface{}{"chunkdir": dir, "gcinterval": 1, "heartbeatinterval": 0})
+	writeFile(t, addr, "/tmp/deleted", []byte("some chunk data"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(validCopies(master, "/tmp/deleted")) != master.REPLICAS {
+		if time.Now().After(deadline) {
+			t.Fatal("file was never written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := master.Delete("/tmp/deleted"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := master.Read("/tmp/deleted"); err == nil {
+		t.Error("deleted file is still readable")
+	}
+	if err := master.Delete("/tmp"); err == nil {
+		t.Error("deleted a directory")
+	}
+
+	for {
+		master.mutex.RLock()
+		pending := len(master.garbage)
+		diskCap := master.diskCap
+		master.mutex.RUnlock()
+		if pending == 0 {
+			if diskCap != master.ROW*DEFAULT_ALLOCATED_DISKSPACE {
+				t.Errorf("disk capacity is %d after reclaiming, expected %d", diskCap, master.ROW*DEFAULT_ALLOCATED_DISKSPACE)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d chunk copies were never reclaimed", pending)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	chunkFiles, _ := filepath.Glob(filepath.Join(dir, "*", "*"+chunkFileExt))
+	if len(chunkFiles) > 0 {
+		t.Errorf("chunk files left on disk: %v", chunkFiles)
+	}
+}
+
+func TestStreamingWriteSplitsChunks(t *testing.T) {
+	master, addr := startTestCluster(t, map[string]interface{}{"chunksize": 16})
+	data := []byte(strings.Repeat("0123456789", 10))
+	writeFile(t, addr, "streamed", data)
+
+	entry, err := master.Read("streamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := entry.getChunks()
+	if len(chunks) != 7 || entry.GetSize() != len(data) {
+		t.Fatalf("expected 7 chunks and %d bytes, got %d chunks and %d bytes", len(data), len(chunks), entry.GetSize())
+	}
+	for index, chunk := range chunks {
+		if chunk.Id() != index {
+			t.Errorf("chunk %d has index %d", index, chunk.Id())
+		}
+	}
+
+	if content, pieces := readRange(t, entry, 0, -1); content != string(data) || pieces != 7 {
+		t.Errorf("read back %q in %d pieces", content, pieces)
+	}
+}
+
+// readRange reads a byte range of entry from the chunk server and returns
+// it with the number of pieces it was streamed in.
+func readRange(t testing.TB, entry FileEntry, offset int, length int) (string, int) {
+	s := dialSession(t, ":"+os.Getenv("CHUNK_SERVER_PORT"))
+	defer s.conn.Close()
+	msg := &Message{Command: "read", Args: []string{entry.GetName(), strconv.Itoa(offset), strconv.Itoa(length)}}
+	if err := s.encoder.Encode(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.encoder.Encode(entry); err != nil {
+		t.Fatal(err)
+	}
+	var content string
+	var pieces int
+	for {
+		var piece ReadPiece
+		if err := s.decoder.Decode(&piece); err != nil {
+			t.Fatal(err)
+		}
+		if len(piece.Err) > 0 {
+			t.Fatal(piece.Err)
+		}
+		if len(piece.Data) == 0 {
+			return content, pieces
+		}
+		content += string(piece.Data)
+		pieces++
+	}
+}
+
+func TestRangedRead(t *testing.T) {
+	master, addr := startTestCluster(t, map[string]interface{}{"chunksize": 10})
+	data := "aaaaaaaaaabbbbbbbbbbccccccccccdddd"
+	writeFile(t, addr, "ranged", []byte(data))
+	entry, err := master.Read("ranged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		offset, length, pieces int
+	}{
+		{0, -1, 4},
+		{0, 10, 1},
+		{5, 10, 2},
+		{12, 3, 1},
+		{25, -1, 2},
+		{30, 100, 1},
+		{34, -1, 0},
+	} {
+		want := data[tc.offset:]
+		if tc.length >= 0 && tc.offset+tc.length < len(data) {
+			want = data[tc.offset : tc.offset+tc.length]
+		}
+		content, pieces := readRange(t, entry, tc.offset, tc.length)
+		if content != want || pieces != tc.pieces {
+			t.Errorf("read of %d bytes at %d returned %q in %d pieces, expected %q in %d", tc.length, tc.offset, content, pieces, want, tc.pieces)
+		}
+	}
+}
+
+// slowNode delays every read, standing in for a busy disk or a remote node.
+type slowNode struct {
+	DataNode
+	delay time.Duration
+}
+
+func (n *slowNode) Read(addr int) string {
+	time.Sleep(n.delay)
+	return n.DataNode.Read(addr)
+}
+
+// newReadServer returns a chunk server whose nodes answer reads after the
+// given delays, and the fetches for a file of chunks with a copy on every
+// node.
+func newReadServer(t testing.TB, concurrency int, delays []time.Duration, chunks int) (*ChunkServer, []chunkFetch, string) {
+	c := NewChunkServer("chunk", map[string]interface{}{
+		"nodes": len(delays), "NO_PER_RACK": 4, "chunksize": 10, "readconcurrency": concurrency, "hedgedelay": 5})
+	for id, delay := range delays {
+		c.nodes[id] = &slowNode{DataNode: c.nodes[id], delay: delay}
+	}
+	var fetches []chunkFetch
+	var content string
+	for index := 0; index < chunks; index++ {
+		data := []byte(fmt.Sprintf("chunk%05d", index))
+		content += string(data)
+		var copies []Copy
+		for id := range delays {
+			dataChannel := make(chan []byte, 1)
+			dataChannel <- data
+			copies = append(copies, c.hanleDataWrite(id, dataChannel, chunkChecksum(data)))
+		}
+		entry := &ChunkMetadata{Index: index, Copies: copies, Checksum: chunkChecksum(data), Checked: true}
+		fetches = append(fetches, chunkFetch{index: index, entry: entry, high: len(data)})
+	}
+	return c, fetches, content
+}
+
+func fetchAll(t testing.TB, c *ChunkServer, fetches []chunkFetch) string {
+	var content string
+	c.fetchChunks("file", fetches, func(fetch chunkFetch, data []byte, err error) bool {
+		if err != nil {
+			t.Fatal(err)
+		}
+		content += string(data)
+		return true
+	})
+	return content
+}
+
+func TestParallelReadKeepsOrder(t *testing.T) {
+	delays := []time.Duration{3 * time.Millisecond, 0, time.Millisecond}
+	c, fetches, want := newReadServer(t, 8, delays, 50)
+	if got := fetchAll(t, c, fetches); got != want {
+		t.Errorf("chunks came out of order: %q", got)
+	}
+}
+
+func TestHedgedReadAvoidsSlowNode(t *testing.T) {
+	c, fetches, want := newReadServer(t, 1, []time.Duration{time.Second, 0, 0}, 3)
+	start := time.Now()
+	if got := fetchAll(t, c, fetches); got != want {
+		t.Errorf("read %q, expected %q", got, want)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("read waited %v for the slow node", elapsed)
+	}
+}
+
+func benchmarkRead(b *testing.B, concurrency int) {
+	delays := []time.Duration{time.Millisecond, time.Millisecond, time.Millisecond}
+	c, fetches, want := newReadServer(b, concurrency, delays, 32)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if got := fetchAll(b, c, fetches); got != want {
+			b.Fatal("unexpected content")
+		}
+	}
+}
+
+// BenchmarkReadSequential matches the old loop that read one chunk at a time.
+func BenchmarkReadSequential(b *testing.B) {
+	benchmarkRead(b, 1)
+}
+
+func BenchmarkReadParallel(b *testing.B) {
+	benchmarkRead(b, 8)
+}
+
+func TestAppendFillsLastChunk(t *testing.T) {
+	master, addr := startTestCluster(t, map[string]interface{}{"chunksize": 10, "gcinterval": 0})
+	writeFile(t, addr, "log", []byte("abcdefghijklm"))
+	result := sendFile(t, addr, "append", "log", []byte("0123456789xy"))
+	if !strings.HasSuffix(result, "at offset 13") {
+		t.Errorf("unexpected append result %q", result)
+	}
+	sendFile(t, addr, "append", "log", []byte("z"))
+
+	entry, err := master.Read("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sizes []int
+	for index, chunk := range entry.getChunks() {
+		sizes = append(sizes, chunk.Size())
+		if chunk.Id() != index {
+			t.Errorf("chunk %d has index %d", index, chunk.Id())
+		}
+	}
+	if fmt.Sprint(sizes) != "[10 10 6]" || entry.GetSize() != 26 {
+		t.Errorf("unexpected chunk sizes %v for %d bytes", sizes, entry.GetSize())
+	}
+	if content, _ := readRange(t, entry, 0, -1); content != "abcdefghijklm0123456789xyz" {
+		t.Errorf("read back %q", content)
+	}
+
+	master.mutex.RLock()
+	garbage := len(master.garbage)
+	master.mutex.RUnlock()
+	// the rewritten last chunks of both appends wait for the garbage collector
+	if garbage != 2*master.REPLICAS {
+		t.Errorf("expected %d replaced copies, found %d", 2*master.REPLICAS, garbage)
+	}
+
+	// the space check counts the copies of the file, not the cluster default
+	if _, err := master.Write("single", 1); err != nil {
+		t.Fatal(err)
+	}
+	s := dialSession(t, addr)
+	defer s.conn.Close()
+	var rmsg struct {
+		Err string
+	}
+	size := strconv.Itoa(master.GetDiskCap() / 2)
+	if err := call(s, &rmsg, "append", "single", size); err != nil || len(rmsg.Err) > 0 {
+		t.Errorf("append of %s bytes to a file with one copy: %v %s", size, err, rmsg.Err)
+	}
+	if err := call(s, &rmsg, "append", "log", size); err != nil || len(rmsg.Err) == 0 {
+		t.Errorf("append of %s bytes to a file with %d copies was accepted", size, master.REPLICAS)
+	}
+}
+
+func TestConcurrentRecordAppend(t *testing.T) {
+	const writers, records, chunkSize = 20, 5, 32
+	master, addr := startTestCluster(t, map[string]interface{}{"chunksize": chunkSize, "gcinterval": 0})
+	writeFile(t, addr, "shared.log", nil)
+
+	type appended struct {
+		record string
+		offset int
+	}
+	results := make(chan appended, writers*records)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			s := dialSession(t, ":"+os.Getenv("CHUNK_SERVER_PORT"))
+			defer s.conn.Close()
+			for r := 0; r < records; r++ {
+				// records of different lengths so that some hit a chunk boundary
+				record := fmt.Sprintf("<%d:%d%s>", w, r, strings.Repeat(".", (w+r)%7))
+				var rmsg struct {
+					Result int
+					Err    string
+				}
+				if err := s.encoder.Encode(&Message{Command: "recordappend", Args: []string{"shared.log"}}); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := s.encoder.Encode([]byte(record)); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := s.decoder.Decode(&rmsg); err != nil || len(rmsg.Err) > 0 {
+					t.Errorf("record append: %v %s", err, rmsg.Err)
+					return
+				}
+				results <- appended{record, rmsg.Result}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(results)
+
+	entry, err := master.Read("shared.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := readRange(t, entry, 0, -1)
+	offsets := map[int]bool{}
+	for result := range results {
+		end := result.offset + len(result.record)
+		if end > len(content) || content[result.offset:end] != result.record {
+			t.Errorf("record %s not found at offset %d", result.record, result.offset)
+		}
+		if result.offset/chunkSize != (end-1)/chunkSize {
+			t.Errorf("record %s at offset %d straddles a chunk boundary", result.record, result.offset)
+		}
+		if offsets[result.offset] {
+			t.Errorf("offset %d handed out twice", result.offset)
+		}
+		offsets[result.offset] = true
+	}
+	if len(offsets) != writers*records {
+		t.Errorf("expected %d records, got %d", writers*records, len(offsets))
+	}
+}
+
+func TestLeaseRevokedOnStopNode(t *testing.T) {
+	master, addr := startTestCluster(t, map[string]interface{}{"chunksize": 10, "gcinterval": 0, "replicationinterval": 0})
+	writeFile(t, addr, "leased", []byte("abc"))
+
+	lease, err := master.GrantLease("leased")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holders := validCopies(master, "leased"); len(holders) == 0 || !containsNode(holders, lease.Primary) {
+		t.Errorf("primary %d holds no copy of the last chunk, copies on %v", lease.Primary, holders)
+	}
+	if extended, err := master.GrantLease("leased"); err != nil || extended.ID != lease.ID || !extended.Expires.After(lease.Expires) {
+		t.Errorf("lease %d was not extended: %+v %v", lease.ID, extended, err)
+	}
+
+	if err := master.commit(&logRecord{Op: "stopnode", Args: []string{strconv.Itoa(lease.Primary)}}); err != nil {
+		t.Fatal(err)
+	}
+	// a mutation still running under the revoked lease must not commit
+	if _, err := master.CommitAppend("leased", 0, 1, 0, lease.ID, &File{Name: "leased"}); err == nil {
+		t.Error("append under a revoked lease was accepted")
+	}
+	renewed, err := master.GrantLease("leased")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.ID == lease.ID || renewed.Primary == lease.Primary {
+		t.Errorf("lease on a stopped node was handed out again: %+v", renewed)
+	}
+
+	master.mutex.Lock()
+	master.leases["/leased"].Expires = time.Now().Add(-time.Second)
+	master.mutex.Unlock()
+	if expired, err := master.GrantLease("leased"); err != nil || expired.ID == renewed.ID {
+		t.Errorf("expired lease %d was handed out again: %+v %v", renewed.ID, expired, err)
+	}
+
+	sendFile(t, addr, "append", "leased", []byte("defghijklmn"))
+	entry, err := master.Read("leased")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := readRange(t, entry, 0, -1); content != "abcdefghijklmn" {
+		t.Errorf("read back %q", content)
+	}
+}
+
+func containsNode(nodes []int, nodeID int) bool {
+	for _, node := range nodes {
+		if node == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+func TestStaleCopyAfterStopNode(t *testing.T) {
+	master, addr := startTestCluster(t, map[string]interface{}{"chunksize": 10, "gcinterval": 0, "replicationinterval": 0})
+	writeFile(t, addr, "versioned", []byte("abcdefghijklm"))
+	before, err := master.Read("versioned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := before.getChunks()[1].Read()[0]
+	if stale.Version != 1 {
+		t.Fatalf("written copy has version %d", stale.Version)
+	}
+
+	if err := master.commit(&logRecord{Op: "stopnode", Args: []string{strconv.Itoa(stale.Node)}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := master.GrantLease("versioned"); err != nil {
+		t.Fatal(err)
+	}
+	entry, _ := master.Read("versioned")
+	first, last := entry.getChunks()[0], entry.getChunks()[1]
+	if first.GetVersion() != 1 || last.GetVersion() != 2 {
+		t.Errorf("chunk versions are %d and %d after a new lease", first.GetVersion(), last.GetVersion())
+	}
+	for _, chunkCopy := range last.Read() {
+		if chunkCopy.Node == stale.Node || chunkCopy.Version != 2 {
+			t.Errorf("unexpected copy %+v of the last chunk", chunkCopy)
+		}
+	}
+	master.mutex.RLock()
+	garbage := append([]Copy(nil), master.garbage...)
+	master.mutex.RUnlock()
+	if len(garbage) != 1 || garbage[0].Node != stale.Node || garbage[0].Addr != stale.Addr {
+		t.Errorf("stale copy was not left to the garbage collector: %v", garbage)
+	}
+
+	// the chunk server never reads the stale copy, even when asked to
+	last.(*ChunkMetadata).Copies = []Copy{stale}
+	s := dialSession(t, ":"+os.Getenv("CHUNK_SERVER_PORT"))
+	defer s.conn.Close()
+	if err := s.encoder.Encode(&Message{Command: "read", Args: []string{"versioned", "10", "-1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.encoder.Encode(entry); err != nil {
+		t.Fatal(err)
+	}
+	var piece ReadPiece
+	if err := s.decoder.Decode(&piece); err != nil || len(piece.Err) == 0 {
+		t.Errorf("stale copy was read: %q %v", piece.Data, err)
+	}
+
+	sendFile(t, addr, "append", "versioned", []byte("n"))
+	entry, _ = master.Read("versioned")
+	if version := entry.getChunks()[1].GetVersion(); version != 3 {
+		t.Errorf("appended chunk has version %d", version)
+	}
+	if content, _ := readRange(t, entry, 0, -1); content != "abcdefghijklmn" {
+		t.Errorf("read back %q", content)
+	}
+}
+
+func copyOn(m *MasterNode, name string, nodeID int) (Copy, bool) {
+	entry, err := m.Read(name)
+	if err != nil {
+		return Copy{}, false
+	}
+	for _, chunkCopy := range entry.getChunks()[0].Read() {
+		if chunkCopy.Node == nodeID {
+			return chunkCopy, true
+		}
+	}
+	return Copy{}, false
+}
+
+func TestStartNodeReconcilesCopies(t *testing.T) {
+	// every node holds a copy of every chunk
+	master, addr := startTestCluster(t, map[string]interface{}{
+		"replicas": 4, "gcinterval": 0, "replicationinterval": 0, "heartbeatinterval": 0})
+	for _, name := range []string{"kept", "stale", "lost"} {
+		writeFile(t, addr, name, []byte("data of "+name))
+	}
+	const stopped = 1
+	chunk := dialSession(t, ":"+os.Getenv("CHUNK_SERVER_PORT"))
+	defer chunk.conn.Close()
+	var rmsg struct {
+		Result string
+		Err    string
+	}
+	if err := master.commit(&logRecord{Op: "stopnode", Args: []string{strconv.Itoa(stopped)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := call(chunk, &rmsg, "killnode", strconv.Itoa(stopped)); err != nil || len(rmsg.Err) > 0 {
+		t.Fatalf("killnode: %v %s", err, rmsg.Err)
+	}
+
+	// a new lease while the node is down makes its copy stale
+	master.mutex.Lock()
+	master.leases["/stale"].Expires = time.Now()
+	master.mutex.Unlock()
+	if _, err := master.GrantLease("stale"); err != nil {
+		t.Fatal(err)
+	}
+	lost, _ := copyOn(master, "lost", stopped)
+	if err := call(chunk, &rmsg, "deletechunk", strconv.Itoa(stopped), strconv.Itoa(lost.Addr)); err != nil || len(rmsg.Err) > 0 {
+		t.Fatalf("deletechunk: %v %s", err, rmsg.Err)
+	}
+	if kept, _ := copyOn(master, "kept", stopped); kept.Valid {
+		t.Fatal("copy on a stopped node is still valid")
+	}
+
+	if err := call(chunk, &rmsg, "startnode", strconv.Itoa(stopped)); err != nil || len(rmsg.Err) > 0 {
+		t.Fatalf("startnode: %v %s", err, rmsg.Err)
+	}
+	if rmsg.Result != "node 1 is running with 1 valid chunk copies" {
+		t.Errorf("unexpected startnode result %q", rmsg.Result)
+	}
+	if kept, ok := copyOn(master, "kept", stopped); !ok || !kept.Valid {
+		t.Errorf("current copy was not revalidated: %+v", kept)
+	}
+	for _, name := range []string{"stale", "lost"} {
+		if chunkCopy, ok := copyOn(master, name, stopped); ok {
+			t.Errorf("copy %+v of %s was kept", chunkCopy, name)
+		}
+	}
+	master.mutex.RLock()
+	downNodes, free := len(master.downNodes), master.nodeMap[stopped]
+	master.mutex.RUnlock()
+	if downNodes != 0 {
+		t.Errorf("%d nodes still down", downNodes)
+	}
+	// the lost copy gave its space back, the stale one waits for the garbage collector
+	if expected := DEFAULT_ALLOCATED_DISKSPACE - len("data of kept") - len("data of stale"); free != expected {
+		t.Errorf("node %d has %d free, expected %d", stopped, free, expected)
+	}
+
+	if err := call(chunk, &rmsg, "startnode", strconv.Itoa(stopped)); err != nil || len(rmsg.Err) == 0 {
+		t.Errorf("started a running node: %v %q", err, rmsg.Result)
+	}
+	rmsg.Err = ""
+	if err := call(chunk, &rmsg, "restartnode", strconv.Itoa(stopped)); err != nil || len(rmsg.Err) > 0 {
+		t.Errorf("restartnode: %v %s", err, rmsg.Err)
+	}
+}
+
+func TestAppendDuringOutageKeepsLastChunk(t *testing.T) {
+	master, addr := startTestCluster(t, map[string]interface{}{
+		"replicas": 1, "gcinterval": 0, "replicationinterval": 0, "heartbeatinterval": 0})
+	writeFile(t, addr, "outage", []byte("before"))
+	stopped := validCopies(master, "outage")[0]
+	if err := master.StopNode(stopped); err != nil {
+		t.Fatal(err)
+	}
+	chunk := dialSession(t, ":"+os.Getenv("CHUNK_SERVER_PORT"))
+	defer chunk.conn.Close()
+	var rmsg struct {
+		Result string
+		Err    string
+	}
+	if err := call(chunk, &rmsg, "killnode", strconv.Itoa(stopped)); err != nil || len(rmsg.Err) > 0 {
+		t.Fatalf("killnode: %v %s", err, rmsg.Err)
+	}
+
+	// the only copy of the last chunk is on the stopped node
+	if _, err := master.GrantLease("outage"); err == nil {
+		t.Error("granted a lease without a current copy of the last chunk")
+	}
+	var appended struct {
+		Result int
+		Err    string
+	}
+	if err := chunk.encoder.Encode(&Message{Command: "recordappend", Args: []string{"outage"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunk.encoder.Encode([]byte("during")); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunk.decoder.Decode(&appended); err != nil || len(appended.Err) == 0 {
+		t.Errorf("record append during the outage answered %+v: %v", appended, err)
+	}
+	master.mutex.RLock()
+	garbage := len(master.garbage)
+	master.mutex.RUnlock()
+	if _, ok := copyOn(master, "outage", stopped); !ok || garbage > 0 {
+		t.Fatalf("copy on the stopped node was dropped, %d copies in the garbage list", garbage)
+	}
+
+	if err := call(chunk, &rmsg, "startnode", strconv.Itoa(stopped)); err != nil || len(rmsg.Err) > 0 {
+		t.Fatalf("startnode: %v %s", err, rmsg.Err)
+	}
+	if chunkCopy, ok := copyOn(master, "outage", stopped); !ok || !chunkCopy.Valid {
+		t.Fatalf("copy was not revalidated: %+v", chunkCopy)
+	}
+	sendFile(t, addr, "append", "outage", []byte(" after"))
+	entry, err := master.Read("outage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := readRange(t, entry, 0, -1); content != "before after" {
+		t.Errorf("read back %q", content)
+	}
+}
+
+func TestStopNodeFailureInjection(t *testing.T) {
+	master, addr := startTestCluster(t, map[string]interface{}{"nodes": 8, "replicationinterval": 0})
+	s := dialSession(t, addr)
+	defer s.conn.Close()
+	stop := func(command string, args ...string) (string, string) {
+		var rmsg struct {
+			Result string
+			Err    string
+		}
+		if err := call(s, &rmsg, command, args...); err != nil {
+			t.Fatal(err)
+		}
+		return rmsg.Result, rmsg.Err
+	}
+
+	if nodes, err := stop("stopnode", "7"); nodes != "7" || len(err) > 0 {
+		t.Errorf("stopnode 7 stopped %q: %s", nodes, err)
+	}
+	if _, err := stop("stopnode", "7"); len(err) == 0 {
+		t.Error("stopped node 7 twice")
+	}
+	if nodes, err := stop("stoprack", "1"); nodes != "4,5,6" || len(err) > 0 {
+		t.Errorf("stoprack 1 stopped %q: %s", nodes, err)
+	}
+	if _, err := stop("stoprack", "2"); len(err) == 0 {
+		t.Error("stopped a rack that does not exist")
+	}
+
+	// the same seed picks the same nodes
+	nodes, err := master.StopRandomNodes(2, 42)
+	if err != nil || len(nodes) != 2 {
+		t.Fatalf("stopped %v: %v", nodes, err)
+	}
+	for _, nodeID := range nodes {
+		if nodeID > 3 {
+			t.Errorf("picked node %d, which was already down", nodeID)
+		}
+	}
+	master.mutex.Lock()
+	for _, nodeID := range nodes {
+		delete(master.downNodes, nodeID)
+	}
+	master.mutex.Unlock()
+	if again, _ := stop("stopnode", "--count", "2", "42"); again != formatNodeIDs(nodes) {
+		t.Errorf("seed 42 stopped %s, then %v", again, nodes)
+	}
+	if _, err := stop("stopnode", "--count", "3"); len(err) == 0 {
+		t.Error("stopped more nodes than are running")
+	}
+	if nodes, err := stop("stopnode", "--count", "2"); len(strings.Split(nodes, ",")) != 2 || len(err) > 0 {
+		t.Errorf("stopnode --count 2 stopped %q: %s", nodes, err)
+	}
+	master.mutex.RLock()
+	down := len(master.downNodes)
+	master.mutex.RUnlock()
+	if down != master.ROW {
+		t.Errorf("%d of %d nodes are down", down, master.ROW)
+	}
+}
+
+func TestHeartbeatDetectsDeadNode(t *testing.T) {
+	master, addr := startTestCluster(t, map[string]interface{}{
+		"chunksize": 10, "heartbeatinterval": 20, "heartbeatmisses": 3, "replicationinterval": 0})
+	writeFile(t, addr, "beating", []byte("0123456789"))
+	dead := validCopies(master, "beating")[0]
+
+	// the free space comes from the reports, not from the bookkeeping
+	master.mutex.Lock()
+	master.nodeMap[dead] = 0
+	master.mutex.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		master.mutex.RLock()
+		free := master.nodeMap[dead]
+		beat := master.heartbeats[dead]
+		master.mutex.RUnlock()
+		if free == DEFAULT_ALLOCATED_DISKSPACE-10 && beat.Chunks == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("node %d reported %+v, free space %d", dead, beat, free)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	chunk := dialSession(t, ":"+os.Getenv("CHUNK_SERVER_PORT"))
+	defer chunk.conn.Close()
+	var rmsg struct {
+		Result string
+		Err    string
+	}
+	if err := call(chunk, &rmsg, "killnode", strconv.Itoa(dead)); err != nil || len(rmsg.Err) > 0 {
+		t.Fatalf("killnode: %v %s", err, rmsg.Err)
+	}
+	for containsNode(validCopies(master, "beating"), dead) {
+		if time.Now().After(deadline) {
+			t.Fatalf("node %d was never detected as dead", dead)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	master.mutex.RLock()
+	down := len(master.downNodes)
+	master.mutex.RUnlock()
+	if down != 1 {
+		t.Errorf("%d nodes marked as dead, expected only node %d", down, dead)
+	}
+	if stat := master.nodeStatByID(dead); !strings.HasSuffix(stat, "stopped") {
+		t.Errorf("unexpected node stat %q", stat)
+	}
+}
+
+func TestHeartbeatRejoinsTimedOutNode(t *testing.T) {
+	master, addr := startTestCluster(t, map[string]interface{}{
+		"chunksize": 10, "heartbeatinterval": 20, "heartbeatmisses": 1000, "replicationinterval": 0})
+	writeFile(t, addr, "blip", []byte("0123456789"))
+	nodes := validCopies(master, "blip")
+	timedOut, stopped := nodes[0], nodes[1]
+
+	// what the failure detector does for a node whose heartbeats were lost
+	if err := master.stopNodes([]int{timedOut}); err != nil {
+		t.Fatal(err)
+	}
+	master.mutex.Lock()
+	master.missedHeartbeats[timedOut] = true
+	master.mutex.Unlock()
+	if err := master.StopNode(stopped); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !containsNode(validCopies(master, "blip"), timedOut) {
+		if time.Now().After(deadline) {
+			t.Fatalf("node %d never rejoined after its heartbeats resumed", timedOut)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// a few more heartbeats of the node stopped by hand
+	time.Sleep(100 * time.Millisecond)
+	master.mutex.RLock()
+	defer master.mutex.RUnlock()
+	if master.downNodes[timedOut] || master.missedHeartbeats[timedOut] {
+		t.Errorf("node %d is still marked as timed out", timedOut)
+	}
+	if !master.downNodes[stopped] {
+		t.Errorf("node %d stopped with stopnode rejoined without startnode", stopped)
+	}
+}
+
+func TestHeartbeatSpaceNotCountedTwice(t *testing.T) {
+	master, addr := startTestCluster(t, map[string]interface{}{"heartbeatinterval": 60000, "gcinterval": 1})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		master.mutex.RLock()
+		beats := len(master.heartbeats)
+		master.mutex.RUnlock()
+		if beats == master.ROW {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d of %d nodes sent a heartbeat", beats, master.ROW)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	writeFile(t, addr, "reported", []byte("some chunk data"))
+	master.mutex.RLock()
+	for nodeID, free := range master.nodeMap {
+		if free != DEFAULT_ALLOCATED_DISKSPACE {
+			t.Errorf("node %d has %d free before its next heartbeat, expected %d", nodeID, free, DEFAULT_ALLOCATED_DISKSPACE)
+		}
+	}
+	master.mutex.RUnlock()
+
+	// the nodes report the space of the copies before they are reclaimed
+	const reported = 1000
+	for nodeID := 0; nodeID < master.ROW; nodeID++ {
+		if _, err := master.Heartbeat(NodeHeartbeat{Node: nodeID, Free: reported}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := master.Delete("reported"); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		master.mutex.RLock()
+		pending := len(master.garbage)
+		master.mutex.RUnlock()
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d chunk copies were never reclaimed", pending)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	master.mutex.RLock()
+	defer master.mutex.RUnlock()
+	for nodeID, free := range master.nodeMap {
+		if free != reported {
+			t.Errorf("node %d has %d free after reclaiming, expected the reported %d", nodeID, free, reported)
+		}
+	}
+}
+
+func TestChunkNodeProcess(t *testing.T) {
+	master, addr := startTestCluster(t, map[string]interface{}{
+		"chunksize": 10, "heartbeatinterval": 0, "replicationinterval": 0, "gcinterval": 0})
+	node, err := NewChunkNode("chunk node", map[string]interface{}{"id": 1, "rack": 5, "master": addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go node.Run()
+	defer node.Close()
+	master.mutex.RLock()
+	member, rack := master.members[1], master.rackOf(1)
+	master.mutex.RUnlock()
+	if member.Addr != node.addr || rack != 5 {
+		t.Fatalf("node 1 joined as %+v on rack %d", member, rack)
+	}
+
+	// with the other nodes stopped the node process holds the lease, so the
+	// write goes straight to it
+	for _, nodeID := range []int{0, 2, 3} {
+		if err := master.StopNode(nodeID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := "written to a node process"
+	writeFile(t, addr, "direct", []byte(data))
+	master.mutex.RLock()
+	lease := master.leases["/direct"]
+	master.mutex.RUnlock()
+	if lease == nil || lease.Primary != 1 {
+		t.Fatalf("lease on /direct is %+v", lease)
+	}
+	entry, err := master.Read("direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	held := node.localNode(1).Checksums()
+	for _, chunk := range entry.getChunks() {
+		var stored bool
+		for _, chunkCopy := range chunk.Read() {
+			stored = stored || chunkCopy.Node == 1 && held[chunkCopy.Addr] == chunk.GetChecksum()
+		}
+		if !stored {
+			t.Fatalf("chunk %d has no copy in the node process", chunk.Id())
+		}
+	}
+
+	meta := dialSession(t, addr)
+	defer meta.conn.Close()
+	var rmsg struct {
+		Result *File
+		Addr   string
+		Err    string
+	}
+	if err := call(meta, &rmsg, "read", "direct"); err != nil || len(rmsg.Err) > 0 {
+		t.Fatalf("read: %v %s", err, rmsg.Err)
+	}
+	if rmsg.Addr != node.addr {
+		t.Fatalf("read sent to %q instead of the node process", rmsg.Addr)
+	}
+	s := dialSession(t, rmsg.Addr)
+	defer s.conn.Close()
+	msg := &Message{Command: "read", Args: []string{"direct", "0", "-1"}}
+	if err := s.encoder.Encode(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.encoder.Encode(rmsg.Result); err != nil {
+		t.Fatal(err)
+	}
+	var content string
+	for {
+		var piece ReadPiece
+		if err := s.decoder.Decode(&piece); err != nil || len(piece.Err) > 0 {
+			t.Fatalf("read: %v %s", err, piece.Err)
+		}
+		if len(piece.Data) == 0 {
+			break
+		}
+		content += string(piece.Data)
+	}
+	if content != data {
+		t.Errorf("read %q from the node process, expected %q", content, data)
+	}
+
+	// the chunk server of the metadata server holds no primary of the file:
+	// it refuses writes and forwards record appends to the node process
+	chunkServer := dialSession(t, ":"+os.Getenv("CHUNK_SERVER_PORT"))
+	defer chunkServer.conn.Close()
+	var reply struct {
+		Result string
+		Err    string
+	}
+	for _, value := range []interface{}{&Message{Command: "write", Args: []string{"direct"}}, rmsg.Result, []byte("x"), []byte{}} {
+		if err := chunkServer.encoder.Encode(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := chunkServer.decoder.Decode(&reply); err != nil || !strings.Contains(reply.Err, "not served here") {
+		t.Errorf("write away from the primary answered %+v: %v", reply, err)
+	}
+	var appended struct {
+		Result int
+		Err    string
+	}
+	if err := chunkServer.encoder.Encode(&Message{Command: "recordappend", Args: []string{"direct"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunkServer.encoder.Encode([]byte("rec")); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunkServer.decoder.Decode(&appended); err != nil || len(appended.Err) > 0 || appended.Result != len(data) {
+		t.Errorf("forwarded record append answered %+v: %v", appended, err)
+	}
+	if size := master.FileSize("direct"); size != len(data)+3 {
+		t.Errorf("file has %d bytes after the record append, expected %d", size, len(data)+3)
+	}
+
+	// whether a remote node runs comes from the heartbeat replies
+	node.updateLiveness([]int{0, 2})
+	for nodeID, running := range map[int]bool{0: false, 1: true, 2: false, 3: true} {
+		if node.node(nodeID).IsRunning() != running {
+			t.Errorf("node %d running is %v after the heartbeat reply", nodeID, !running)
+		}
+	}
+}
+
+// TestHelperProcess is not a test. It runs the metadata server or a chunk
+// node in a process of its own for startHelperProcess.
+func TestHelperProcess(t *testing.T) {
+	switch os.Getenv("GOSIMDFS_HELPER") {
+	case "master":
+		port, _ := strconv.Atoi(os.Getenv("META_SERVER_PORT"))
+		master := NewMasterServer("metadata", map[string]interface{}{
+			"port": port, "metadir": os.Getenv("GOSIMDFS_METADIR"), "chunksize": 10,
+			"heartbeatinterval": 20, "heartbeatmisses": 50, "replicationinterval": 0, "gcinterval": 0})
+		master.Run()
+	case "chunknode":
+		nodeID, _ := strconv.Atoi(os.Getenv("GOSIMDFS_NODE"))
+		node, err := NewChunkNode("chunk node", map[string]interface{}{"id": nodeID, "rack": -1, "master": ":" + os.Getenv("META_SERVER_PORT")})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		node.Run()
+	}
+}
+
+// startHelperProcess runs TestHelperProcess in a new process of the test
+// binary as the given role, with env added to the environment.
+func startHelperProcess(t *testing.T, role string, env ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+	cmd.Env = append(append(os.Environ(), "GOSIMDFS_HELPER="+role), env...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+func stopHelperProcess(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+	cmd.Wait()
+}
+
+// memberAddrOf waits until the metadata server knows where a node process
+// runs and returns its address.
+func memberAddrOf(t *testing.T, addr string, nodeID int) string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		meta := dialSession(t, addr)
+		var rmsg struct {
+			Result string
+			Err    string
+		}
+		err := call(meta, &rmsg, "nodestat", strconv.Itoa(nodeID))
+		meta.conn.Close()
+		if start := strings.Index(rmsg.Result, " at "); err == nil && start >= 0 {
+			stat := rmsg.Result[start+len(" at "):]
+			return stat[:strings.Index(stat, ")")]
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("node %d never joined: %v %s", nodeID, err, rmsg.Result)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestChunkNodeRejoinsRestartedMaster(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rejoin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	metaPort, chunkPort := freePort(t), freePort(t)
+	os.Setenv("META_SERVER_PORT", strconv.Itoa(metaPort))
+	os.Setenv("CHUNK_SERVER_PORT", strconv.Itoa(chunkPort))
+	addr := fmt.Sprintf(":%d", metaPort)
+	master := startHelperProcess(t, "master", "GOSIMDFS_METADIR="+dir)
+	defer func() { stopHelperProcess(master) }()
+	waitForPorts(t, metaPort, chunkPort)
+	node := startHelperProcess(t, "chunknode", "GOSIMDFS_NODE=1")
+	defer stopHelperProcess(node)
+	nodeAddr := memberAddrOf(t, addr, 1)
+
+	// with the other nodes stopped the only copies are in the node process
+	meta := dialSession(t, addr)
+	var reply struct {
+		Result string
+		Err    string
+	}
+	for _, nodeID := range []int{0, 2, 3} {
+		if err := call(meta, &reply, "stopnode", strconv.Itoa(nodeID)); err != nil || len(reply.Err) > 0 {
+			t.Fatalf("stopnode: %v %s", err, reply.Err)
+		}
+	}
+	meta.conn.Close()
+	data := "kept by a node process"
+	writeFile(t, addr, "spawned", []byte(data))
+
+	// a restarted metadata server learns where the node runs from its
+	// heartbeats and reads the file through it
+	stopHelperProcess(master)
+	master = startHelperProcess(t, "master", "GOSIMDFS_METADIR="+dir)
+	waitForPorts(t, metaPort, chunkPort)
+	if rejoined := memberAddrOf(t, addr, 1); rejoined != nodeAddr {
+		t.Fatalf("node 1 rejoined at %s, it runs at %s", rejoined, nodeAddr)
+	}
+	meta = dialSession(t, addr)
+	defer meta.conn.Close()
+	var rmsg struct {
+		Result *File
+		Addr   string
+		Err    string
+	}
+	if err := call(meta, &rmsg, "read", "spawned"); err != nil || len(rmsg.Err) > 0 {
+		t.Fatalf("read: %v %s", err, rmsg.Err)
+	}
+	if rmsg.Addr != nodeAddr {
+		t.Errorf("read sent to %q instead of the node process at %s", rmsg.Addr, nodeAddr)
+	}
+	if content, _ := readRange(t, rmsg.Result, 0, -1); content != data {
+		t.Errorf("read %q through the restarted chunk server, expected %q", content, data)
+	}
+}
+
+func TestNodeStatShowsDrainProgress(t *testing.T) {
+	master, addr := startTestCluster(t, map[string]interface{}{"heartbeatinterval": 0, "replicationinterval": 0})
+	writeFile(t, addr, "draining", []byte("some chunk data"))
+	drained := validCopies(master, "draining")[0]
+	// a decommission that has not moved anything yet
+	master.mutex.Lock()
+	master.draining[drained] = master.copiesOn(drained)
+	master.mutex.Unlock()
+
+	meta := dialSession(t, addr)
+	defer meta.conn.Close()
+	var rmsg struct {
+		Result string
+		Err    string
+	}
+	if err := call(meta, &rmsg, "nodestat"); err != nil || len(rmsg.Err) > 0 {
+		t.Fatalf("nodestat: %v %s", err, rmsg.Err)
+	}
+	lines := strings.Split(strings.TrimSpace(rmsg.Result), "\n")
+	if len(lines) != master.ROW+1 {
+		t.Fatalf("nodestat has %d lines for %d nodes: %q", len(lines), master.ROW, rmsg.Result)
+	}
+	for nodeID, line := range lines[1:] {
+		draining := strings.HasSuffix(line, "decommissioning: 0 of 1 chunk copies moved, 1 left")
+		if draining != (nodeID == drained) {
+			t.Errorf("unexpected stat of node %d: %q", nodeID, line)
+		}
+	}
+}
+
+func TestAddAndDecommissionNode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "membership")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	master, addr := startTestCluster(t, map[string]interface{}{
+		"chunksize": 10, "metadir": dir, "checkpointinterval": 0, "heartbeatinterval": 0, "gcinterval": 0})
+	nodeID, err := master.AddNode(2, 500)
+	if err != nil || nodeID != 4 {
+		t.Fatalf("added node %d: %v", nodeID, err)
+	}
+	master.mutex.RLock()
+	rack, free := master.rackOf(nodeID), master.nodeMap[nodeID]
+	master.mutex.RUnlock()
+	if rack != 2 || free != 500 {
+		t.Fatalf("node %d is on rack %d with %d bytes free", nodeID, rack, free)
+	}
+
+	writeFile(t, addr, "drain", []byte("0123456789abcdefghijklmnopqrst"))
+	drained := validCopies(master, "drain")[0]
+	if err := master.Decommission(drained); err != nil {
+		t.Fatal(err)
+	}
+	if err := master.Decommission(drained); err == nil {
+		t.Error("decommissioned a node twice")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		master.mutex.RLock()
+		done := master.decommissioned[drained]
+		master.mutex.RUnlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("node %d was never drained: %s", drained, master.nodeStatByID(drained))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	entry, _ := master.Read("drain")
+	for _, chunk := range entry.getChunks() {
+		var copies int
+		for _, chunkCopy := range chunk.Read() {
+			if chunkCopy.Valid {
+				copies++
+			}
+			if chunkCopy.Node == drained {
+				t.Errorf("chunk %d still has a copy on node %d", chunk.Id(), drained)
+			}
+		}
+		if copies != 3 {
+			t.Errorf("chunk %d has %d valid copies", chunk.Id(), copies)
+		}
+	}
+	if stat := master.nodeStatByID(drained); !strings.HasSuffix(stat, "decommissioned") {
+		t.Errorf("unexpected node stat %q", stat)
+	}
+	if _, err := master.RegisterNode(drained, nil); err == nil {
+		t.Error("a decommissioned node rejoined")
+	}
+
+	// the added and the removed node survive a restart
+	recovered := NewMasterServer("metadata", map[string]interface{}{"metadir": dir})
+	if recovered.ROW != 5 || !recovered.decommissioned[drained] || recovered.rackOf(nodeID) != 2 {
+		t.Errorf("recovered %d nodes, decommissioned %v", recovered.ROW, recovered.decommissioned)
+	}
+}
+
+func TestBalanceMovesCopiesToEmptyNode(t *testing.T) {
+	master, addr := startTestCluster(t, map[string]interface{}{
+		"chunksize": 10, "heartbeatinterval": 0, "balanceinterval": 0, "balancebandwidth": 0, "gcinterval": 0})
+	data := []byte(strings.Repeat("0123456789", 40))
+	writeFile(t, addr, "balanced", data)
+	before, _ := master.Read("balanced")
+	nodeID, err := master.AddNode(1, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := master.Balance(101); err == nil {
+		t.Error("accepted a threshold above 100%")
+	}
+	moved, spread, err := master.Balance(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved == 0 || spread[1] >= spread[0] {
+		t.Fatalf("moved %d copies, usage gap went from %.1f%% to %.1f%%", moved, spread[0], spread[1])
+	}
+
+	master.mutex.RLock()
+	usage := master.usage(master.usedSpace())
+	master.mutex.RUnlock()
+	var average float64
+	for _, value := range usage {
+		average += value
+	}
+	average /= float64(len(usage))
+	for id, value := range usage {
+		if value > average+5 || value < average-5 {
+			t.Errorf("node %d is at %.1f%% after balancing, the average is %.1f%%", id, value, average)
+		}
+	}
+	entry, _ := master.Read("balanced")
+	var onNew int
+	for _, chunk := range entry.getChunks() {
+		var copies int
+		for _, chunkCopy := range chunk.Read() {
+			if chunkCopy.Valid {
+				copies++
+			}
+			if chunkCopy.Node == nodeID {
+				onNew++
+			}
+		}
+		if copies != 3 {
+			t.Errorf("chunk %d has %d valid copies", chunk.Id(), copies)
+		}
+	}
+	if onNew != moved {
+		t.Errorf("moved %d copies but node %d holds %d", moved, nodeID, onNew)
+	}
+	if content, _ := readRange(t, entry, 0, len(data)); content != string(data) {
+		t.Errorf("read %q after balancing", content)
+	}
+	// the moved copies wait for the garbage collector, a reader that looked
+	// up the file before can still read them
+	master.mutex.RLock()
+	garbage := len(master.garbage)
+	master.mutex.RUnlock()
+	if garbage != moved {
+		t.Errorf("%d copies on the garbage list after moving %d", garbage, moved)
+	}
+	if content, _ := readRange(t, before, 0, len(data)); content != string(data) {
+		t.Errorf("read %q from the copies before balancing", content)
+	}
+}
+
+func TestBalanceWithoutThresholdTerminates(t *testing.T) {
+	master, addr := startTestCluster(t, map[string]interface{}{
+		"heartbeatinterval": 0, "balanceinterval": 0, "balancebandwidth": 0, "gcinterval": 0})
+	writeFile(t, addr, "unbalanced", []byte(strings.Repeat("0123456789", 7)))
+	type result struct {
+		moved  int
+		spread [2]float64
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		moved, spread, err := master.Balance(0)
+		done <- result{moved, spread, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if r.spread[1] > r.spread[0] {
+			t.Errorf("moved %d copies, usage gap went from %.1f%% to %.1f%%", r.moved, r.spread[0], r.spread[1])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("balancing without a threshold never ends")
+	}
+	master.mutex.RLock()
+	garbage := len(master.garbage)
+	master.mutex.RUnlock()
+	if garbage > 1 {
+		t.Errorf("%d copies on the garbage list after balancing a single chunk", garbage)
+	}
+}
+
+func TestReedSolomonReconstruct(t *testing.T) {
+	rs := newReedSolomon(ErasureScheme{Data: 6, Parity: 3})
+	data := []byte("any six of the nine shards bring the chunk back")
+	shards := rs.encode(data)
+	// every way of losing three shards
+	for a := 0; a < len(shards); a++ {
+		for b := a + 1; b < len(shards); b++ {
+			for c := b + 1; c < len(shards); c++ {
+				damaged := append([][]byte(nil), shards...)
+				damaged[a], damaged[b], damaged[c] = nil, nil, nil
+				if err := rs.reconstruct(damaged); err != nil {
+					t.Fatal(err)
+				}
+				if got := rs.join(damaged, len(data)); string(got) != string(data) {
+					t.Fatalf("lost shards %d, %d and %d, decoded %q", a, b, c, got)
+				}
+			}
+		}
+	}
+	shards[0], shards[1], shards[2], shards[3] = nil, nil, nil, nil
+	if err := rs.reconstruct(shards); err == nil {
+		t.Error("decoded a chunk from five shards")
+	}
+}
+
+func TestErasureCodedFile(t *testing.T) {
+	master, addr := startTestCluster(t, map[string]interface{}{
+		"nodes": 12, "chunksize": 60, "heartbeatinterval": 0, "balanceinterval": 0, "replicationinterval": 1})
+	scheme := ErasureScheme{Data: 6, Parity: 3}
+	if _, err := master.WriteErasureCoded("coded", scheme); err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(strings.Repeat("erasure coding.", 20))
+	writeFile(t, addr, "coded", data)
+	if err := master.SetReplication("coded", 2); err == nil {
+		t.Error("set the replication factor of an erasure coded file")
+	}
+
+	// complete reports whether every chunk has all its shards on running
+	// nodes, checking their placement on the way
+	complete := func() bool {
+		entry, err := master.Read("coded")
+		if err != nil {
+			t.Fatal(err)
+		}
+		master.mutex.RLock()
+		defer master.mutex.RUnlock()
+		var stored int
+		for _, chunk := range entry.getChunks() {
+			shards, racks := map[int]bool{}, map[int]int{}
+			for _, chunkCopy := range chunk.Read() {
+				if chunkCopy.Valid && !master.downNodes[chunkCopy.Node] {
+					shards[chunkCopy.Shard] = true
+					racks[master.rackOf(chunkCopy.Node)]++
+					stored += chunkCopy.Size
+				}
+			}
+			for rack, count := range racks {
+				if count > scheme.Parity {
+					t.Fatalf("rack %d holds %d shards of chunk %d", rack, count, chunk.Id())
+				}
+			}
+			if len(shards) != scheme.Shards() {
+				return false
+			}
+		}
+		if stored != len(data)*3/2 {
+			t.Fatalf("stored %d bytes for %d bytes of data", stored, len(data))
+		}
+		return true
+	}
+	if !complete() {
+		t.Fatal("chunks were written without all their shards")
+	}
+
+	// losing three shards of a chunk, data shards included, still reads
+	entry, _ := master.Read("coded")
+	for _, chunkCopy := range entry.getChunks()[0].Read()[:scheme.Parity] {
+		if err := master.StopNode(chunkCopy.Node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entry, _ = master.Read("coded")
+	if content, _ := readRange(t, entry, 0, len(data)); content != string(data) {
+		t.Fatalf("read %q with shards missing", content)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !complete() {
+		if time.Now().After(deadline) {
+			t.Fatal("missing shards were never reconstructed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	entry, _ = master.Read("coded")
+	if content, _ := readRange(t, entry, 0, len(data)); content != string(data) {
+		t.Errorf("read %q after reconstruction", content)
+	}
+	if stat, _ := master.FileStat("coded"); !strings.Contains(stat, "RS(6,3)") || !strings.Contains(stat, "1.50x") {
+		t.Errorf("unexpected file stat %q", stat)
+	}
+}
@@ -0,0 +1,19 @@
+package server
+
+import (
+	"encoding/gob"
+	"net"
+)
+
+// session is an accepted connection together with the gob codec bound to it.
+// Each connection gets its own session so that replies always go back on the
+// connection that sent the request.
+type session struct {
+	conn    net.Conn
+	encoder *gob.Encoder
+	decoder *gob.Decoder
+}
+
+func newSession(conn net.Conn) *session {
+	return &session{conn: conn, encoder: gob.NewEncoder(conn), decoder: gob.NewDecoder(conn)}
+}
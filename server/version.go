@@ -0,0 +1,66 @@
+package server
+
+import (
+	"log"
+)
+
+// Every chunk carries a version number, and so does every copy of it. The
+// metadata server raises the version of the last chunk of a file whenever it
+// grants a new lease on the file, and only the copies on running nodes are
+// brought along. A copy on a stopped node keeps its old version, so when the
+// node comes back its copy is known to be stale: it is dropped from the
+// chunk, never read again and left to the garbage collector. Chunks written
+// by a mutation take the version after that of the chunk they replace.
+
+// stampVersions numbers the chunks written by a mutation, the first of which
+// takes the place of replaced[from].
+func stampVersions(chunks []ChunkEntry, replaced []ChunkEntry, from int) {
+	for i, chunk := range chunks {
+		metadata, ok := chunk.(*ChunkMetadata)
+		if !ok {
+			continue
+		}
+		metadata.Version = 1
+		if from+i < len(replaced) {
+			metadata.Version = replaced[from+i].GetVersion() + 1
+		}
+		for j := range metadata.Copies {
+			metadata.Copies[j].Version = metadata.Version
+		}
+	}
+}
+
+// applyVersion raises the version of the last chunk of a file. Copies that
+// are invalid or on stopped nodes become stale and go to the garbage list,
+// unless no copy would be left, in which case the version stays as it is.
+func (m *MasterNode) applyVersion(filename string) {
+	entry, ok := m.files[filename]
+	if !ok || len(entry.getChunks()) == 0 {
+		return
+	}
+	chunks := entry.getChunks()
+	last, ok := chunks[len(chunks)-1].(*ChunkMetadata)
+	if !ok {
+		return
+	}
+	var current, stale []Copy
+	for _, chunkCopy := range last.Copies {
+		if chunkCopy.Valid && !m.downNodes[chunkCopy.Node] && chunkCopy.Version >= last.Version {
+			chunkCopy.Version = last.Version + 1
+			current = append(current, chunkCopy)
+		} else {
+			stale = append(stale, chunkCopy)
+		}
+	}
+	if len(current) == 0 {
+		// the copies on stopped nodes may still come back
+		log.Printf("chunk %d of %s has no current copy on a running node, version %d kept\n", last.Index, filename, last.Version)
+		return
+	}
+	last.Version++
+	for _, chunkCopy := range stale {
+		log.Printf("copy of chunk %d of %s on node %d is stale at version %d\n", last.Index, filename, chunkCopy.Node, chunkCopy.Version)
+		m.garbage = append(m.garbage, chunkCopy)
+	}
+	last.Copies = current
+}